@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat string
+
+const (
+	AccessLogCommon   AccessLogFormat = "common"
+	AccessLogCombined AccessLogFormat = "combined"
+	AccessLogJSON     AccessLogFormat = "json"
+)
+
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch f := AccessLogFormat(s); f {
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown access log format: %q", s)
+	}
+}
+
+// AccessLogEntry describes a single handled request.
+type AccessLogEntry struct {
+	Time        time.Time     `json:"time"`
+	RemoteAddr  string        `json:"remote_addr"`
+	User        string        `json:"user,omitempty"`
+	Method      string        `json:"method"`
+	Target      string        `json:"target"`
+	Version     string        `json:"version"`
+	Status      int           `json:"status"`
+	Duration    time.Duration `json:"-"`
+	RequestSize int64         `json:"request_size"`
+	// ResponseSize counts the bytes written to the connection, BodySize only
+	// those of the body, the size reported by the common log format.
+	ResponseSize int64  `json:"response_size"`
+	BodySize     int64  `json:"body_size"`
+	UserAgent    string `json:"user_agent,omitempty"`
+	Referer      string `json:"referer,omitempty"`
+	RequestID    string `json:"request_id,omitempty"`
+}
+
+// AccessLogger writes one line per request in the configured format.
+// When backed by a file, Reopen can be used to cooperate with logrotate.
+type AccessLogger struct {
+	format AccessLogFormat
+	path   string
+	log    *slog.Logger
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// NewAccessLogger creates an access logger writing to path, "-" means stdout.
+func NewAccessLogger(path string, format AccessLogFormat, logger *slog.Logger) (*AccessLogger, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	l := &AccessLogger{
+		format: format,
+		path:   path,
+		log:    logger,
+	}
+
+	if path == "-" {
+		l.w = os.Stdout
+		return l, nil
+	}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reopen closes and reopens the underlying log file.
+func (l *AccessLogger) Reopen() error {
+	if l.path == "" || l.path == "-" {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.file = f
+	l.w = f
+	l.mu.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// ReopenOnSignal reopens the log file every time one of sigs is received.
+func (l *AccessLogger) ReopenOnSignal(sigs ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		for sig := range ch {
+			if err := l.Reopen(); err != nil {
+				l.log.Error("could not reopen access log", slog.String("signal", sig.String()), slog.String("error", err.Error()))
+				continue
+			}
+			l.log.Info("reopened access log", slog.String("path", l.path))
+		}
+	}()
+}
+
+func (l *AccessLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	l.w = io.Discard
+	return err
+}
+
+func (l *AccessLogger) Log(e AccessLogEntry) {
+	line := l.format.Format(e)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.w, line); err != nil {
+		l.log.Warn("could not write access log", slog.String("error", err.Error()))
+	}
+}
+
+// Format renders e as a single newline-terminated line. Fields taken from the
+// request are quoted and escaped so they cannot break the line apart.
+func (f AccessLogFormat) Format(e AccessLogEntry) string {
+	switch f {
+	case AccessLogJSON:
+		return formatJSONAccessLog(e)
+	case AccessLogCombined:
+		return fmt.Sprintf("%s %q %q\n", formatCommonAccessLog(e), dashIfEmpty(e.Referer), dashIfEmpty(e.UserAgent))
+	default:
+		return formatCommonAccessLog(e) + "\n"
+	}
+}
+
+func formatCommonAccessLog(e AccessLogEntry) string {
+	return fmt.Sprintf("%s - %s [%s] %q %d %s",
+		dashIfEmpty(e.RemoteAddr),
+		dashIfEmpty(e.User),
+		e.Time.Format(clfTimeLayout),
+		e.Method+" "+e.Target+" "+e.Version,
+		e.Status,
+		clfSize(e.BodySize),
+	)
+}
+
+func formatJSONAccessLog(e AccessLogEntry) string {
+	type jsonEntry struct {
+		AccessLogEntry
+		DurationMs float64 `json:"duration_ms"`
+	}
+	buff, err := json.Marshal(jsonEntry{
+		AccessLogEntry: e,
+		DurationMs:     float64(e.Duration.Microseconds()) / 1000,
+	})
+	if err != nil {
+		return "{}\n"
+	}
+	return string(buff) + "\n"
+}
+
+func clfSize(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormat(t *testing.T) {
+	entry := AccessLogEntry{
+		Time:         time.Date(2024, time.March, 10, 13, 55, 36, 0, time.UTC),
+		RemoteAddr:   "127.0.0.1",
+		Method:       MethodGet,
+		Target:       "/echo/abc",
+		Version:      "HTTP/1.1",
+		Status:       StatusOK,
+		Duration:     1500 * time.Microsecond,
+		RequestSize:  0,
+		ResponseSize: 42,
+		BodySize:     3,
+		UserAgent:    "curl/8.2.1",
+		Referer:      "http://example.com/",
+		RequestID:    "abc123",
+	}
+
+	quoted := entry
+	quoted.Target = `/echo/a"b\c`
+
+	testCases := []struct {
+		desc   string
+		format AccessLogFormat
+		entry  AccessLogEntry
+		want   string
+	}{
+		{
+			desc:   "common log format",
+			format: AccessLogCommon,
+			entry:  entry,
+			want:   "127.0.0.1 - - [10/Mar/2024:13:55:36 +0000] \"GET /echo/abc HTTP/1.1\" 200 3\n",
+		},
+		{
+			desc:   "combined log format",
+			format: AccessLogCombined,
+			entry:  entry,
+			want:   "127.0.0.1 - - [10/Mar/2024:13:55:36 +0000] \"GET /echo/abc HTTP/1.1\" 200 3 \"http://example.com/\" \"curl/8.2.1\"\n",
+		},
+		{
+			desc:   "request line with quotes is escaped",
+			format: AccessLogCommon,
+			entry:  quoted,
+			want:   "127.0.0.1 - - [10/Mar/2024:13:55:36 +0000] \"GET /echo/a\\\"b\\\\c HTTP/1.1\" 200 3\n",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if got := tC.format.Format(tC.entry); got != tC.want {
+				t.Errorf("invalid log line, wanted: '%s', got: '%s'", tC.want, got)
+			}
+		})
+	}
+
+	t.Run("json log format", func(t *testing.T) {
+		line := AccessLogJSON.Format(entry)
+		if !strings.HasSuffix(line, "\n") {
+			t.Errorf("wanted log line to end with a newline")
+		}
+		var got map[string]any
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("could not decode json log line: %v", err)
+		}
+		want := map[string]any{
+			"remote_addr":   "127.0.0.1",
+			"status":        float64(200),
+			"duration_ms":   1.5,
+			"response_size": float64(42),
+			"body_size":     float64(3),
+			"request_id":    "abc123",
+			"user_agent":    "curl/8.2.1",
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("invalid value of '%s', wanted: '%v', got: '%v'", k, v, got[k])
+			}
+		}
+	})
+}
+
+func TestAccessLoggerReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLogger(path, AccessLogCommon, nil)
+	if err != nil {
+		t.Fatalf("could not create access logger: %v", err)
+	}
+	defer l.Close()
+
+	l.Log(AccessLogEntry{Method: MethodGet, Target: "/first", Version: "HTTP/1.1", Status: StatusOK})
+
+	// Simulate logrotate moving the file away.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("could not rotate log file: %v", err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("could not reopen log file: %v", err)
+	}
+
+	l.Log(AccessLogEntry{Method: MethodGet, Target: "/second", Version: "HTTP/1.1", Status: StatusOK})
+
+	rotated, _ := os.ReadFile(path + ".1")
+	current, _ := os.ReadFile(path)
+	if !strings.Contains(string(rotated), "/first") || strings.Contains(string(rotated), "/second") {
+		t.Errorf("invalid rotated log contents: '%s'", rotated)
+	}
+	if !strings.Contains(string(current), "/second") || strings.Contains(string(current), "/first") {
+		t.Errorf("invalid current log contents: '%s'", current)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HeaderAuthorization   = "Authorization"
+	HeaderWWWAuthenticate = "WWW-Authenticate"
+
+	// sha256Prefix marks htpasswd entries holding a base64 encoded SHA-256
+	// digest of the password instead of a bcrypt hash.
+	sha256Prefix = "{SHA256}"
+)
+
+var (
+	ErrNoCredentials      = errors.New("http: request has no credentials")
+	ErrInvalidCredentials = errors.New("http: invalid credentials")
+	ErrUnsupportedHash    = errors.New("http: unsupported password hash")
+)
+
+// Htpasswd holds users and password hashes read from an htpasswd-style file.
+type Htpasswd struct {
+	hashes map[string]string
+	// dummy is checked for unknown users, so they take as long to reject as
+	// known ones and user names cannot be probed through timing.
+	dummy string
+}
+
+// LoadHtpasswd reads "user:hash" lines, hashes being bcrypt ($2a$, $2b$,
+// $2y$) or {SHA256} followed by the base64 encoded digest. Empty lines and
+// lines starting with "#" are ignored.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{hashes: map[string]string{}}
+	maxCost := 0
+	err := readCredentialsFile(path, func(user, hash string) error {
+		if strings.HasPrefix(hash, sha256Prefix) {
+			digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, sha256Prefix))
+			if err != nil || len(digest) != sha256.Size {
+				return ErrUnsupportedHash
+			}
+		} else if cost, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return ErrUnsupportedHash
+		} else {
+			maxCost = max(maxCost, cost)
+		}
+		h.hashes[user] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The dummy costs as much as the slowest hash of the file.
+	sum := sha256.Sum256(nil)
+	h.dummy = sha256Prefix + base64.StdEncoding.EncodeToString(sum[:])
+	if maxCost > 0 {
+		dummy, err := bcrypt.GenerateFromPassword(nil, maxCost)
+		if err != nil {
+			return nil, err
+		}
+		h.dummy = string(dummy)
+	}
+	return h, nil
+}
+
+// Authenticate reports whether password matches the hash of user.
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	hash, known := h.hashes[user]
+	if !known {
+		hash = h.dummy
+	}
+	return passwordMatches(hash, password) && known
+}
+
+func passwordMatches(hash, password string) bool {
+	if digest, ok := strings.CutPrefix(hash, sha256Prefix); ok {
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(digest)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Tokens maps bearer tokens to the name of their owner.
+type Tokens struct {
+	// owners is keyed by the SHA-256 digest of the token so that lookups do
+	// not leak the token through timing.
+	owners map[[sha256.Size]byte]string
+}
+
+// LoadTokens reads "name:token" lines, empty lines and lines starting with
+// "#" are ignored.
+func LoadTokens(path string) (*Tokens, error) {
+	t := &Tokens{owners: map[[sha256.Size]byte]string{}}
+	err := readCredentialsFile(path, func(name, token string) error {
+		t.owners[sha256.Sum256([]byte(token))] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Lookup returns the owner of token.
+func (t *Tokens) Lookup(token string) (string, bool) {
+	name, ok := t.owners[sha256.Sum256([]byte(token))]
+	return name, ok
+}
+
+func readCredentialsFile(path string, add func(name, secret string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, secret, ok := strings.Cut(line, ":")
+		if !ok || name == "" || secret == "" {
+			return fmt.Errorf("%s:%d: expected 'name:secret'", path, n)
+		}
+		if err := add(name, secret); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return sc.Err()
+}
+
+// Authenticator verifies Basic credentials against Users and Bearer tokens
+// against Tokens, either may be nil to disable the scheme.
+type Authenticator struct {
+	Realm  string
+	Users  *Htpasswd
+	Tokens *Tokens
+}
+
+// Authenticate returns the user named by the Authorization header of req.
+func (a *Authenticator) Authenticate(req *HttpRequest) (string, error) {
+	scheme, credentials, _ := strings.Cut(req.Headers.Get(HeaderAuthorization), " ")
+	credentials = strings.TrimSpace(credentials)
+	switch {
+	case scheme == "":
+		return "", ErrNoCredentials
+	case strings.EqualFold(scheme, "Basic") && a.Users != nil:
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", ErrInvalidCredentials
+		}
+		user, password, ok := strings.Cut(string(decoded), ":")
+		if !ok || !a.Users.Authenticate(user, password) {
+			return "", ErrInvalidCredentials
+		}
+		return user, nil
+	case strings.EqualFold(scheme, "Bearer") && a.Tokens != nil:
+		name, ok := a.Tokens.Lookup(credentials)
+		if !ok {
+			return "", ErrInvalidCredentials
+		}
+		return name, nil
+	default:
+		return "", ErrInvalidCredentials
+	}
+}
+
+// Require returns a middleware letting through authenticated requests, only
+// those of the listed users when any are given. Requests without valid
+// credentials get 401 with a challenge per scheme, authenticated users not
+// listed get 403.
+func (a *Authenticator) Require(users ...string) Middleware {
+	return requireUser(a.Authenticate, a.challenges, users)
+}
+
+func requireUser(authenticate func(*HttpRequest) (string, error), challenges func(error) string, users []string) Middleware {
+	return func(next Handler) Handler {
+		return func(req *HttpRequest, res *HttpResponse) {
+			user, err := authenticate(req)
+			if err != nil {
+				res.Headers[HeaderWWWAuthenticate] = challenges(err)
+				res.ErrorFor(req, StatusUnauthorized, "")
+				return
+			}
+			if len(users) > 0 && !slices.Contains(users, user) {
+				res.ErrorFor(req, StatusForbidden, "")
+				return
+			}
+			req.user = user
+			next(req, res)
+		}
+	}
+}
+
+// challenges builds the WWW-Authenticate value, flagging a rejected bearer
+// token as RFC 6750 asks.
+func (a *Authenticator) challenges(err error) string {
+	realm := fmt.Sprintf("realm=%q", a.Realm)
+	var challenges []string
+	if a.Users != nil {
+		challenges = append(challenges, "Basic "+realm+`, charset="UTF-8"`)
+	}
+	if a.Tokens != nil {
+		bearer := "Bearer " + realm
+		if errors.Is(err, ErrInvalidCredentials) {
+			bearer += `, error="invalid_token"`
+		}
+		challenges = append(challenges, bearer)
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// authScheme is implemented by Authenticator and DigestAuthenticator.
+type authScheme interface {
+	Require(users ...string) Middleware
+	Protect(policy AuthPolicy, handler Handler) Handler
+}
+
+// AuthPolicy decides per method which requests to a route need credentials.
+type AuthPolicy struct {
+	// Public lists the methods served without authentication.
+	Public []string
+	// Users restricts the other methods to these users, any authenticated
+	// user is allowed when empty.
+	Users []string
+}
+
+// Protect applies policy to handler, typically a route registered for one
+// or several methods.
+func (a *Authenticator) Protect(policy AuthPolicy, handler Handler) Handler {
+	return policy.protect(a.Require(policy.Users...), handler)
+}
+
+func (p AuthPolicy) protect(require Middleware, handler Handler) Handler {
+	protected := require(handler)
+	return func(req *HttpRequest, res *HttpResponse) {
+		method := req.Method
+		if method == MethodHead {
+			// HEAD is served by the GET handler and shares its policy.
+			method = MethodGet
+		}
+		if slices.Contains(p.Public, req.Method) || slices.Contains(p.Public, method) {
+			handler(req, res)
+			return
+		}
+		protected(req, res)
+	}
+}
+
+// User returns the name authenticated by the auth middleware, "" otherwise.
+func (r *HttpRequest) User() string {
+	return r.user
+}
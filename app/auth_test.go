@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeCredentialsFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write credentials file: %v", err)
+	}
+	return path
+}
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+	sum := sha256.Sum256([]byte("hunter2"))
+
+	users, err := LoadHtpasswd(writeCredentialsFile(t, "# users\nalice:"+string(hash)+"\n\nbob:{SHA256}"+base64.StdEncoding.EncodeToString(sum[:])+"\n"))
+	if err != nil {
+		t.Fatalf("could not load htpasswd: %v", err)
+	}
+	tokens, err := LoadTokens(writeCredentialsFile(t, "ci:tok:en\n"))
+	if err != nil {
+		t.Fatalf("could not load tokens: %v", err)
+	}
+	return &Authenticator{Realm: "files", Users: users, Tokens: tokens}
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestLoadHtpasswdErrors(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		content string
+		wantErr error
+	}{
+		{desc: "md5 hash", content: "alice:$apr1$abc$def\n", wantErr: ErrUnsupportedHash},
+		{desc: "short sha256 digest", content: "alice:{SHA256}YWJj\n", wantErr: ErrUnsupportedHash},
+		{desc: "missing hash", content: "alice\n"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := LoadHtpasswd(writeCredentialsFile(t, tC.content))
+			if err == nil {
+				t.Fatal("wanted an error, got none")
+			}
+			if tC.wantErr != nil && !errors.Is(err, tC.wantErr) {
+				t.Errorf("invalid error, wanted: '%v', got: '%v'", tC.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHtpasswdUnknownUser(t *testing.T) {
+	users := newTestAuthenticator(t).Users
+	// Unknown users go through a hash as costly as the real ones.
+	if cost, err := bcrypt.Cost([]byte(users.dummy)); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("invalid dummy hash cost, wanted: %d, got: %d (err: %v)", bcrypt.MinCost, cost, err)
+	}
+	for _, password := range []string{"", "secret"} {
+		if users.Authenticate("mallory", password) {
+			t.Errorf("wanted unknown user to be rejected with password '%s'", password)
+		}
+	}
+}
+
+func TestAuthenticatorProtect(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	var gotUser string
+	handler := auth.Protect(AuthPolicy{Public: []string{MethodGet}, Users: []string{"alice", "bob", "ci"}}, func(req *HttpRequest, res *HttpResponse) {
+		gotUser = req.User()
+	})
+	adminOnly := auth.Protect(AuthPolicy{Users: []string{"alice"}}, func(req *HttpRequest, res *HttpResponse) {
+		gotUser = req.User()
+	})
+
+	testCases := []struct {
+		desc          string
+		handler       Handler
+		method        string
+		authorization string
+		wantStatus    int
+		wantUser      string
+		wantChallenge string
+	}{
+		{desc: "anonymous get", handler: handler, method: MethodGet, wantStatus: StatusOK},
+		{desc: "anonymous head", handler: handler, method: MethodHead, wantStatus: StatusOK},
+		{
+			desc: "anonymous post", handler: handler, method: MethodPost, wantStatus: StatusUnauthorized,
+			wantChallenge: `Basic realm="files", charset="UTF-8", Bearer realm="files"`,
+		},
+		{desc: "bcrypt password", handler: handler, method: MethodPost, authorization: basicAuth("alice", "secret"), wantStatus: StatusOK, wantUser: "alice"},
+		{desc: "sha256 password", handler: handler, method: MethodPost, authorization: basicAuth("bob", "hunter2"), wantStatus: StatusOK, wantUser: "bob"},
+		{
+			desc: "wrong password", handler: handler, method: MethodPost, authorization: basicAuth("alice", "nope"), wantStatus: StatusUnauthorized,
+			wantChallenge: `Basic realm="files", charset="UTF-8", Bearer realm="files", error="invalid_token"`,
+		},
+		{
+			desc: "unknown user", handler: handler, method: MethodPost, authorization: basicAuth("mallory", "secret"), wantStatus: StatusUnauthorized,
+			wantChallenge: `Basic realm="files", charset="UTF-8", Bearer realm="files", error="invalid_token"`,
+		},
+		{desc: "bearer token", handler: handler, method: MethodPost, authorization: "Bearer tok:en", wantStatus: StatusOK, wantUser: "ci"},
+		{
+			desc: "invalid bearer token", handler: handler, method: MethodPost, authorization: "bearer nope", wantStatus: StatusUnauthorized,
+			wantChallenge: `Basic realm="files", charset="UTF-8", Bearer realm="files", error="invalid_token"`,
+		},
+		{desc: "user not allowed", handler: adminOnly, method: MethodGet, authorization: basicAuth("bob", "hunter2"), wantStatus: StatusForbidden},
+		{desc: "allowed user", handler: adminOnly, method: MethodGet, authorization: basicAuth("alice", "secret"), wantStatus: StatusOK, wantUser: "alice"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			gotUser = ""
+			req := &HttpRequest{Method: tC.method, Target: "/files/a", Headers: HttpHeaders{}}
+			if tC.authorization != "" {
+				req.Headers[HeaderAuthorization] = tC.authorization
+			}
+			res := newCleanResponse()
+			tC.handler(req, res)
+
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+			if gotUser != tC.wantUser {
+				t.Errorf("invalid user, wanted: '%s', got: '%s'", tC.wantUser, gotUser)
+			}
+			if challenge := res.Headers[HeaderWWWAuthenticate]; challenge != tC.wantChallenge {
+				t.Errorf("invalid challenge, wanted: '%s', got: '%s'", tC.wantChallenge, challenge)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderCookie    = "Cookie"
+	HeaderSetCookie = "Set-Cookie"
+)
+
+var (
+	ErrNoCookie             = errors.New("http: named cookie not present")
+	ErrInvalidCookieName    = errors.New("http: invalid cookie name")
+	ErrInvalidCookieValue   = errors.New("http: invalid cookie value")
+	ErrInvalidCookiePath    = errors.New("http: invalid cookie path")
+	ErrInvalidCookieDomain  = errors.New("http: invalid cookie domain")
+	ErrInvalidCookieExpires = errors.New("http: invalid cookie expiry date")
+	ErrInsecureCookie       = errors.New("http: cookie requires the Secure attribute")
+)
+
+type SameSite int
+
+const (
+	// SameSiteDefault omits the attribute and leaves the policy to the browser.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is an HTTP cookie as sent in Cookie and Set-Cookie headers (RFC 6265).
+// Only Name and Value are populated for request cookies.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path   string
+	Domain string
+	// Expires is omitted when zero.
+	Expires time.Time
+	// MaxAge is omitted when zero, a negative value deletes the cookie right away.
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+	// Partitioned stores the cookie per top-level site (CHIPS), it requires Secure.
+	Partitioned bool
+}
+
+// Valid reports the first problem that would make browsers reject the cookie.
+func (c *Cookie) Valid() error {
+	if !cookieNameIsValid(c.Name) {
+		return ErrInvalidCookieName
+	}
+	if !cookieValueIsValid(strings.Trim(c.Value, `"`)) {
+		return ErrInvalidCookieValue
+	}
+	if strings.ContainsFunc(c.Path, func(r rune) bool { return r < 0x20 || r == 0x7f || r == ';' }) {
+		return ErrInvalidCookiePath
+	}
+	if c.Domain != "" && !cookieDomainIsValid(c.Domain) {
+		return ErrInvalidCookieDomain
+	}
+	if !c.Expires.IsZero() && c.Expires.Year() < 1601 {
+		return ErrInvalidCookieExpires
+	}
+	if (c.Partitioned || c.SameSite == SameSiteNone) && !c.Secure {
+		return ErrInsecureCookie
+	}
+	return nil
+}
+
+// String renders c as a Set-Cookie header value.
+func (c *Cookie) String() string {
+	var sb strings.Builder
+	sb.WriteString(c.Name + "=")
+	if strings.ContainsAny(c.Value, " ,") && !strings.HasPrefix(c.Value, `"`) {
+		sb.WriteString(`"` + c.Value + `"`)
+	} else {
+		sb.WriteString(c.Value)
+	}
+
+	if c.Path != "" {
+		sb.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		sb.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		sb.WriteString("; Expires=" + c.Expires.UTC().Format(TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		sb.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		sb.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		sb.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		sb.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		sb.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		sb.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		sb.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		sb.WriteString("; Partitioned")
+	}
+	return sb.String()
+}
+
+// SetCookie adds a Set-Cookie header to the response, invalid cookies are
+// rejected instead of being sent.
+func (r *HttpResponse) SetCookie(c *Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	r.cookies = append(r.cookies, c.String())
+	return nil
+}
+
+// Cookies parses the Cookie header, malformed pairs are skipped.
+func (r *HttpRequest) Cookies() []*Cookie {
+	var cookies []*Cookie
+	for _, pair := range strings.Split(r.Headers.Get(HeaderCookie), ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !cookieNameIsValid(name) {
+			continue
+		}
+		if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if !cookieValueIsValid(value) {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// Cookie returns the first request cookie called name.
+func (r *HttpRequest) Cookie(name string) (*Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCookie
+}
+
+// cookieNameIsValid reports whether name is an RFC 9110 token.
+func cookieNameIsValid(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// cookieValueIsValid reports whether value only has cookie-octets, spaces and
+// commas are accepted as well since values holding them get quoted.
+func cookieValueIsValid(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < ' ' || c >= 0x7f || c == '"' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func cookieDomainIsValid(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || len(domain) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
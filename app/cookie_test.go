@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieString(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		cookie Cookie
+		want   string
+	}{
+		{
+			desc:   "name and value",
+			cookie: Cookie{Name: "id", Value: "abc"},
+			want:   "id=abc",
+		},
+		{
+			desc: "all attributes",
+			cookie: Cookie{
+				Name: "id", Value: "abc", Path: "/admin", Domain: ".example.com",
+				Expires: time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC), MaxAge: 3600,
+				Secure: true, HttpOnly: true, SameSite: SameSiteNone, Partitioned: true,
+			},
+			want: "id=abc; Path=/admin; Domain=example.com; Expires=Wed, 02 Jan 2030 03:04:05 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned",
+		},
+		{
+			desc:   "deleted cookie",
+			cookie: Cookie{Name: "id", MaxAge: -1, SameSite: SameSiteLax},
+			want:   "id=; Max-Age=0; SameSite=Lax",
+		},
+		{
+			desc:   "value with spaces is quoted",
+			cookie: Cookie{Name: "greeting", Value: "hello world"},
+			want:   `greeting="hello world"`,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if got := tC.cookie.String(); got != tC.want {
+				t.Errorf("invalid cookie, wanted: '%s', got: '%s'", tC.want, got)
+			}
+		})
+	}
+}
+
+func TestCookieValid(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		cookie  Cookie
+		wantErr error
+	}{
+		{desc: "valid", cookie: Cookie{Name: "id", Value: "abc", Path: "/", Domain: "example.com"}},
+		{desc: "empty name", cookie: Cookie{Value: "abc"}, wantErr: ErrInvalidCookieName},
+		{desc: "separator in name", cookie: Cookie{Name: "a=b", Value: "abc"}, wantErr: ErrInvalidCookieName},
+		{desc: "semicolon in value", cookie: Cookie{Name: "id", Value: "a;b"}, wantErr: ErrInvalidCookieValue},
+		{desc: "control character in path", cookie: Cookie{Name: "id", Path: "/\n"}, wantErr: ErrInvalidCookiePath},
+		{desc: "invalid domain", cookie: Cookie{Name: "id", Domain: "exa mple.com"}, wantErr: ErrInvalidCookieDomain},
+		{desc: "ancient expiry", cookie: Cookie{Name: "id", Expires: time.Date(1500, 1, 1, 0, 0, 0, 0, time.UTC)}, wantErr: ErrInvalidCookieExpires},
+		{desc: "partitioned without secure", cookie: Cookie{Name: "id", Partitioned: true}, wantErr: ErrInsecureCookie},
+		{desc: "same site none without secure", cookie: Cookie{Name: "id", SameSite: SameSiteNone}, wantErr: ErrInsecureCookie},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if err := tC.cookie.Valid(); !errors.Is(err, tC.wantErr) {
+				t.Errorf("invalid error, wanted: '%v', got: '%v'", tC.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRequestCookies(t *testing.T) {
+	req := &HttpRequest{Headers: HttpHeaders{"Cookie": `id=abc; theme="dark"; broken; bad name=x; empty=`}}
+
+	cookies := req.Cookies()
+	var got []string
+	for _, c := range cookies {
+		got = append(got, c.Name+"="+c.Value)
+	}
+	if want := "id=abc theme=dark empty="; strings.Join(got, " ") != want {
+		t.Errorf("invalid cookies, wanted: '%s', got: '%s'", want, strings.Join(got, " "))
+	}
+
+	if c, err := req.Cookie("theme"); err != nil || c.Value != "dark" {
+		t.Errorf("wanted cookie 'theme' with value 'dark', got: %v (err: %v)", c, err)
+	}
+	if _, err := req.Cookie("missing"); !errors.Is(err, ErrNoCookie) {
+		t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrNoCookie, err)
+	}
+}
+
+func TestWriteSetCookies(t *testing.T) {
+	res := newCleanResponse()
+	if err := res.SetCookie(&Cookie{Name: "a", Value: "1"}); err != nil {
+		t.Fatalf("could not set cookie: %v", err)
+	}
+	if err := res.SetCookie(&Cookie{Name: "b", Value: "2", HttpOnly: true}); err != nil {
+		t.Fatalf("could not set cookie: %v", err)
+	}
+	if err := res.SetCookie(&Cookie{Name: "c;"}); !errors.Is(err, ErrInvalidCookieName) {
+		t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrInvalidCookieName, err)
+	}
+
+	var sb strings.Builder
+	if _, err := Write(&sb, res); err != nil {
+		t.Fatalf("wanted no errors but write(HttpResponse) returned error: %v", err)
+	}
+	want := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2; HttpOnly\r\n\r\n"
+	if got := sb.String(); got != want {
+		t.Errorf("invalid value written, wanted: '%s', got: '%s'", want, got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderAccessControlAllowOrigin      = "Access-Control-Allow-Origin"
+	HeaderAccessControlAllowMethods     = "Access-Control-Allow-Methods"
+	HeaderAccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	HeaderAccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	HeaderAccessControlExposeHeaders    = "Access-Control-Expose-Headers"
+	HeaderAccessControlMaxAge           = "Access-Control-Max-Age"
+	HeaderAccessControlRequestMethod    = "Access-Control-Request-Method"
+	HeaderAccessControlRequestHeaders   = "Access-Control-Request-Headers"
+)
+
+// CORSOptions configure the CORS middleware.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins allowed to make requests, "*" allows
+	// any origin and a single "*" within an entry matches one or more
+	// characters other than "/", as in "https://*.example.com".
+	AllowedOrigins []string
+	// AllowOriginFunc is consulted for origins not in AllowedOrigins.
+	AllowOriginFunc func(origin string) bool
+	// AllowedMethods answered to preflights. When empty the preflight is
+	// passed on and the methods are taken from the Allow header set by the
+	// router for OPTIONS requests.
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers a client may send, "*" allows
+	// any header.
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers readable by the client.
+	ExposedHeaders []string
+	// AllowCredentials lets requests include cookies and authorization.
+	AllowCredentials bool
+	// MaxAge is how long a preflight response may be cached, not sent when zero.
+	MaxAge time.Duration
+}
+
+// CORS answers preflight requests and adds the Access-Control headers to the
+// responses for allowed origins. Requests from other origins are served
+// without them, leaving the browser to block the response.
+func CORS(opts CORSOptions) Middleware {
+	return func(next Handler) Handler {
+		return func(req *HttpRequest, res *HttpResponse) {
+			origin := req.Headers.Get(HeaderOrigin)
+			if origin == "" {
+				next(req, res)
+				return
+			}
+			addVary(res, HeaderOrigin)
+
+			if req.Method == MethodOptions && req.Headers.Get(HeaderAccessControlRequestMethod) != "" {
+				opts.preflight(origin, next, req, res)
+				return
+			}
+			if opts.allowOrigin(origin) {
+				opts.setAllowOrigin(origin, res)
+				if len(opts.ExposedHeaders) > 0 {
+					res.Headers[HeaderAccessControlExposeHeaders] = strings.Join(opts.ExposedHeaders, ", ")
+				}
+			}
+			next(req, res)
+		}
+	}
+}
+
+// preflight answers an OPTIONS request announcing a cross-origin request.
+// The Access-Control headers are only sent when the origin, method and
+// headers of the announced request are all allowed.
+func (o CORSOptions) preflight(origin string, next Handler, req *HttpRequest, res *HttpResponse) {
+	addVary(res, HeaderAccessControlRequestMethod)
+	addVary(res, HeaderAccessControlRequestHeaders)
+
+	methods := o.AllowedMethods
+	if len(methods) == 0 {
+		next(req, res)
+		if res.Status != StatusNoContent && res.Status != StatusOK {
+			return
+		}
+		methods = strings.Split(res.Headers[HeaderAllow], ", ")
+	}
+	res.Status = StatusNoContent
+	res.Body = nil
+
+	method := req.Headers.Get(HeaderAccessControlRequestMethod)
+	requested := splitHeaderList(req.Headers.Get(HeaderAccessControlRequestHeaders))
+	if !o.allowOrigin(origin) || !slices.Contains(methods, method) || !o.allowHeaders(requested) {
+		return
+	}
+
+	o.setAllowOrigin(origin, res)
+	res.Headers[HeaderAccessControlAllowMethods] = strings.Join(methods, ", ")
+	if len(requested) > 0 {
+		// Echoing the request also covers "*", which browsers ignore for
+		// credentialed requests.
+		res.Headers[HeaderAccessControlAllowHeaders] = strings.Join(requested, ", ")
+	}
+	if o.MaxAge > 0 {
+		res.Headers[HeaderAccessControlMaxAge] = strconv.Itoa(int(o.MaxAge.Seconds()))
+	}
+}
+
+func (o CORSOptions) setAllowOrigin(origin string, res *HttpResponse) {
+	if slices.Contains(o.AllowedOrigins, "*") && !o.AllowCredentials {
+		res.Headers[HeaderAccessControlAllowOrigin] = "*"
+	} else {
+		res.Headers[HeaderAccessControlAllowOrigin] = origin
+	}
+	if o.AllowCredentials {
+		res.Headers[HeaderAccessControlAllowCredentials] = "true"
+	}
+}
+
+func (o CORSOptions) allowOrigin(origin string) bool {
+	for _, allowed := range o.AllowedOrigins {
+		if matchOrigin(allowed, origin) {
+			return true
+		}
+	}
+	return o.AllowOriginFunc != nil && o.AllowOriginFunc(origin)
+}
+
+// matchOrigin compares origins case-insensitively, pattern may contain a
+// single "*" wildcard.
+func matchOrigin(pattern, origin string) bool {
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok || len(origin) <= len(prefix)+len(suffix) ||
+		!strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	return !strings.Contains(origin[len(prefix):len(origin)-len(suffix)], "/")
+}
+
+func (o CORSOptions) allowHeaders(requested []string) bool {
+	if slices.Contains(o.AllowedHeaders, "*") {
+		return true
+	}
+	for _, h := range requested {
+		if !slices.ContainsFunc(o.AllowedHeaders, func(allowed string) bool { return strings.EqualFold(allowed, h) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitHeaderList splits a comma separated header value into its trimmed,
+// non-empty elements.
+func splitHeaderList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// addVary adds header to the Vary header of res unless already listed.
+func addVary(res *HttpResponse, header string) {
+	vary := res.Headers.Get(HeaderVary)
+	for _, h := range splitHeaderList(vary) {
+		if strings.EqualFold(h, header) {
+			return
+		}
+	}
+	if vary != "" {
+		header = vary + ", " + header
+	}
+	res.Headers.Del(HeaderVary)
+	res.Headers[HeaderVary] = header
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	rt := NewRouter()
+	rt.HandlePrefix(MethodGet, "/api/", func(req *HttpRequest, res *HttpResponse) {
+		res.WriteStr("ok")
+	})
+	rt.HandlePrefix(MethodPut, "/api/", func(req *HttpRequest, res *HttpResponse) {
+		res.WriteStr("ok")
+	})
+
+	testCases := []struct {
+		desc        string
+		opts        CORSOptions
+		method      string
+		target      string
+		headers     HttpHeaders
+		wantStatus  int
+		wantHeaders map[string]string
+	}{
+		{
+			desc:        "same origin request",
+			opts:        CORSOptions{AllowedOrigins: []string{"*"}},
+			method:      MethodGet,
+			target:      "/api/a",
+			headers:     HttpHeaders{},
+			wantStatus:  StatusOK,
+			wantHeaders: map[string]string{HeaderAccessControlAllowOrigin: "", HeaderVary: ""},
+		},
+		{
+			desc:       "any origin",
+			opts:       CORSOptions{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{HeaderRequestID}},
+			method:     MethodGet,
+			target:     "/api/a",
+			headers:    HttpHeaders{HeaderOrigin: "https://app.example.com"},
+			wantStatus: StatusOK,
+			wantHeaders: map[string]string{
+				HeaderAccessControlAllowOrigin:   "*",
+				HeaderAccessControlExposeHeaders: HeaderRequestID,
+				HeaderVary:                       HeaderOrigin,
+			},
+		},
+		{
+			desc:       "credentials echo the origin",
+			opts:       CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			method:     MethodGet,
+			target:     "/api/a",
+			headers:    HttpHeaders{HeaderOrigin: "https://app.example.com"},
+			wantStatus: StatusOK,
+			wantHeaders: map[string]string{
+				HeaderAccessControlAllowOrigin:      "https://app.example.com",
+				HeaderAccessControlAllowCredentials: "true",
+			},
+		},
+		{
+			desc:        "origin not allowed",
+			opts:        CORSOptions{AllowedOrigins: []string{"https://example.com"}},
+			method:      MethodGet,
+			target:      "/api/a",
+			headers:     HttpHeaders{HeaderOrigin: "https://evil.com"},
+			wantStatus:  StatusOK,
+			wantHeaders: map[string]string{HeaderAccessControlAllowOrigin: "", HeaderVary: HeaderOrigin},
+		},
+		{
+			desc:        "origin pattern",
+			opts:        CORSOptions{AllowedOrigins: []string{"https://*.example.com"}},
+			method:      MethodGet,
+			target:      "/api/a",
+			headers:     HttpHeaders{HeaderOrigin: "https://App.Example.com"},
+			wantStatus:  StatusOK,
+			wantHeaders: map[string]string{HeaderAccessControlAllowOrigin: "https://App.Example.com"},
+		},
+		{
+			desc:        "origin func",
+			opts:        CORSOptions{AllowOriginFunc: func(origin string) bool { return origin == "null" }},
+			method:      MethodGet,
+			target:      "/api/a",
+			headers:     HttpHeaders{HeaderOrigin: "null"},
+			wantStatus:  StatusOK,
+			wantHeaders: map[string]string{HeaderAccessControlAllowOrigin: "null"},
+		},
+		{
+			desc: "preflight with router methods",
+			opts: CORSOptions{
+				AllowedOrigins: []string{"https://app.example.com"},
+				AllowedHeaders: []string{HeaderContentType},
+				MaxAge:         10 * time.Minute,
+			},
+			method: MethodOptions,
+			target: "/api/a",
+			headers: HttpHeaders{
+				HeaderOrigin:                      "https://app.example.com",
+				HeaderAccessControlRequestMethod:  MethodPut,
+				HeaderAccessControlRequestHeaders: "content-type",
+			},
+			wantStatus: StatusNoContent,
+			wantHeaders: map[string]string{
+				HeaderAccessControlAllowOrigin:  "https://app.example.com",
+				HeaderAccessControlAllowMethods: "GET, HEAD, OPTIONS, PUT",
+				HeaderAccessControlAllowHeaders: "content-type",
+				HeaderAccessControlMaxAge:       "600",
+				HeaderVary:                      "Origin, Access-Control-Request-Method, Access-Control-Request-Headers",
+			},
+		},
+		{
+			desc:   "preflight with configured methods",
+			opts:   CORSOptions{AllowedOrigins: []string{"*"}, AllowedMethods: []string{MethodGet, MethodPost}},
+			method: MethodOptions,
+			target: "/api/a",
+			headers: HttpHeaders{
+				HeaderOrigin:                     "https://app.example.com",
+				HeaderAccessControlRequestMethod: MethodPost,
+			},
+			wantStatus: StatusNoContent,
+			wantHeaders: map[string]string{
+				HeaderAccessControlAllowOrigin:  "*",
+				HeaderAccessControlAllowMethods: "GET, POST",
+				HeaderAccessControlMaxAge:       "",
+			},
+		},
+		{
+			desc:   "preflight method not allowed",
+			opts:   CORSOptions{AllowedOrigins: []string{"*"}},
+			method: MethodOptions,
+			target: "/api/a",
+			headers: HttpHeaders{
+				HeaderOrigin:                     "https://app.example.com",
+				HeaderAccessControlRequestMethod: MethodDelete,
+			},
+			wantStatus:  StatusNoContent,
+			wantHeaders: map[string]string{HeaderAccessControlAllowOrigin: "", HeaderAllow: "GET, HEAD, OPTIONS, PUT"},
+		},
+		{
+			desc:   "preflight header not allowed",
+			opts:   CORSOptions{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{HeaderContentType}},
+			method: MethodOptions,
+			target: "/api/a",
+			headers: HttpHeaders{
+				HeaderOrigin:                      "https://app.example.com",
+				HeaderAccessControlRequestMethod:  MethodGet,
+				HeaderAccessControlRequestHeaders: "Content-Type, X-Secret",
+			},
+			wantStatus:  StatusNoContent,
+			wantHeaders: map[string]string{HeaderAccessControlAllowOrigin: "", HeaderAccessControlAllowHeaders: ""},
+		},
+		{
+			desc:   "preflight for unknown target",
+			opts:   CORSOptions{AllowedOrigins: []string{"*"}},
+			method: MethodOptions,
+			target: "/missing",
+			headers: HttpHeaders{
+				HeaderOrigin:                     "https://app.example.com",
+				HeaderAccessControlRequestMethod: MethodGet,
+			},
+			wantStatus:  StatusNotFound,
+			wantHeaders: map[string]string{HeaderAccessControlAllowOrigin: ""},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res := newCleanResponse()
+			CORS(tC.opts)(rt.Serve)(&HttpRequest{Method: tC.method, Target: tC.target, Headers: tC.headers}, res)
+
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+			for k, want := range tC.wantHeaders {
+				if got := res.Headers[k]; got != want {
+					t.Errorf("invalid %s header, wanted: '%s', got: '%s'", k, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchOrigin(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{pattern: "*", origin: "https://a.com", want: true},
+		{pattern: "https://a.com", origin: "https://A.com", want: true},
+		{pattern: "https://a.com", origin: "http://a.com", want: false},
+		{pattern: "https://*.a.com", origin: "https://x.y.a.com", want: true},
+		{pattern: "https://*.a.com", origin: "https://.a.com", want: false},
+		{pattern: "https://*.a.com", origin: "https://a.com", want: false},
+		{pattern: "https://*.a.com", origin: "https://evil.com/.a.com", want: false},
+		{pattern: "http://localhost:*", origin: "http://localhost:3000", want: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.pattern+" "+tC.origin, func(t *testing.T) {
+			if got := matchOrigin(tC.pattern, tC.origin); got != tC.want {
+				t.Errorf("invalid match, wanted: %v, got: %v", tC.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DigestMD5    = "MD5"
+	DigestSHA256 = "SHA-256"
+
+	defaultNonceTTL = 5 * time.Minute
+)
+
+var (
+	ErrStaleNonce  = errors.New("http: digest nonce expired")
+	ErrNonceReplay = errors.New("http: digest nonce count reused")
+)
+
+// DigestAuthenticator implements HTTP Digest access authentication (RFC 7616)
+// with qop=auth. Nonces carry their issue time signed with a key of the
+// authenticator, so challenges keep no state. Only the nonces clients
+// authenticated with are remembered until they expire, each nonce count
+// being accepted once to stop replayed requests. Counts may arrive out of
+// order, as with a nonce shared by parallel requests, within a window of
+// 64 below the highest one seen.
+type DigestAuthenticator struct {
+	Realm string
+	// Password returns the password of user, ok is false for unknown users.
+	Password func(user string) (password string, ok bool)
+	// Algorithms are offered in order, the default is SHA-256 then MD5.
+	Algorithms []string
+	// NonceTTL is how long a nonce is valid, 5 minutes when zero.
+	NonceTTL time.Duration
+
+	opaque string
+	key    []byte
+	// now is replaced by tests.
+	now func() time.Time
+
+	mu        sync.Mutex
+	used      map[string]*digestNonce
+	nextSweep time.Time
+}
+
+type digestNonce struct {
+	expires time.Time
+	// nc is the highest nonce count accepted so far, bit i of seen is set
+	// once nc-i is.
+	nc   uint64
+	seen uint64
+}
+
+// ncWindow is how far below the highest nonce count one is still accepted.
+const ncWindow = 64
+
+// use accepts nc unless it was already used, counts too far below the
+// highest one can no longer be told apart and are refused as well.
+func (n *digestNonce) use(nc uint64) bool {
+	switch {
+	case nc > n.nc:
+		if shift := nc - n.nc; shift < ncWindow {
+			n.seen <<= shift
+		} else {
+			n.seen = 0
+		}
+		n.nc = nc
+		n.seen |= 1
+		return true
+	case n.nc-nc >= ncWindow:
+		return false
+	}
+	bit := uint64(1) << (n.nc - nc)
+	if n.seen&bit != 0 {
+		return false
+	}
+	n.seen |= bit
+	return true
+}
+
+func NewDigestAuthenticator(realm string, password func(user string) (string, bool)) *DigestAuthenticator {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return &DigestAuthenticator{
+		Realm:    realm,
+		Password: password,
+		opaque:   randomDigestValue(),
+		key:      key,
+		now:      time.Now,
+		used:     map[string]*digestNonce{},
+	}
+}
+
+func randomDigestValue() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// LoadDigestUsers reads "user:password" lines for NewDigestAuthenticator,
+// Digest authentication needs the passwords themselves. Empty lines and
+// lines starting with "#" are ignored.
+func LoadDigestUsers(path string) (func(user string) (string, bool), error) {
+	passwords := map[string]string{}
+	err := readCredentialsFile(path, func(user, password string) error {
+		passwords[user] = password
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(user string) (string, bool) {
+		password, ok := passwords[user]
+		return password, ok
+	}, nil
+}
+
+func (d *DigestAuthenticator) algorithms() []string {
+	if len(d.Algorithms) == 0 {
+		return []string{DigestSHA256, DigestMD5}
+	}
+	return d.Algorithms
+}
+
+func (d *DigestAuthenticator) nonceTTL() time.Duration {
+	if d.NonceTTL <= 0 {
+		return defaultNonceTTL
+	}
+	return d.NonceTTL
+}
+
+// Require returns a middleware letting through requests with a valid digest
+// response, only those of the listed users when any are given.
+func (d *DigestAuthenticator) Require(users ...string) Middleware {
+	return requireUser(d.Authenticate, d.challenges, users)
+}
+
+// Protect applies policy to handler like Authenticator.Protect.
+func (d *DigestAuthenticator) Protect(policy AuthPolicy, handler Handler) Handler {
+	return policy.protect(d.Require(policy.Users...), handler)
+}
+
+// Authenticate verifies the Digest credentials of req and returns the user.
+func (d *DigestAuthenticator) Authenticate(req *HttpRequest) (string, error) {
+	scheme, rawParams, _ := strings.Cut(req.Headers.Get(HeaderAuthorization), " ")
+	if scheme == "" {
+		return "", ErrNoCredentials
+	}
+	if !strings.EqualFold(scheme, "Digest") {
+		return "", ErrInvalidCredentials
+	}
+	params := parseAuthParams(rawParams)
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = DigestMD5
+	}
+	h := digestHash(algorithm)
+	if h == nil || !containsFold(d.algorithms(), algorithm) ||
+		params["realm"] != d.Realm || params["qop"] != "auth" || params["uri"] != req.Target ||
+		params["opaque"] != d.opaque || params["cnonce"] == "" {
+		return "", ErrInvalidCredentials
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil || len(params["nc"]) != 8 || nc == 0 {
+		return "", ErrInvalidCredentials
+	}
+	user := params["username"]
+	password, ok := d.Password(user)
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+
+	want := digestResponse(h, params, d.Realm, password, req.Method)
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", ErrInvalidCredentials
+	}
+	if err := d.useNonce(params["nonce"], nc); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// digestResponse computes the response expected for the qop=auth params of
+// an Authorization header (RFC 7616, section 3.4.1).
+func digestResponse(h func(string) string, params map[string]string, realm, password, method string) string {
+	ha1 := h(params["username"] + ":" + realm + ":" + password)
+	ha2 := h(method + ":" + params["uri"])
+	return h(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+}
+
+// useNonce accepts nc for nonce if the nonce is live and nc was not used yet.
+func (d *DigestAuthenticator) useNonce(nonce string, nc uint64) error {
+	issued, ok := d.nonceIssued(nonce)
+	if !ok {
+		// Nonces signed before a restart are rejected like expired ones, the
+		// client retries with a new one.
+		return ErrStaleNonce
+	}
+	now := d.now()
+	expires := issued.Add(d.nonceTTL())
+	if !now.Before(expires) {
+		return ErrStaleNonce
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(now)
+	n, ok := d.used[nonce]
+	if !ok {
+		n = &digestNonce{expires: expires}
+		d.used[nonce] = n
+	}
+	if !n.use(nc) {
+		return ErrNonceReplay
+	}
+	return nil
+}
+
+// sweep drops the expired nonces at most once per TTL.
+func (d *DigestAuthenticator) sweep(now time.Time) {
+	if now.Before(d.nextSweep) {
+		return
+	}
+	for k, n := range d.used {
+		if !now.Before(n.expires) {
+			delete(d.used, k)
+		}
+	}
+	d.nextSweep = now.Add(d.nonceTTL())
+}
+
+// newNonce returns the issue time followed by its signature.
+func (d *DigestAuthenticator) newNonce() string {
+	issued := strconv.FormatInt(d.now().UnixNano(), 10)
+	return issued + "." + base64.RawURLEncoding.EncodeToString(sign(d.key, issued))
+}
+
+// nonceIssued returns the issue time of a nonce signed by d.
+func (d *DigestAuthenticator) nonceIssued(nonce string) (time.Time, bool) {
+	issued, sig, _ := strings.Cut(nonce, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !verifySignature([][]byte{d.key}, issued, mac) {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// challenges offers one challenge per algorithm sharing a fresh nonce,
+// flagged stale when the client only needs to retry with it.
+func (d *DigestAuthenticator) challenges(err error) string {
+	nonce := d.newNonce()
+	var challenges []string
+	for _, algorithm := range d.algorithms() {
+		c := fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=%s, nonce=%q, opaque=%q`, d.Realm, algorithm, nonce, d.opaque)
+		if errors.Is(err, ErrStaleNonce) {
+			c += ", stale=true"
+		}
+		challenges = append(challenges, c)
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// digestHash returns the hex encoding hash function of algorithm, nil when
+// it is not supported.
+func digestHash(algorithm string) func(string) string {
+	var newHash func() hash.Hash
+	switch strings.ToUpper(algorithm) {
+	case DigestMD5:
+		newHash = md5.New
+	case DigestSHA256:
+		newHash = sha256.New
+	default:
+		return nil
+	}
+	return func(s string) string {
+		h := newHash()
+		h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthParams parses the comma separated name=value pairs of an
+// Authorization header, values may be quoted strings.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			rest = rest[min(i+1, len(rest)):]
+		} else {
+			v, _, _ := strings.Cut(rest, ",")
+			value.WriteString(strings.TrimSpace(v))
+			rest = rest[len(v):]
+		}
+		params[name] = value.String()
+		s = rest
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Values of the RFC 7616 section 3.9.1 example.
+const (
+	rfcDigestNonce  = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+	rfcDigestOpaque = "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"
+	rfcDigestCnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+)
+
+func TestDigestResponse(t *testing.T) {
+	params := map[string]string{
+		"username": "Mufasa",
+		"uri":      "/dir/index.html",
+		"nonce":    rfcDigestNonce,
+		"nc":       "00000001",
+		"cnonce":   rfcDigestCnonce,
+	}
+	testCases := []struct {
+		algorithm string
+		want      string
+	}{
+		{algorithm: DigestMD5, want: "8ca523f5e9506fed4657c9700eebdbec"},
+		{algorithm: DigestSHA256, want: "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.algorithm, func(t *testing.T) {
+			if got := digestResponse(digestHash(tC.algorithm), params, "http-auth@example.org", "Circle of Life", MethodGet); got != tC.want {
+				t.Errorf("invalid response, wanted: '%s', got: '%s'", tC.want, got)
+			}
+		})
+	}
+}
+
+func newTestDigestAuthenticator(now *time.Time) *DigestAuthenticator {
+	d := NewDigestAuthenticator("http-auth@example.org", func(user string) (string, bool) {
+		return "Circle of Life", user == "Mufasa"
+	})
+	d.opaque = rfcDigestOpaque
+	d.now = func() time.Time { return *now }
+	return d
+}
+
+// digestAuthorization answers the challenge of nonce with password.
+func digestAuthorization(algorithm, nonce, nc, password string) string {
+	params := map[string]string{"username": "Mufasa", "uri": "/dir/index.html", "nonce": nonce, "nc": nc, "cnonce": rfcDigestCnonce}
+	h := digestHash(algorithm)
+	if h == nil {
+		// Unsupported algorithms get a response the server cannot check.
+		h = digestHash(DigestSHA256)
+	}
+	response := digestResponse(h, params, "http-auth@example.org", password, MethodGet)
+	return fmt.Sprintf(`Digest username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", algorithm=%s, `+
+		`nonce="%s", nc=%s, cnonce="%s", qop=auth, response="%s", opaque="%s"`,
+		algorithm, nonce, nc, rfcDigestCnonce, response, rfcDigestOpaque)
+}
+
+func TestDigestAuthenticator(t *testing.T) {
+	const password = "Circle of Life"
+	testCases := []struct {
+		desc string
+		// authorization builds the headers sent once the nonce is issued.
+		authorization func(nonce string) []string
+		wait          time.Duration
+		wantStatus    int
+		wantUser      string
+		wantStale     bool
+	}{
+		{desc: "no credentials", authorization: func(string) []string { return nil }, wantStatus: StatusUnauthorized},
+		{
+			desc: "sha-256",
+			authorization: func(nonce string) []string {
+				return []string{digestAuthorization(DigestSHA256, nonce, "00000001", password)}
+			},
+			wantStatus: StatusOK,
+			wantUser:   "Mufasa",
+		},
+		{
+			desc: "md5",
+			authorization: func(nonce string) []string {
+				return []string{digestAuthorization(DigestMD5, nonce, "00000001", password)}
+			},
+			wantStatus: StatusOK,
+			wantUser:   "Mufasa",
+		},
+		{
+			desc: "wrong password",
+			authorization: func(nonce string) []string {
+				return []string{digestAuthorization(DigestSHA256, nonce, "00000001", "wrong")}
+			},
+			wantStatus: StatusUnauthorized,
+		},
+		{
+			desc: "unsupported algorithm",
+			authorization: func(nonce string) []string {
+				return []string{digestAuthorization("SHA-512-256", nonce, "00000001", password)}
+			},
+			wantStatus: StatusUnauthorized,
+		},
+		{
+			desc:          "basic scheme",
+			authorization: func(string) []string { return []string{basicAuth("Mufasa", password)} },
+			wantStatus:    StatusUnauthorized,
+		},
+		{
+			desc: "replayed nonce count",
+			authorization: func(nonce string) []string {
+				return []string{
+					digestAuthorization(DigestSHA256, nonce, "00000001", password),
+					digestAuthorization(DigestSHA256, nonce, "00000001", password),
+				}
+			},
+			wantStatus: StatusUnauthorized,
+		},
+		{
+			desc: "increasing nonce count",
+			authorization: func(nonce string) []string {
+				return []string{
+					digestAuthorization(DigestSHA256, nonce, "00000001", password),
+					digestAuthorization(DigestSHA256, nonce, "00000002", password),
+				}
+			},
+			wantStatus: StatusOK,
+			wantUser:   "Mufasa",
+		},
+		{
+			desc: "nonce count out of order",
+			authorization: func(nonce string) []string {
+				return []string{
+					digestAuthorization(DigestSHA256, nonce, "00000002", password),
+					digestAuthorization(DigestSHA256, nonce, "00000001", password),
+				}
+			},
+			wantStatus: StatusOK,
+			wantUser:   "Mufasa",
+		},
+		{
+			desc: "nonce count replayed out of order",
+			authorization: func(nonce string) []string {
+				return []string{
+					digestAuthorization(DigestSHA256, nonce, "00000001", password),
+					digestAuthorization(DigestSHA256, nonce, "00000003", password),
+					digestAuthorization(DigestSHA256, nonce, "00000001", password),
+				}
+			},
+			wantStatus: StatusUnauthorized,
+		},
+		{
+			desc: "nonce count below the window",
+			authorization: func(nonce string) []string {
+				return []string{
+					digestAuthorization(DigestSHA256, nonce, "00000041", password),
+					digestAuthorization(DigestSHA256, nonce, "00000001", password),
+				}
+			},
+			wantStatus: StatusUnauthorized,
+		},
+		{
+			desc: "expired nonce",
+			authorization: func(nonce string) []string {
+				return []string{digestAuthorization(DigestSHA256, nonce, "00000001", password)}
+			},
+			wait:       defaultNonceTTL,
+			wantStatus: StatusUnauthorized,
+			wantStale:  true,
+		},
+		{
+			desc: "nonce not signed by the server",
+			authorization: func(string) []string {
+				return []string{digestAuthorization(DigestSHA256, rfcDigestNonce, "00000001", password)}
+			},
+			wantStatus: StatusUnauthorized,
+			wantStale:  true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+			d := newTestDigestAuthenticator(&now)
+			var gotUser string
+			handler := d.Require()(func(req *HttpRequest, res *HttpResponse) {
+				gotUser = req.User()
+			})
+
+			// The nonce is issued by a first, unauthenticated request.
+			res := newCleanResponse()
+			handler(&HttpRequest{Method: MethodGet, Target: "/dir/index.html", Headers: HttpHeaders{}}, res)
+			nonce := parseAuthParams(res.Headers[HeaderWWWAuthenticate])["nonce"]
+			now = now.Add(tC.wait)
+
+			for _, authorization := range tC.authorization(nonce) {
+				gotUser = ""
+				res = newCleanResponse()
+				handler(&HttpRequest{Method: MethodGet, Target: "/dir/index.html", Headers: HttpHeaders{HeaderAuthorization: authorization}}, res)
+			}
+
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+			if gotUser != tC.wantUser {
+				t.Errorf("invalid user, wanted: '%s', got: '%s'", tC.wantUser, gotUser)
+			}
+			challenge := res.Headers[HeaderWWWAuthenticate]
+			if tC.wantStatus == StatusUnauthorized && parseAuthParams(challenge)["nonce"] == "" {
+				t.Errorf("invalid challenge, wanted a nonce, got: '%s'", challenge)
+			}
+			if stale := strings.Contains(challenge, "stale=true"); stale != tC.wantStale {
+				t.Errorf("invalid stale flag, wanted: %v, got: '%s'", tC.wantStale, challenge)
+			}
+		})
+	}
+}
+
+func TestDigestChallenges(t *testing.T) {
+	now := time.Now()
+	d := newTestDigestAuthenticator(&now)
+	got := d.challenges(ErrNoCredentials)
+	nonce := parseAuthParams(got)["nonce"]
+	want := `Digest realm="http-auth@example.org", qop="auth", algorithm=SHA-256, nonce="` + nonce + `", opaque="` + rfcDigestOpaque + `", ` +
+		`Digest realm="http-auth@example.org", qop="auth", algorithm=MD5, nonce="` + nonce + `", opaque="` + rfcDigestOpaque + `"`
+	if got != want {
+		t.Errorf("invalid challenges, wanted: '%s', got: '%s'", want, got)
+	}
+	if issued, ok := d.nonceIssued(nonce); !ok || !issued.Equal(now) {
+		t.Errorf("invalid nonce, wanted it issued at %v, got: %v (valid: %t)", now, issued, ok)
+	}
+}
+
+func TestDigestNonceState(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	d := newTestDigestAuthenticator(&now)
+	handler := d.Require()(func(req *HttpRequest, res *HttpResponse) {})
+	authenticate := func(authorization string) string {
+		res := newCleanResponse()
+		handler(&HttpRequest{Method: MethodGet, Target: "/dir/index.html", Headers: HttpHeaders{HeaderAuthorization: authorization}}, res)
+		return parseAuthParams(res.Headers[HeaderWWWAuthenticate])["nonce"]
+	}
+
+	// Challenges are not remembered.
+	var nonce string
+	for range 100 {
+		nonce = authenticate("")
+		now = now.Add(time.Millisecond)
+	}
+	if n := len(d.used); n != 0 {
+		t.Fatalf("wanted no nonce state for unauthenticated requests, got: %d", n)
+	}
+
+	authenticate(digestAuthorization(DigestSHA256, nonce, "00000001", "Circle of Life"))
+	if n := len(d.used); n != 1 {
+		t.Fatalf("wanted the nonce used to authenticate to be remembered, got: %d", n)
+	}
+
+	// Expired nonces are swept once another one is used.
+	now = now.Add(defaultNonceTTL)
+	nonce = authenticate("")
+	authenticate(digestAuthorization(DigestSHA256, nonce, "00000001", "Circle of Life"))
+	if n := len(d.used); n != 1 {
+		t.Errorf("wanted the expired nonce to be dropped, got: %d nonces", n)
+	}
+}
+
+func TestNewDigestAuthenticatorFromConfig(t *testing.T) {
+	path := writeCredentialsFile(t, "# legacy clients\nMufasa:Circle of Life\n")
+	auth, err := newAuthenticator(Config{DigestUsersFile: path})
+	if err != nil {
+		t.Fatalf("could not load digest users: %v", err)
+	}
+	d, ok := auth.(*DigestAuthenticator)
+	if !ok {
+		t.Fatalf("wanted a digest authenticator, got: %T", auth)
+	}
+	if password, ok := d.Password("Mufasa"); !ok || password != "Circle of Life" {
+		t.Errorf("invalid password, wanted: 'Circle of Life', got: '%s' (found: %t)", password, ok)
+	}
+	if _, ok := d.Password("Scar"); ok {
+		t.Error("wanted unknown user not to be found")
+	}
+
+	if _, err := newAuthenticator(Config{DigestUsersFile: path, HtpasswdFile: path}); err == nil {
+		t.Error("wanted an error combining --digest-users and --htpasswd")
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`username="a\"b", realm="x, y", nc=00000001 ,qop=auth`)
+	want := map[string]string{"username": `a"b`, "realm": "x, y", "nc": "00000001", "qop": "auth"}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("invalid %s param, wanted: '%s', got: '%s'", k, v, params[k])
+		}
+	}
+}
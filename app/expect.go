@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"strings"
+)
+
+const HeaderExpect = "Expect"
+
+// expectsContinue reports whether the client waits for 100 Continue before
+// sending the request body. HTTP/1.0 clients cannot wait for it.
+func expectsContinue(req *HttpRequest) bool {
+	return req.Version != "HTTP/1.0" && strings.EqualFold(req.Headers.Get(HeaderExpect), "100-continue")
+}
+
+// expectationFailed reports whether req carries an expectation the server
+// does not support.
+func expectationFailed(req *HttpRequest) bool {
+	expect := req.Headers.Get(HeaderExpect)
+	return expect != "" && !strings.EqualFold(expect, "100-continue")
+}
+
+// continueReader sends 100 Continue on the first read of the body, so a
+// handler that rejects the request without reading it never asks the client
+// to send the body.
+type continueReader struct {
+	r    io.Reader
+	send func() error
+	sent bool
+	err  error
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		c.err = c.send()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
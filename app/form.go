@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	ContentTypeForm      = "application/x-www-form-urlencoded"
+	ContentTypeMultipart = "multipart/form-data"
+
+	// maxFormSize limits url-encoded bodies, which are always held in memory.
+	maxFormSize = 10 << 20
+)
+
+var (
+	ErrNotForm          = errors.New("http: request body is not url-encoded form data")
+	ErrNotMultipart     = errors.New("http: request body is not multipart/form-data")
+	ErrFormTooLarge     = errors.New("http: form too large")
+	ErrFormPartTooLarge = errors.New("http: form part too large")
+)
+
+// ParseForm returns the values of the query string followed by those of an
+// application/x-www-form-urlencoded body. Bodies of other types are left
+// unread, so the query values are still returned along with ErrNotForm.
+func (r *HttpRequest) ParseForm() (url.Values, error) {
+	values := url.Values{}
+	if _, query, ok := strings.Cut(r.Target, "?"); ok {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		values = q
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Headers.Get(HeaderContentType))
+	if mediaType != ContentTypeForm || r.Body == nil {
+		return values, ErrNotForm
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxFormSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxFormSize {
+		return nil, ErrFormTooLarge
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range values {
+		form[k] = append(form[k], v...)
+	}
+	return form, nil
+}
+
+// MultipartLimits bound the resources used by ParseMultipartForm, zero
+// values fall back to the defaults.
+type MultipartLimits struct {
+	// MaxMemory is the number of bytes of the form kept in memory, files
+	// beyond it are written to TempDir while values beyond it make the form
+	// too large. Defaults to 1 MiB.
+	MaxMemory int64
+	// MaxPartSize limits every single part. Defaults to MaxTotalSize.
+	MaxPartSize int64
+	// MaxTotalSize limits the whole body. Defaults to 32 MiB.
+	MaxTotalSize int64
+	// TempDir defaults to os.TempDir.
+	TempDir string
+}
+
+var defaultMultipartLimits = MultipartLimits{
+	MaxMemory:    1 << 20,
+	MaxTotalSize: 32 << 20,
+}
+
+// MultipartForm is a parsed multipart/form-data body. RemoveAll must be
+// called once the files are no longer needed.
+type MultipartForm struct {
+	Values url.Values
+	Files  map[string][]*FormFile
+}
+
+// FormFile is an uploaded file, held in memory or in a temporary file.
+type FormFile struct {
+	Filename    string
+	ContentType string
+	Size        int64
+
+	content []byte
+	path    string
+}
+
+// Open returns the contents of the file.
+func (f *FormFile) Open() (io.ReadCloser, error) {
+	if f.path != "" {
+		return os.Open(f.path)
+	}
+	return io.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+// RemoveAll deletes the temporary files of the form.
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, files := range f.Files {
+		for _, file := range files {
+			if file.path != "" {
+				errs = append(errs, os.Remove(file.path))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ParseMultipartForm reads a multipart/form-data body, streaming file parts
+// to disk once the memory budget of limits is spent.
+func (r *HttpRequest) ParseMultipartForm(limits MultipartLimits) (*MultipartForm, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Headers.Get(HeaderContentType))
+	if err != nil || mediaType != ContentTypeMultipart || params["boundary"] == "" || r.Body == nil {
+		return nil, ErrNotMultipart
+	}
+
+	if limits.MaxMemory <= 0 {
+		limits.MaxMemory = defaultMultipartLimits.MaxMemory
+	}
+	if limits.MaxTotalSize <= 0 {
+		limits.MaxTotalSize = defaultMultipartLimits.MaxTotalSize
+	}
+	if limits.MaxPartSize <= 0 || limits.MaxPartSize > limits.MaxTotalSize {
+		limits.MaxPartSize = limits.MaxTotalSize
+	}
+
+	body := &countingReader{r: io.LimitReader(r.Body, limits.MaxTotalSize+1)}
+	mr := multipart.NewReader(body, params["boundary"])
+	form := &MultipartForm{Values: url.Values{}, Files: map[string][]*FormFile{}}
+	memory := limits.MaxMemory
+
+	for {
+		part, err := mr.NextPart()
+		if err == nil {
+			err = form.addPart(part, limits, &memory)
+			part.Close()
+		}
+		// A body cut off by the size limit may look complete to the reader.
+		if body.n > limits.MaxTotalSize {
+			err = ErrFormTooLarge
+		}
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+	}
+}
+
+func (f *MultipartForm) addPart(part *multipart.Part, limits MultipartLimits, memory *int64) error {
+	name := part.FormName()
+	if name == "" {
+		return nil
+	}
+
+	// Read one byte past the limits to detect parts exceeding them.
+	var buf bytes.Buffer
+	limit := min(limits.MaxPartSize, *memory)
+	n, err := io.CopyN(&buf, part, limit+1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if part.FileName() == "" {
+		if n > limits.MaxPartSize {
+			return ErrFormPartTooLarge
+		}
+		if n > limit {
+			// Values are always held in memory.
+			return ErrFormTooLarge
+		}
+		*memory -= n
+		f.Values.Add(name, buf.String())
+		return nil
+	}
+
+	file := &FormFile{
+		Filename:    part.FileName(),
+		ContentType: part.Header.Get(HeaderContentType),
+		Size:        n,
+	}
+	if n <= limit {
+		*memory -= n
+		file.content = buf.Bytes()
+		f.Files[name] = append(f.Files[name], file)
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(limits.TempDir, "multipart-")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	file.path = tmp.Name()
+	// Register the file first so RemoveAll cleans it up on failure.
+	f.Files[name] = append(f.Files[name], file)
+
+	size, err := io.Copy(tmp, io.MultiReader(&buf, io.LimitReader(part, limits.MaxPartSize-n+1)))
+	if err != nil {
+		return err
+	}
+	if size > limits.MaxPartSize {
+		return ErrFormPartTooLarge
+	}
+	file.Size = size
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func TestParseForm(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		target      string
+		contentType string
+		body        string
+		want        string
+		wantErr     error
+	}{
+		{
+			desc:        "url-encoded body and query",
+			target:      "/submit?a=1",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        "a=2&b=hello+world",
+			want:        "a=2&a=1&b=hello+world",
+		},
+		{
+			desc:        "other content type",
+			target:      "/submit?a=1",
+			contentType: "application/json",
+			body:        "{}",
+			want:        "a=1",
+			wantErr:     ErrNotForm,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{
+				Target:  tC.target,
+				Headers: HttpHeaders{HeaderContentType: tC.contentType},
+				Body:    strings.NewReader(tC.body),
+			}
+			values, err := req.ParseForm()
+			if !errors.Is(err, tC.wantErr) {
+				t.Fatalf("invalid error, wanted: '%v', got: '%v'", tC.wantErr, err)
+			}
+			if got := values.Encode(); got != tC.want {
+				t.Errorf("invalid values, wanted: '%s', got: '%s'", tC.want, got)
+			}
+		})
+	}
+}
+
+// newMultipartRequest builds a multipart/form-data request from fields and files.
+func newMultipartRequest(t *testing.T, target string, fields map[string]string, files map[string]string) *HttpRequest {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for name, contents := range files {
+		w, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("could not create form file: %v", err)
+		}
+		io.WriteString(w, contents)
+	}
+	mw.Close()
+
+	return &HttpRequest{
+		Method:  MethodPost,
+		Target:  target,
+		Version: "HTTP/1.1",
+		Headers: HttpHeaders{HeaderContentType: mw.FormDataContentType()},
+		Body:    &body,
+	}
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		limits     MultipartLimits
+		files      map[string]string
+		wantOnDisk bool
+		wantErr    error
+	}{
+		{
+			desc:   "file kept in memory",
+			limits: MultipartLimits{MaxMemory: 1024},
+			files:  map[string]string{"small.txt": "hello"},
+		},
+		{
+			desc:       "file streamed to disk",
+			limits:     MultipartLimits{MaxMemory: 4},
+			files:      map[string]string{"large.txt": strings.Repeat("x", 100)},
+			wantOnDisk: true,
+		},
+		{
+			desc:    "part too large",
+			limits:  MultipartLimits{MaxMemory: 4, MaxPartSize: 50},
+			files:   map[string]string{"large.txt": strings.Repeat("x", 100)},
+			wantErr: ErrFormPartTooLarge,
+		},
+		{
+			desc:    "values over the memory budget",
+			limits:  MultipartLimits{MaxMemory: 1},
+			wantErr: ErrFormTooLarge,
+		},
+		{
+			desc:    "form too large",
+			limits:  MultipartLimits{MaxTotalSize: 100},
+			files:   map[string]string{"large.txt": strings.Repeat("x", 200)},
+			wantErr: ErrFormTooLarge,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tC.limits.TempDir = t.TempDir()
+			req := newMultipartRequest(t, "/files/", map[string]string{"note": "hi"}, tC.files)
+
+			form, err := req.ParseMultipartForm(tC.limits)
+			if !errors.Is(err, tC.wantErr) {
+				t.Fatalf("invalid error, wanted: '%v', got: '%v'", tC.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			defer form.RemoveAll()
+
+			if v := form.Values.Get("note"); v != "hi" {
+				t.Errorf("invalid field value, wanted: 'hi', got: '%s'", v)
+			}
+			for name, contents := range tC.files {
+				file := form.Files["file"][0]
+				if file.Filename != name || file.Size != int64(len(contents)) {
+					t.Errorf("invalid file, wanted '%s' of %d bytes, got '%s' of %d bytes", name, len(contents), file.Filename, file.Size)
+				}
+				if onDisk := file.path != ""; onDisk != tC.wantOnDisk {
+					t.Errorf("invalid storage, wanted on disk: %t, got: %t", tC.wantOnDisk, onDisk)
+				}
+				f, _ := file.Open()
+				if got := readerToString(t, f); got != contents {
+					t.Errorf("invalid file contents, wanted %d bytes, got %d bytes", len(contents), len(got))
+				}
+				f.Close()
+			}
+		})
+	}
+
+	t.Run("not multipart", func(t *testing.T) {
+		req := &HttpRequest{Headers: HttpHeaders{HeaderContentType: "text/plain"}, Body: strings.NewReader("")}
+		if _, err := req.ParseMultipartForm(MultipartLimits{}); !errors.Is(err, ErrNotMultipart) {
+			t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrNotMultipart, err)
+		}
+	})
+}
@@ -6,11 +6,23 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"mime"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
+// logger returns the request-scoped logger when the request came through the server.
+func (a *app) logger(req *HttpRequest) *slog.Logger {
+	if req.log != nil {
+		return req.log
+	}
+	return a.log
+}
+
 func (a *app) notFoundHandler(res *HttpResponse, _ *HttpRequest) {
 	res.Status = StatusNotFound
 }
@@ -25,61 +37,83 @@ func (a *app) echoHandler(res *HttpResponse, req *HttpRequest) {
 	res.WriteStr(echo)
 }
 
+// webSocketEchoHandler sends every received message back to the client.
+func (a *app) webSocketEchoHandler(ws *WebSocketConn, req *HttpRequest) {
+	log := a.logger(req)
+	for {
+		msgType, msg, err := ws.ReadMessage()
+		if err != nil {
+			log.Info("websocket closed", slog.String("reason", err.Error()))
+			return
+		}
+		if err := ws.WriteMessage(msgType, msg); err != nil {
+			log.Warn("could not write websocket message", slog.String("error", err.Error()))
+			return
+		}
+	}
+}
+
 func (a *app) userAgentHandler(res *HttpResponse, req *HttpRequest) {
 	res.Status = StatusOK
 	res.WriteStr(req.Headers["User-Agent"])
 }
 
-func (a *app) filesHandler(res *HttpResponse, req *HttpRequest) {
-	switch req.Method {
-	case MethodGet:
-		a.readFileHandler(res, req)
-	case MethodPost:
-		a.createFileHandler(res, req)
+// fileError sends a problem+json error to clients accepting JSON and keeps
+// the plain text messages of the files handlers for the others.
+func (a *app) fileError(res *HttpResponse, req *HttpRequest, code int, msg string) {
+	if acceptsJSON(req) {
+		res.ErrorFor(req, code, msg)
+		return
+	}
+	res.Status = code
+	if msg != "" {
+		res.WriteStr(msg)
 	}
 }
 
 func (a *app) readFileHandler(res *HttpResponse, req *HttpRequest) {
-	fileName, ok := strings.CutPrefix(req.Target, "/files/")
+	fileName, ok := strings.CutPrefix(req.Path(), "/files/")
 	if fileName == "" || !ok {
-		res.Status = StatusBadRequest
+		a.fileError(res, req, StatusBadRequest, "")
 		return
 	}
 
 	f, err := os.Open(filepath.Join(a.cfg.FileDir, fileName))
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			res.Status = StatusNotFound
+			a.fileError(res, req, StatusNotFound, "")
 			return
 		}
-		res.Status = StatusInternalServerError
-		resp := fmt.Sprintf("Could not load file: %s", err.Error())
-		res.WriteStr(resp)
+		a.fileError(res, req, StatusInternalServerError, fmt.Sprintf("Could not load file: %s", err.Error()))
 		return
 	}
-	defer f.Close()
 
+	// The file is closed once the response is written.
 	res.Status = StatusOK
 	res.Body = f
 	res.Headers[HeaderContentType] = "application/octet-stream"
 }
 
 func (a *app) createFileHandler(res *HttpResponse, req *HttpRequest) {
-	fileName, _ := strings.CutPrefix(req.Target, "/files/")
+	fileName, _ := strings.CutPrefix(req.Path(), "/files/")
+	log := a.logger(req)
 
 	if err := os.MkdirAll(a.cfg.FileDir, os.ModePerm); err != nil {
-		a.log.Warn("could not create dirs", slog.String("error", err.Error()))
-		res.Status = StatusInternalServerError
-		res.WriteStr("Could not create dirs: " + err.Error())
+		log.Warn("could not create dirs", slog.String("error", err.Error()))
+		a.fileError(res, req, StatusInternalServerError, "Could not create dirs: "+err.Error())
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(req.Headers.Get(HeaderContentType)); mediaType == ContentTypeMultipart {
+		a.uploadFilesHandler(res, req, fileName)
 		return
 	}
 
 	filePath := filepath.Join(a.cfg.FileDir, fileName)
 	f, err := os.Create(filePath)
 	if err != nil {
-		a.log.Warn("could not create file", slog.String("fileName", fileName), slog.String("error", err.Error()))
-		res.Status = StatusInternalServerError
-		res.WriteStr("Could not create file: " + err.Error())
+		log.Warn("could not create file", slog.String("fileName", fileName), slog.String("error", err.Error()))
+		a.fileError(res, req, StatusInternalServerError, "Could not create file: "+err.Error())
 		return
 	}
 	defer f.Close()
@@ -87,14 +121,134 @@ func (a *app) createFileHandler(res *HttpResponse, req *HttpRequest) {
 	w := bufio.NewWriter(f)
 	n, err := io.Copy(w, req.Body)
 	if err != nil {
-		a.log.Warn("could not write data to file", slog.String("fileName", fileName), slog.String("error", err.Error()))
-		res.Status = StatusInternalServerError
-		res.WriteStr("Could not write data to file: " + err.Error())
+		log.Warn("could not write data to file", slog.String("fileName", fileName), slog.String("error", err.Error()))
+		a.fileError(res, req, StatusInternalServerError, "Could not write data to file: "+err.Error())
 		return
 	}
 	w.Flush()
 
-	a.log.Info("written file contents", slog.String("fileName", fileName), slog.Int64("bytes", n))
+	log.Info("written file contents", slog.String("fileName", fileName), slog.Int64("bytes", n))
 
 	res.Status = StatusCreated
 }
+
+// uploadFilesHandler stores the files of a multipart form. Uploads to /files/
+// keep the names sent by the client, an upload to /files/<name> must hold a
+// single file which is stored as name.
+func (a *app) uploadFilesHandler(res *HttpResponse, req *HttpRequest, fileName string) {
+	log := a.logger(req)
+
+	form, err := req.ParseMultipartForm(defaultMultipartLimits)
+	if err != nil {
+		if errors.Is(err, ErrFormTooLarge) || errors.Is(err, ErrFormPartTooLarge) {
+			res.ErrorFor(req, StatusContentTooLarge, err.Error())
+			return
+		}
+		res.ErrorFor(req, StatusBadRequest, err.Error())
+		return
+	}
+	defer form.RemoveAll()
+
+	var files []*FormFile
+	for _, name := range slices.Sorted(maps.Keys(form.Files)) {
+		files = append(files, form.Files[name]...)
+	}
+	if len(files) == 0 || fileName != "" && len(files) > 1 {
+		res.ErrorFor(req, StatusBadRequest, "expected one file per named upload and at least one file")
+		return
+	}
+
+	var stored []string
+	for _, file := range files {
+		name := fileName
+		if name == "" {
+			name = filepath.Base(file.Filename)
+		}
+		if !fileNameIsValid(name) {
+			res.ErrorFor(req, StatusBadRequest, "invalid file name: "+name)
+			return
+		}
+		if err := a.storeFormFile(file, filepath.Join(a.cfg.FileDir, name)); err != nil {
+			log.Warn("could not store uploaded file", slog.String("fileName", name), slog.String("error", err.Error()))
+			res.ErrorFor(req, StatusInternalServerError, "could not store "+name)
+			return
+		}
+		log.Info("written file contents", slog.String("fileName", name), slog.Int64("bytes", file.Size))
+		stored = append(stored, name)
+	}
+
+	res.Status = StatusCreated
+	res.WriteStr(strings.Join(stored, "\n") + "\n")
+}
+
+// fileNameIsValid reports whether name designates a file directly under the
+// files directory.
+func fileNameIsValid(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func (a *app) storeFormFile(file *FormFile, path string) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// signURLRequest is the body of POST /signed-urls, TTL defaults to an hour.
+type signURLRequest struct {
+	Path   string `json:"path"`
+	Method string `json:"method"`
+	TTL    string `json:"ttl"`
+}
+
+// signURLHandler mints a signed URL granting GET or POST on a file.
+func (a *app) signURLHandler(res *HttpResponse, req *HttpRequest) {
+	var body signURLRequest
+	if err := req.DecodeJSON(&body); err != nil {
+		res.ErrorFor(req, StatusBadRequest, err.Error())
+		return
+	}
+
+	ttl := time.Hour
+	if body.TTL != "" {
+		d, err := time.ParseDuration(body.TTL)
+		if err != nil || d <= 0 {
+			res.ErrorFor(req, StatusBadRequest, "invalid ttl")
+			return
+		}
+		ttl = d
+	}
+	if body.Method == "" {
+		body.Method = MethodGet
+	}
+	name, ok := strings.CutPrefix(body.Path, "/files/")
+	if !ok || !fileNameIsValid(name) || strings.Contains(body.Path, "?") {
+		res.ErrorFor(req, StatusBadRequest, "path must name a file under /files/")
+		return
+	}
+	if body.Method != MethodGet && body.Method != MethodPost {
+		res.ErrorFor(req, StatusBadRequest, "method must be GET or POST")
+		return
+	}
+
+	signed, err := a.signer.Sign(body.Method, body.Path, ttl)
+	if err != nil {
+		res.ErrorFor(req, StatusBadRequest, err.Error())
+		return
+	}
+	a.logger(req).Info("signed file URL", slog.String("path", body.Path), slog.String("method", body.Method), slog.String("user", req.User()))
+	if err := res.JSON(StatusCreated, map[string]string{"url": signed}); err != nil {
+		res.ErrorFor(req, StatusInternalServerError, err.Error())
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
@@ -161,6 +162,253 @@ func TestCreateFileHandler(t *testing.T) {
 	}
 }
 
+func TestUploadFilesHandler(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		target     string
+		files      map[string]string
+		wantStatus int
+		wantFiles  map[string]string
+	}{
+		{
+			desc:       "should store every file under its own name",
+			target:     "/files/",
+			files:      map[string]string{"a.txt": "first", "b.txt": "second"},
+			wantStatus: StatusCreated,
+			wantFiles:  map[string]string{"a.txt": "first", "b.txt": "second"},
+		},
+		{
+			desc:       "should store a single file under the target name",
+			target:     "/files/renamed",
+			files:      map[string]string{"original.txt": "contents"},
+			wantStatus: StatusCreated,
+			wantFiles:  map[string]string{"renamed": "contents"},
+		},
+		{
+			desc:       "should strip directories from file names",
+			target:     "/files/",
+			files:      map[string]string{"../../escape.txt": "contents"},
+			wantStatus: StatusCreated,
+			wantFiles:  map[string]string{"escape.txt": "contents"},
+		},
+		{
+			desc:       "should reject several files for a named upload",
+			target:     "/files/renamed",
+			files:      map[string]string{"a.txt": "first", "b.txt": "second"},
+			wantStatus: StatusBadRequest,
+		},
+		{
+			desc:       "should reject a named upload outside the directory",
+			target:     "/files/../escaped.txt",
+			files:      map[string]string{"original.txt": "contents"},
+			wantStatus: StatusBadRequest,
+		},
+		{
+			desc:       "should reject a named upload in a subdirectory",
+			target:     "/files/sub/renamed",
+			files:      map[string]string{"original.txt": "contents"},
+			wantStatus: StatusBadRequest,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			app := newMockApp(t)
+			res := newCleanResponse()
+			req := newMultipartRequest(t, tC.target, nil, tC.files)
+
+			app.createFileHandler(res, req)
+
+			if res.Status != tC.wantStatus {
+				t.Fatalf("invalid http status returned, wanted: '%d', got: %d", tC.wantStatus, res.Status)
+			}
+			if tC.wantStatus != StatusCreated {
+				name, _ := strings.CutPrefix(tC.target, "/files/")
+				if _, err := os.Stat(filepath.Join(app.cfg.FileDir, name)); err == nil {
+					t.Errorf("wanted rejected upload '%s' not to be stored", name)
+				}
+			}
+			for name, contents := range tC.wantFiles {
+				buff, err := os.ReadFile(filepath.Join(app.cfg.FileDir, name))
+				if err != nil {
+					t.Fatalf("could not read file: %v", err)
+				}
+				if string(buff) != contents {
+					t.Errorf("file '%s' contents differ, wanted: '%s', got: %s", name, contents, buff)
+				}
+			}
+		})
+	}
+}
+
+func TestReadFileHandlerErrors(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		accept          string
+		wantContentType string
+	}{
+		{desc: "should send problem details to json clients", accept: "application/json", wantContentType: ContentTypeProblemJSON},
+		{desc: "should send no body to other clients", accept: "*/*", wantContentType: ""},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			app := newMockApp(t)
+			res := newCleanResponse()
+			req := &HttpRequest{
+				Method:  MethodGet,
+				Target:  "/files/missing",
+				Version: "HTTP/1.1",
+				Headers: HttpHeaders{"Accept": tC.accept},
+			}
+
+			app.readFileHandler(res, req)
+
+			if res.Status != StatusNotFound {
+				t.Errorf("invalid http status returned, wanted: '404', got: %d", res.Status)
+			}
+			if ct := res.Headers[HeaderContentType]; ct != tC.wantContentType {
+				t.Errorf("invalid content type, wanted: '%s', got: '%s'", tC.wantContentType, ct)
+			}
+		})
+	}
+}
+
+// TestReadFileOverConnection serves files through the server, which writes
+// the body after the handler returned.
+func TestReadFileOverConnection(t *testing.T) {
+	app := newMockApp(t)
+	if err := os.WriteFile(filepath.Join(app.cfg.FileDir, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+	addr := startTestServer(t, app.Handle)
+	conn, br := dialTestServer(t, addr)
+
+	// The connection is kept alive, the second request reads the file again.
+	for range 2 {
+		status, _, body := roundTrip(t, conn, br, "GET /files/a.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if status != "HTTP/1.1 200 OK" || body != "hello" {
+			t.Fatalf("invalid response, wanted: 200 with 'hello', got: '%s' with '%s'", status, body)
+		}
+	}
+}
+
+func TestSignedFileURLs(t *testing.T) {
+	app := newMockApp(t)
+	app.cfg.AuthRead = true
+	app.auth = newTestAuthenticator(t)
+	signer, err := NewURLSigner([][]byte{[]byte("key")})
+	if err != nil {
+		t.Fatalf("could not create signer: %v", err)
+	}
+	app.signer = signer
+
+	// Requests go through the server, which writes the bodies set by the handlers.
+	addr := startTestServer(t, app.Handle)
+	serve := func(method, target, authorization, body string) (int, string) {
+		t.Helper()
+		conn, br := dialTestServer(t, addr)
+		defer conn.Close()
+		rawReq := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n", method, target, len(body))
+		if authorization != "" {
+			rawReq += HeaderAuthorization + ": " + authorization + "\r\n"
+		}
+		status, _, resBody := roundTrip(t, conn, br, rawReq+"\r\n"+body)
+		code, _ := strconv.Atoi(strings.Fields(status)[1])
+		return code, resBody
+	}
+	mint := func(method string) string {
+		t.Helper()
+		status, resBody := serve(MethodPost, "/signed-urls", basicAuth("alice", "secret"), `{"path": "/files/a.txt", "method": "`+method+`", "ttl": "1m"}`)
+		if status != StatusCreated {
+			t.Fatalf("could not mint URL, got status: %d", status)
+		}
+		var body struct{ URL string }
+		if err := (&HttpRequest{Headers: HttpHeaders{}, Body: strings.NewReader(resBody)}).DecodeJSON(&body); err != nil {
+			t.Fatalf("could not decode minted URL: %v", err)
+		}
+		return body.URL
+	}
+
+	if status, _ := serve(MethodPost, "/signed-urls", "", `{"path": "/files/a.txt"}`); status != StatusUnauthorized {
+		t.Errorf("invalid status minting without credentials, wanted: 401, got: %d", status)
+	}
+	for _, path := range []string{"/etc/passwd", "/files/../x", "/files/sub/x"} {
+		if status, _ := serve(MethodPost, "/signed-urls", basicAuth("alice", "secret"), `{"path": "`+path+`"}`); status != StatusBadRequest {
+			t.Errorf("invalid status minting '%s', wanted: 400, got: %d", path, status)
+		}
+	}
+
+	post := mint(MethodPost)
+	if status, _ := serve(MethodPost, post, "", "hello"); status != StatusCreated {
+		t.Errorf("invalid status uploading with a signed URL, wanted: 201, got: %d", status)
+	}
+	if content, _ := os.ReadFile(filepath.Join(app.cfg.FileDir, "a.txt")); string(content) != "hello" {
+		t.Errorf("invalid file content, wanted: 'hello', got: '%s'", content)
+	}
+
+	get := mint(MethodGet)
+	testCases := []struct {
+		desc       string
+		method     string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{desc: "unsigned", method: MethodGet, target: "/files/a.txt", wantStatus: StatusUnauthorized},
+		{desc: "signed", method: MethodGet, target: get, wantStatus: StatusOK, wantBody: "hello"},
+		{desc: "signed for another method", method: MethodGet, target: post, wantStatus: StatusForbidden},
+		{desc: "tampered", method: MethodGet, target: strings.Replace(get, "signature=", "signature=x", 1), wantStatus: StatusForbidden},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			status, body := serve(tC.method, tC.target, "", "")
+			if status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, status)
+			}
+			if tC.wantBody != "" && body != tC.wantBody {
+				t.Errorf("invalid body, wanted: '%s', got: '%s'", tC.wantBody, body)
+			}
+		})
+	}
+}
+
+func TestRateLimitedFiles(t *testing.T) {
+	app := newMockApp(t)
+	app.cfg.AuthRead = true
+	app.cfg.RateLimits = stringsFlag{"/files/=1/1m"}
+	app.auth = newTestAuthenticator(t)
+	rateLimits, err := newRateLimits(app.cfg)
+	if err != nil {
+		t.Fatalf("could not parse rate limits: %v", err)
+	}
+	app.rateLimits = rateLimits
+
+	// Authenticated clients are limited per user, whatever their IP, and
+	// failed attempts per IP.
+	testCases := []struct {
+		desc          string
+		remoteAddr    string
+		authorization string
+		wantLimited   bool
+	}{
+		{desc: "first user", remoteAddr: "10.0.0.1:1000", authorization: basicAuth("alice", "secret")},
+		{desc: "second user from the same IP", remoteAddr: "10.0.0.1:1001", authorization: basicAuth("bob", "hunter2")},
+		{desc: "first user from another IP", remoteAddr: "10.0.0.2:1000", authorization: basicAuth("alice", "secret"), wantLimited: true},
+		{desc: "wrong password", remoteAddr: "10.0.0.3:1000", authorization: basicAuth("alice", "guess")},
+		{desc: "wrong password again", remoteAddr: "10.0.0.3:1001", authorization: basicAuth("alice", "guess2"), wantLimited: true},
+		{desc: "no credentials from the same IP", remoteAddr: "10.0.0.3:1002", wantLimited: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Method: MethodGet, Target: "/files/a.txt", Version: "HTTP/1.1", Headers: HttpHeaders{HeaderAuthorization: tC.authorization}, RemoteAddr: tC.remoteAddr}
+			res := newCleanResponse()
+			app.Handle(req, res)
+			if limited := res.Status == StatusTooManyRequests; limited != tC.wantLimited {
+				t.Errorf("invalid rate limiting, wanted limited: %t, got status: %d", tC.wantLimited, res.Status)
+			}
+		})
+	}
+}
+
 type noopLogger struct {
 }
 
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+)
+
+// HPACK header compression (RFC 7541) used by the HTTP/2 server.
+
+const hpackDefaultTableSize = 4096
+
+var (
+	ErrHpackInvalidIndex     = errors.New("hpack: invalid index")
+	ErrHpackIntegerOverflow  = errors.New("hpack: integer overflow")
+	ErrHpackTruncated        = errors.New("hpack: truncated header block")
+	ErrHpackInvalidHuffman   = errors.New("hpack: invalid huffman encoding")
+	ErrHpackInvalidTableSize = errors.New("hpack: invalid dynamic table size update")
+	ErrHpackHeaderListSize   = errors.New("hpack: header list too large")
+)
+
+type hpackField struct {
+	name  string
+	value string
+}
+
+func (f hpackField) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+// hpackTable is the dynamic table, the most recently inserted entry has index 0.
+type hpackTable struct {
+	entries []hpackField
+	size    int
+	maxSize int
+}
+
+func (t *hpackTable) add(f hpackField) {
+	t.entries = append([]hpackField{f}, t.entries...)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *hpackTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *hpackTable) evict() {
+	for t.size > t.maxSize && len(t.entries) > 0 {
+		last := t.entries[len(t.entries)-1]
+		t.entries = t.entries[:len(t.entries)-1]
+		t.size -= last.size()
+	}
+}
+
+// hpackDecoder decodes header blocks, keeping its dynamic table across blocks of a connection.
+type hpackDecoder struct {
+	table hpackTable
+	// allowedMaxSize is the SETTINGS_HEADER_TABLE_SIZE we advertised.
+	allowedMaxSize int
+	// maxHeaderListSize limits the decoded size of a single header block.
+	maxHeaderListSize int
+}
+
+func newHpackDecoder(tableSize, maxHeaderListSize int) *hpackDecoder {
+	return &hpackDecoder{
+		table:             hpackTable{maxSize: tableSize},
+		allowedMaxSize:    tableSize,
+		maxHeaderListSize: maxHeaderListSize,
+	}
+}
+
+func (d *hpackDecoder) at(index uint64) (hpackField, error) {
+	if index == 0 {
+		return hpackField{}, ErrHpackInvalidIndex
+	}
+	if index <= uint64(len(hpackStaticTable)) {
+		return hpackStaticTable[index-1], nil
+	}
+	index -= uint64(len(hpackStaticTable)) + 1
+	if index >= uint64(len(d.table.entries)) {
+		return hpackField{}, ErrHpackInvalidIndex
+	}
+	return d.table.entries[index], nil
+}
+
+// Decode decodes a complete header block.
+func (d *hpackDecoder) Decode(block []byte) ([]hpackField, error) {
+	var fields []hpackField
+	listSize := 0
+	sawField := false
+
+	for len(block) > 0 {
+		b := block[0]
+		var (
+			f   hpackField
+			err error
+		)
+
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field
+			var index uint64
+			if index, block, err = hpackReadInt(block, 7); err != nil {
+				return nil, err
+			}
+			if f, err = d.at(index); err != nil {
+				return nil, err
+			}
+		case b&0xc0 == 0x40:
+			// Literal header field with incremental indexing
+			if f, block, err = d.readLiteral(block, 6); err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xe0 == 0x20:
+			// Dynamic table size update, only allowed at the beginning of a block
+			if sawField {
+				return nil, ErrHpackInvalidTableSize
+			}
+			var size uint64
+			if size, block, err = hpackReadInt(block, 5); err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, ErrHpackInvalidTableSize
+			}
+			d.table.setMaxSize(int(size))
+			continue
+		default:
+			// Literal header field without indexing or never indexed
+			if f, block, err = d.readLiteral(block, 4); err != nil {
+				return nil, err
+			}
+		}
+
+		sawField = true
+		listSize += f.size()
+		if d.maxHeaderListSize > 0 && listSize > d.maxHeaderListSize {
+			return nil, ErrHpackHeaderListSize
+		}
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+func (d *hpackDecoder) readLiteral(block []byte, prefix uint8) (hpackField, []byte, error) {
+	var (
+		f     hpackField
+		index uint64
+		err   error
+	)
+	if index, block, err = hpackReadInt(block, prefix); err != nil {
+		return f, nil, err
+	}
+
+	if index > 0 {
+		indexed, err := d.at(index)
+		if err != nil {
+			return f, nil, err
+		}
+		f.name = indexed.name
+	} else if f.name, block, err = hpackReadString(block); err != nil {
+		return f, nil, err
+	}
+
+	if f.value, block, err = hpackReadString(block); err != nil {
+		return f, nil, err
+	}
+	return f, block, nil
+}
+
+// hpackReadInt decodes an integer with an N-bit prefix (RFC 7541, section 5.1).
+func hpackReadInt(buf []byte, prefix uint8) (uint64, []byte, error) {
+	if len(buf) == 0 {
+		return 0, nil, ErrHpackTruncated
+	}
+	mask := uint64(1)<<prefix - 1
+	v := uint64(buf[0]) & mask
+	buf = buf[1:]
+	if v < mask {
+		return v, buf, nil
+	}
+
+	var shift uint
+	for len(buf) > 0 {
+		b := buf[0]
+		buf = buf[1:]
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, buf, nil
+		}
+		shift += 7
+		if shift >= 63 {
+			return 0, nil, ErrHpackIntegerOverflow
+		}
+	}
+	return 0, nil, ErrHpackTruncated
+}
+
+// hpackReadString decodes a string literal (RFC 7541, section 5.2).
+func hpackReadString(buf []byte) (string, []byte, error) {
+	if len(buf) == 0 {
+		return "", nil, ErrHpackTruncated
+	}
+	huffman := buf[0]&0x80 != 0
+	n, buf, err := hpackReadInt(buf, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(buf)) < n {
+		return "", nil, ErrHpackTruncated
+	}
+
+	raw, rest := buf[:n], buf[n:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	s, err := huffmanDecode(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, rest, nil
+}
+
+// huffmanNode is a node of the Huffman decoding tree, leaves have no children.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := root
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+	}
+	return root
+}
+
+func huffmanDecode(buf []byte) (string, error) {
+	out := make([]byte, 0, len(buf)*8/5)
+	n := huffmanRoot
+	// Bits consumed since the last emitted symbol, all of them must be 1s
+	// and fewer than 8 for the remainder to be valid EOS padding.
+	pending, pendingOnes := 0, true
+
+	for _, b := range buf {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				// Only EOS (30 bits of 1s) is missing from the tree.
+				return "", ErrHpackInvalidHuffman
+			}
+			pending++
+			pendingOnes = pendingOnes && bit == 1
+			if n.children[0] == nil && n.children[1] == nil {
+				out = append(out, n.sym)
+				n = huffmanRoot
+				pending, pendingOnes = 0, true
+			}
+		}
+	}
+
+	if pending > 7 || !pendingOnes {
+		return "", ErrHpackInvalidHuffman
+	}
+	return string(out), nil
+}
+
+// hpackEncoder encodes header fields using the static table only, so it never
+// has to track the peer's dynamic table size.
+type hpackEncoder struct{}
+
+func (hpackEncoder) Encode(dst []byte, fields []hpackField) []byte {
+	for _, f := range fields {
+		nameIndex := 0
+		exact := false
+		for i, sf := range hpackStaticTable {
+			if sf.name != f.name {
+				continue
+			}
+			if nameIndex == 0 {
+				nameIndex = i + 1
+			}
+			if sf.value == f.value {
+				nameIndex, exact = i+1, true
+				break
+			}
+		}
+
+		if exact {
+			dst = hpackAppendInt(dst, 0x80, 7, uint64(nameIndex))
+			continue
+		}
+
+		// Literal header field without indexing
+		dst = hpackAppendInt(dst, 0x00, 4, uint64(nameIndex))
+		if nameIndex == 0 {
+			dst = hpackAppendString(dst, f.name)
+		}
+		dst = hpackAppendString(dst, f.value)
+	}
+	return dst
+}
+
+func hpackAppendInt(dst []byte, flags byte, prefix uint8, v uint64) []byte {
+	mask := uint64(1)<<prefix - 1
+	if v < mask {
+		return append(dst, flags|byte(v))
+	}
+	dst = append(dst, flags|byte(mask))
+	v -= mask
+	for v >= 0x80 {
+		dst = append(dst, byte(v&0x7f)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func hpackAppendString(dst []byte, s string) []byte {
+	dst = hpackAppendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
@@ -1,23 +1,91 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"maps"
+	"net"
 	"slices"
 	"strconv"
 	"strings"
 )
 
+// TimeFormat is the IMF-fixdate format used in HTTP date headers.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Status codes registered with IANA (RFC 9110 and extensions).
 const (
-	StatusOK                  = 200
-	StatusCreated             = 201
-	StatusBadRequest          = 400
-	StatusNotFound            = 404
-	StatusInternalServerError = 500
+	StatusContinue           = 100
+	StatusSwitchingProtocols = 101
+	StatusProcessing         = 102
+	StatusEarlyHints         = 103
+
+	StatusOK                   = 200
+	StatusCreated              = 201
+	StatusAccepted             = 202
+	StatusNonAuthoritativeInfo = 203
+	StatusNoContent            = 204
+	StatusResetContent         = 205
+	StatusPartialContent       = 206
+	StatusMultiStatus          = 207
+	StatusAlreadyReported      = 208
+	StatusIMUsed               = 226
+
+	StatusMultipleChoices   = 300
+	StatusMovedPermanently  = 301
+	StatusFound             = 302
+	StatusSeeOther          = 303
+	StatusNotModified       = 304
+	StatusUseProxy          = 305
+	StatusTemporaryRedirect = 307
+	StatusPermanentRedirect = 308
+
+	StatusBadRequest                  = 400
+	StatusUnauthorized                = 401
+	StatusPaymentRequired             = 402
+	StatusForbidden                   = 403
+	StatusNotFound                    = 404
+	StatusMethodNotAllowed            = 405
+	StatusNotAcceptable               = 406
+	StatusProxyAuthRequired           = 407
+	StatusRequestTimeout              = 408
+	StatusConflict                    = 409
+	StatusGone                        = 410
+	StatusLengthRequired              = 411
+	StatusPreconditionFailed          = 412
+	StatusContentTooLarge             = 413
+	StatusURITooLong                  = 414
+	StatusUnsupportedMediaType        = 415
+	StatusRangeNotSatisfiable         = 416
+	StatusExpectationFailed           = 417
+	StatusMisdirectedRequest          = 421
+	StatusUnprocessableContent        = 422
+	StatusLocked                      = 423
+	StatusFailedDependency            = 424
+	StatusTooEarly                    = 425
+	StatusUpgradeRequired             = 426
+	StatusPreconditionRequired        = 428
+	StatusTooManyRequests             = 429
+	StatusRequestHeaderFieldsTooLarge = 431
+	StatusUnavailableForLegalReasons  = 451
+
+	StatusInternalServerError           = 500
+	StatusNotImplemented                = 501
+	StatusBadGateway                    = 502
+	StatusServiceUnavailable            = 503
+	StatusGatewayTimeout                = 504
+	StatusHTTPVersionNotSupported       = 505
+	StatusVariantAlsoNegotiates         = 506
+	StatusInsufficientStorage           = 507
+	StatusLoopDetected                  = 508
+	StatusNotExtended                   = 510
+	StatusNetworkAuthenticationRequired = 511
 )
 
 const (
@@ -35,9 +103,19 @@ const (
 const (
 	HeaderContentLength   = "Content-Length"
 	HeaderContentType     = "Content-Type"
+	HeaderAccept          = "Accept"
 	HeaderAcceptEncoding  = "Accept-Encoding"
 	HeaderContentEncoding = "Content-Encoding"
 	HeaderConnection      = "Connection"
+	HeaderKeepAlive       = "Keep-Alive"
+	HeaderAllow           = "Allow"
+	HeaderDate            = "Date"
+	HeaderServer          = "Server"
+	HeaderHost            = "Host"
+	HeaderLocation        = "Location"
+	HeaderUpgrade         = "Upgrade"
+	HeaderHTTP2Settings   = "HTTP2-Settings"
+	HeaderOrigin          = "Origin"
 )
 
 const EncodingGzip = "gzip"
@@ -49,31 +127,174 @@ var (
 	ErrUnsupportedMethod     = errors.New("http: unsupported method")
 	ErrUnsupportedVersion    = errors.New("http: unsupported version")
 	ErrInvalidContentLength  = errors.New("http: invalid content length value")
+	ErrHijacked              = errors.New("http: connection has already been hijacked")
+	ErrHijackNotSupported    = errors.New("http: connection does not support hijacking")
+	ErrInvalidStatusCode     = errors.New("http: invalid status code")
+
+	// Request bodies can only be sent with the chunked transfer coding, and
+	// without Content-Length then.
+	ErrUnsupportedTransferEncoding = errors.New("http: unsupported transfer encoding")
+	ErrContentLengthWithEncoding   = errors.New("http: content length with transfer encoding")
 )
 
 type HttpHeaders map[string]string
 
+// Get returns the value of key, falling back to a case-insensitive match.
+func (h HttpHeaders) Get(key string) string {
+	if v, ok := h[key]; ok {
+		return v
+	}
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Del removes key and every case-insensitive match of it.
+func (h HttpHeaders) Del(key string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
+}
+
 type HttpRequest struct {
 	Method  string
 	Target  string
 	Version string
 	Headers HttpHeaders
 	Body    io.Reader
+
+	// ID is the request ID, either taken from a valid X-Request-ID header or generated by the server.
+	ID  string
+	log *slog.Logger
+
+	// session is attached by the Sessions middleware.
+	session *Session
+	// user is set by the auth middleware once the credentials are verified.
+	user string
+
+	// Connection metadata, populated by the server.
+	RemoteAddr string
+	LocalAddr  string
+	// ConnID uniquely identifies the connection within the server.
+	ConnID uint64
+	// ConnRequestIndex is the 1-based index of the request on its (keep-alive) connection.
+	ConnRequestIndex int
+	// TLS is nil for plain-text connections.
+	TLS *tls.ConnectionState
+}
+
+// Logger returns the request-scoped logger, which carries the request ID.
+func (r *HttpRequest) Logger() *slog.Logger {
+	if r.log == nil {
+		return slog.Default()
+	}
+	return r.log
+}
+
+// RemoteIP returns the IP part of RemoteAddr, or RemoteAddr itself when it has no port.
+func (r *HttpRequest) RemoteIP() string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Path returns the target without its query string.
+func (r *HttpRequest) Path() string {
+	path, _, _ := strings.Cut(r.Target, "?")
+	return path
 }
 
 type HttpResponse struct {
 	Version string
 	Status  int
+	// Reason overrides the reason phrase of Status when not empty.
+	Reason  string
 	Headers HttpHeaders
-	Body    io.Reader
+	// Body is closed once written when it is an io.Closer.
+	Body io.Reader
+
+	// conn and br are set by the server for connections that can be hijacked.
+	conn     net.Conn
+	br       *bufio.Reader
+	hijacked bool
+
+	// cookies are the Set-Cookie values, kept apart from Headers since the
+	// header is repeated once per cookie.
+	cookies []string
+
+	// method is the request method set by the server, HEAD responses are
+	// written without a body.
+	method string
+
+	// newStream is set by the server when the protocol supports streaming.
+	newStream func() (responseStream, error)
+	stream    responseStream
+	// onFinish is run once the handler returned, before the stream ends.
+	onFinish []func()
+
+	// bodySize counts the body bytes sent, without headers or framing.
+	bodySize int64
+
+	// releaseSlot gives back the MaxConcurrentRequests slot of the request
+	// as soon as the response is hijacked or streamed, those may last for
+	// the lifetime of the connection.
+	releaseSlot func()
+}
+
+// detach releases the resources held for the duration of the request.
+func (r *HttpResponse) detach() {
+	if r.releaseSlot != nil {
+		r.releaseSlot()
+	}
+}
+
+// Hijack lets the handler take over the connection. The server writes
+// nothing once the handler returns and the caller must close the connection.
+// Bytes already buffered from the client are available from the returned reader.
+func (r *HttpResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if r.conn == nil {
+		return nil, nil, ErrHijackNotSupported
+	}
+	r.hijacked = true
+	r.detach()
+	return r.conn, bufio.NewReadWriter(r.br, bufio.NewWriter(r.conn)), nil
+}
+
+// Error replaces the response with a plain text error: the status line
+// followed by msg when it is not empty.
+func (r *HttpResponse) Error(code int, msg string) *HttpResponse {
+	body := fmt.Sprintf("%d %s", code, statusString(code))
+	if msg != "" {
+		body += ": " + msg
+	}
+	r.Status = code
+	r.WriteStr(body + "\n")
+	r.Headers["X-Content-Type-Options"] = "nosniff"
+	return r
 }
 
 func (r *HttpResponse) WriteStr(str string) *HttpResponse {
+	return r.WriteStrAs("text/plain", str)
+}
+
+// WriteStrAs sets str as the body with the given content type, typically one
+// chosen by Negotiate.
+func (r *HttpResponse) WriteStrAs(contentType, str string) *HttpResponse {
 	r.Body = strings.NewReader(str)
 	if r.Headers == nil {
 		r.Headers = HttpHeaders{}
 	}
-	r.Headers[HeaderContentType] = "text/plain"
+	r.Headers[HeaderContentType] = contentType
 	return r
 }
 
@@ -86,6 +307,10 @@ func Read(r io.Reader) (*HttpRequest, error) {
 	if err != nil && !errors.Is(err, io.EOF) {
 		return nil, errors.Join(ErrCannotReadRequestLine, err)
 	}
+	if errors.Is(err, io.EOF) && line == "" {
+		// The client closed the connection between requests.
+		return nil, io.EOF
+	}
 	line = strings.TrimRight(line, "\r\n")
 
 	tokens := strings.Fields(line)
@@ -98,7 +323,7 @@ func Read(r io.Reader) (*HttpRequest, error) {
 	if !methodIsValid(method) {
 		return nil, errors.Join(ErrUnsupportedMethod, err)
 	}
-	if version == "" {
+	if !versionIsValid(version) {
 		return nil, errors.Join(ErrUnsupportedVersion, err)
 	}
 
@@ -143,32 +368,32 @@ func Read(r io.Reader) (*HttpRequest, error) {
 }
 
 func Write(w io.Writer, res *HttpResponse) (int64, error) {
+	if !statusIsValid(res.Status) {
+		return 0, ErrInvalidStatusCode
+	}
+
 	bw := newBufferedWriter(w)
 	total := int64(0)
 
 	// Status line
-	n, err := fmt.Fprintf(bw, "%s %d %s\r\n", res.Version, res.Status, statusString(res.Status))
+	n, err := fmt.Fprintf(bw, "%s %d %s\r\n", res.Version, res.Status, res.reasonPhrase())
 	total += int64(n)
 	if err != nil {
 		return total, err
 	}
 
-	var body []byte
-	if res.Body != nil {
-		if res.Headers[HeaderContentEncoding] == EncodingGzip {
-			buff, err := getGzippedBody(res.Body)
-			if err != nil {
-				return total, err
-			}
-			body = buff
-		} else {
-			body, err = io.ReadAll(res.Body)
-		}
+	body, err := readResponseBody(res)
+	if err != nil {
+		return total, err
 	}
 
 	// Headers
 	if res.Headers != nil {
-		res.Headers[HeaderContentLength] = strconv.Itoa(len(body))
+		if bodyAllowedForStatus(res.Status) {
+			res.Headers[HeaderContentLength] = strconv.Itoa(len(body))
+		} else {
+			res.Headers.Del(HeaderContentLength)
+		}
 		// Write headers in alphabetical order
 		for _, k := range slices.Sorted(maps.Keys(res.Headers)) {
 			nn, err := fmt.Fprintf(bw, "%s: %s\r\n", k, res.Headers[k])
@@ -178,6 +403,13 @@ func Write(w io.Writer, res *HttpResponse) (int64, error) {
 			}
 		}
 	}
+	for _, c := range res.cookies {
+		nn, err := fmt.Fprintf(bw, "%s: %s\r\n", HeaderSetCookie, c)
+		total += int64(nn)
+		if err != nil {
+			return total, err
+		}
+	}
 
 	n, err = bw.WriteString("\r\n")
 	total += int64(n)
@@ -186,15 +418,45 @@ func Write(w io.Writer, res *HttpResponse) (int64, error) {
 	}
 
 	// Body
-	nn, err := bw.Write(body)
-	total += int64(nn)
-	if err != nil {
-		return total, err
+	if res.hasBody() {
+		nn, err := bw.Write(body)
+		total += int64(nn)
+		res.bodySize = int64(nn)
+		if err != nil {
+			return total, err
+		}
 	}
 
 	return total, bw.Flush()
 }
 
+// hasBody reports whether the body is sent, HEAD responses keep the headers
+// of the GET equivalent but carry no body.
+func (r *HttpResponse) hasBody() bool {
+	return r.method != MethodHead && bodyAllowedForStatus(r.Status)
+}
+
+// bodyAllowedForStatus reports whether a response with status may carry a
+// body and a Content-Length (RFC 9110, section 6.4.1).
+func bodyAllowedForStatus(status int) bool {
+	return status >= 200 && status != StatusNoContent && status != StatusNotModified
+}
+
+// readResponseBody reads the whole response body, compressing it when the
+// response declares a gzip content encoding, and closes bodies like files.
+func readResponseBody(res *HttpResponse) ([]byte, error) {
+	if res.Body == nil {
+		return nil, nil
+	}
+	if c, ok := res.Body.(io.Closer); ok {
+		defer c.Close()
+	}
+	if res.Headers[HeaderContentEncoding] == EncodingGzip {
+		return getGzippedBody(res.Body)
+	}
+	return io.ReadAll(res.Body)
+}
+
 func getGzippedBody(responseBody io.Reader) ([]byte, error) {
 	var buff bytes.Buffer
 	gzipWriter := gzip.NewWriter(&buff)
@@ -214,18 +476,143 @@ func getGzippedBody(responseBody io.Reader) ([]byte, error) {
 	return buff.Bytes(), nil
 }
 
+func (r *HttpResponse) reasonPhrase() string {
+	if r.Reason != "" {
+		return stripNewlines(r.Reason)
+	}
+	return statusString(r.Status)
+}
+
+// statusIsValid reports whether code has the three digits required in a status line.
+func statusIsValid(code int) bool {
+	return code >= 100 && code <= 999
+}
+
+// statusString returns the reason phrase of code, empty for unregistered codes.
 func statusString(code int) string {
 	switch code {
+	case StatusContinue:
+		return "Continue"
+	case StatusSwitchingProtocols:
+		return "Switching Protocols"
+	case StatusProcessing:
+		return "Processing"
+	case StatusEarlyHints:
+		return "Early Hints"
 	case StatusOK:
 		return "OK"
 	case StatusCreated:
 		return "Created"
+	case StatusAccepted:
+		return "Accepted"
+	case StatusNonAuthoritativeInfo:
+		return "Non-Authoritative Information"
+	case StatusNoContent:
+		return "No Content"
+	case StatusResetContent:
+		return "Reset Content"
+	case StatusPartialContent:
+		return "Partial Content"
+	case StatusMultiStatus:
+		return "Multi-Status"
+	case StatusAlreadyReported:
+		return "Already Reported"
+	case StatusIMUsed:
+		return "IM Used"
+	case StatusMultipleChoices:
+		return "Multiple Choices"
+	case StatusMovedPermanently:
+		return "Moved Permanently"
+	case StatusFound:
+		return "Found"
+	case StatusSeeOther:
+		return "See Other"
+	case StatusNotModified:
+		return "Not Modified"
+	case StatusUseProxy:
+		return "Use Proxy"
+	case StatusTemporaryRedirect:
+		return "Temporary Redirect"
+	case StatusPermanentRedirect:
+		return "Permanent Redirect"
 	case StatusBadRequest:
 		return "Bad Request"
+	case StatusUnauthorized:
+		return "Unauthorized"
+	case StatusPaymentRequired:
+		return "Payment Required"
+	case StatusForbidden:
+		return "Forbidden"
 	case StatusNotFound:
 		return "Not Found"
+	case StatusMethodNotAllowed:
+		return "Method Not Allowed"
+	case StatusNotAcceptable:
+		return "Not Acceptable"
+	case StatusProxyAuthRequired:
+		return "Proxy Authentication Required"
+	case StatusRequestTimeout:
+		return "Request Timeout"
+	case StatusConflict:
+		return "Conflict"
+	case StatusGone:
+		return "Gone"
+	case StatusLengthRequired:
+		return "Length Required"
+	case StatusPreconditionFailed:
+		return "Precondition Failed"
+	case StatusContentTooLarge:
+		return "Content Too Large"
+	case StatusURITooLong:
+		return "URI Too Long"
+	case StatusUnsupportedMediaType:
+		return "Unsupported Media Type"
+	case StatusRangeNotSatisfiable:
+		return "Range Not Satisfiable"
+	case StatusExpectationFailed:
+		return "Expectation Failed"
+	case StatusMisdirectedRequest:
+		return "Misdirected Request"
+	case StatusUnprocessableContent:
+		return "Unprocessable Content"
+	case StatusLocked:
+		return "Locked"
+	case StatusFailedDependency:
+		return "Failed Dependency"
+	case StatusTooEarly:
+		return "Too Early"
+	case StatusUpgradeRequired:
+		return "Upgrade Required"
+	case StatusPreconditionRequired:
+		return "Precondition Required"
+	case StatusTooManyRequests:
+		return "Too Many Requests"
+	case StatusRequestHeaderFieldsTooLarge:
+		return "Request Header Fields Too Large"
+	case StatusUnavailableForLegalReasons:
+		return "Unavailable For Legal Reasons"
 	case StatusInternalServerError:
 		return "Internal Server Error"
+	case StatusNotImplemented:
+		return "Not Implemented"
+	case StatusBadGateway:
+		return "Bad Gateway"
+	case StatusServiceUnavailable:
+		return "Service Unavailable"
+	case StatusGatewayTimeout:
+		return "Gateway Timeout"
+	case StatusHTTPVersionNotSupported:
+		return "HTTP Version Not Supported"
+	case StatusVariantAlsoNegotiates:
+		return "Variant Also Negotiates"
+	case StatusInsufficientStorage:
+		return "Insufficient Storage"
+	case StatusLoopDetected:
+		return "Loop Detected"
+	case StatusNotExtended:
+		return "Not Extended"
+	case StatusNetworkAuthenticationRequired:
+		return "Network Authentication Required"
 	default:
 		return ""
 	}
@@ -242,6 +629,17 @@ func methodIsValid(method string) bool {
 	}
 }
 
+// versionIsValid reports whether version has the HTTP/<digit>.<digit> form,
+// the server decides which versions it supports.
+func versionIsValid(version string) bool {
+	return len(version) == 8 && strings.HasPrefix(version, "HTTP/") &&
+		isDigit(version[5]) && version[6] == '.' && isDigit(version[7])
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
 func newCleanResponse() *HttpResponse {
 	return &HttpResponse{
 		Version: "HTTP/1.1",
@@ -0,0 +1,1254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/textproto"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP/2 (RFC 9113) server side, selected via ALPN on TLS connections and via
+// prior knowledge or "Upgrade: h2c" on clear-text ones. Every stream is
+// dispatched to Server.Handler exactly like an HTTP/1.1 request.
+
+const (
+	http2Preface    = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	http2ALPN       = "h2"
+	http2UpgradeH2C = "h2c"
+	http2Version    = "HTTP/2.0"
+
+	http2FrameHeaderLen      = 9
+	http2DefaultWindowSize   = 65535
+	http2MaxWindowSize       = 1<<31 - 1
+	http2DefaultMaxFrameSize = 16384
+	http2MaxFrameSizeLimit   = 1<<24 - 1
+
+	http2MaxConcurrentStreams = 100
+	http2MaxHeaderListSize    = 1 << 20
+	http2MaxUpgradeBodySize   = 1 << 20
+)
+
+const (
+	http2FrameData         uint8 = 0x0
+	http2FrameHeaders      uint8 = 0x1
+	http2FramePriority     uint8 = 0x2
+	http2FrameRSTStream    uint8 = 0x3
+	http2FrameSettings     uint8 = 0x4
+	http2FramePushPromise  uint8 = 0x5
+	http2FramePing         uint8 = 0x6
+	http2FrameGoAway       uint8 = 0x7
+	http2FrameWindowUpdate uint8 = 0x8
+	http2FrameContinuation uint8 = 0x9
+)
+
+const (
+	http2FlagEndStream  uint8 = 0x1
+	http2FlagAck        uint8 = 0x1
+	http2FlagEndHeaders uint8 = 0x4
+	http2FlagPadded     uint8 = 0x8
+	http2FlagPriority   uint8 = 0x20
+)
+
+const (
+	http2SettingHeaderTableSize      uint16 = 0x1
+	http2SettingEnablePush           uint16 = 0x2
+	http2SettingMaxConcurrentStreams uint16 = 0x3
+	http2SettingInitialWindowSize    uint16 = 0x4
+	http2SettingMaxFrameSize         uint16 = 0x5
+	http2SettingMaxHeaderListSize    uint16 = 0x6
+)
+
+type http2ErrCode uint32
+
+const (
+	http2ErrNoError         http2ErrCode = 0x0
+	http2ErrProtocol        http2ErrCode = 0x1
+	http2ErrInternal        http2ErrCode = 0x2
+	http2ErrFlowControl     http2ErrCode = 0x3
+	http2ErrStreamClosed    http2ErrCode = 0x5
+	http2ErrFrameSize       http2ErrCode = 0x6
+	http2ErrRefusedStream   http2ErrCode = 0x7
+	http2ErrCompression     http2ErrCode = 0x9
+	http2ErrEnhanceYourCalm http2ErrCode = 0xb
+)
+
+var (
+	ErrHTTP2InvalidPreface = errors.New("http2: invalid connection preface")
+	ErrHTTP2StreamReset    = errors.New("http2: stream reset")
+	ErrHTTP2ConnClosed     = errors.New("http2: connection closed")
+)
+
+// http2ConnError terminates the whole connection with a GOAWAY.
+type http2ConnError struct {
+	code   http2ErrCode
+	reason string
+}
+
+func (e http2ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.code, e.reason)
+}
+
+// http2StreamError resets a single stream.
+type http2StreamError struct {
+	streamID uint32
+	code     http2ErrCode
+}
+
+func (e http2StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d", e.streamID, e.code)
+}
+
+type http2Frame struct {
+	typ      uint8
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f http2Frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+func readHTTP2Frame(r io.Reader, maxSize uint32) (http2Frame, error) {
+	var hdr [http2FrameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return http2Frame{}, err
+	}
+
+	length := uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+	f := http2Frame{
+		typ:      hdr[3],
+		flags:    hdr[4],
+		streamID: binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff,
+	}
+	if length > maxSize {
+		return f, http2ConnError{http2ErrFrameSize, "frame too large"}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func appendHTTP2Frame(dst []byte, typ, flags uint8, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), typ, flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID&0x7fffffff)
+	return append(dst, payload...)
+}
+
+// stripPadding removes the padding of DATA and HEADERS frames.
+func stripPadding(f http2Frame) ([]byte, error) {
+	payload := f.payload
+	if !f.has(http2FlagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, http2ConnError{http2ErrProtocol, "missing pad length"}
+	}
+	padLen := int(payload[0])
+	payload = payload[1:]
+	if padLen > len(payload) {
+		return nil, http2ConnError{http2ErrProtocol, "padding exceeds payload"}
+	}
+	return payload[:len(payload)-padLen], nil
+}
+
+type http2Conn struct {
+	srv    *Server
+	conn   net.Conn
+	connID uint64
+	log    *slog.Logger
+
+	// wmu serializes frame writes, a header block and its continuations are
+	// written while holding it.
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	// Everything below is guarded by mu, cond is signalled whenever a send
+	// window grows or a stream or the connection goes away.
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*http2Stream
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	lastStreamID      uint32
+	requestCount      int
+	goingAway         bool
+	closed            bool
+	// idleTimer shuts the connection down after Server.IdleTimeout without
+	// open streams, the connection may be shed meanwhile.
+	idleTimer *time.Timer
+
+	// Only accessed by the read loop.
+	decoder      *hpackDecoder
+	headerBlock  []byte
+	headerStream uint32
+	headerEnds   bool
+	sawSettings  bool
+
+	encoder  hpackEncoder
+	handlers sync.WaitGroup
+}
+
+type http2Stream struct {
+	id            uint32
+	sendWindow    int64
+	recvWindow    int64
+	body          *http2Body
+	remoteClosed  bool
+	reset         bool
+	contentLength int64
+	received      int64
+	// done is closed when the stream is reset or the connection goes away.
+	done chan struct{}
+}
+
+// abort marks the stream as reset, the caller must hold sc.mu.
+func (st *http2Stream) abort(err error) {
+	if st.reset {
+		return
+	}
+	st.reset = true
+	st.body.closeWithError(err)
+	close(st.done)
+}
+
+func newHTTP2Conn(srv *Server, conn net.Conn, connID uint64) *http2Conn {
+	sc := &http2Conn{
+		srv:               srv,
+		conn:              conn,
+		connID:            connID,
+		log:               srv.log.With(slog.Uint64("conn_id", connID), slog.String("proto", http2Version)),
+		bw:                bufio.NewWriter(conn),
+		streams:           make(map[uint32]*http2Stream),
+		sendWindow:        http2DefaultWindowSize,
+		peerInitialWindow: http2DefaultWindowSize,
+		peerMaxFrameSize:  http2DefaultMaxFrameSize,
+		decoder:           newHpackDecoder(hpackDefaultTableSize, http2MaxHeaderListSize),
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+// serveHTTP2 runs an HTTP/2 connection until it is closed. When upgrade is not
+// nil the connection was upgraded from HTTP/1.1 and upgrade is served as stream 1.
+func (srv *Server) serveHTTP2(conn net.Conn, br *bufio.Reader, connID uint64, upgrade *HttpRequest, upgradeSettings []byte) {
+	sc := newHTTP2Conn(srv, conn, connID)
+	defer sc.close()
+	srv.conns.setShutdown(conn, sc.shutdown)
+
+	if err := sc.writeSettings(); err != nil {
+		sc.log.Warn("could not write settings", slog.String("error", err.Error()))
+		return
+	}
+
+	if upgrade != nil {
+		if err := sc.applySettings(upgradeSettings); err != nil {
+			sc.goAway(err)
+			return
+		}
+		body, err := io.ReadAll(upgrade.Body)
+		if err != nil {
+			sc.log.Warn("could not read upgrade request body", slog.String("error", err.Error()))
+			return
+		}
+		stream := sc.newStream(1, -1)
+		stream.remoteClosed = true
+		stream.body.write(body)
+		stream.body.closeWithError(io.EOF)
+		sc.lastStreamID = 1
+		sc.dispatch(stream, upgrade)
+	}
+	sc.mu.Lock()
+	sc.streamsChanged()
+	sc.mu.Unlock()
+
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(br, preface); err != nil || string(preface) != http2Preface {
+		sc.goAway(http2ConnError{http2ErrProtocol, ErrHTTP2InvalidPreface.Error()})
+		return
+	}
+
+	for {
+		f, err := readHTTP2Frame(br, http2DefaultMaxFrameSize)
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+
+		var streamErr http2StreamError
+		switch {
+		case err == nil:
+		case errors.As(err, &streamErr):
+			sc.resetStream(streamErr.streamID, streamErr.code)
+		case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), errors.Is(err, os.ErrDeadlineExceeded):
+			return
+		default:
+			sc.goAway(err)
+			return
+		}
+	}
+}
+
+func (sc *http2Conn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.abort(ErrHTTP2ConnClosed)
+	}
+	sc.streamsChanged()
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	// Unblock handlers writing to the network before waiting for them.
+	_ = sc.conn.SetWriteDeadline(time.Now())
+	sc.handlers.Wait()
+}
+
+// goAway sends GOAWAY with the error code derived from err.
+func (sc *http2Conn) goAway(err error) {
+	code := http2ErrInternal
+	var connErr http2ConnError
+	if errors.As(err, &connErr) {
+		code = connErr.code
+	} else if errors.Is(err, ErrHpackInvalidIndex) || errors.Is(err, ErrHpackTruncated) ||
+		errors.Is(err, ErrHpackInvalidHuffman) || errors.Is(err, ErrHpackIntegerOverflow) ||
+		errors.Is(err, ErrHpackInvalidTableSize) || errors.Is(err, ErrHpackHeaderListSize) {
+		code = http2ErrCompression
+	}
+	sc.log.Warn("closing connection", slog.String("error", err.Error()))
+
+	sc.mu.Lock()
+	sc.goingAway = true
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	if code != http2ErrNoError {
+		payload = append(payload, err.Error()...)
+	}
+	_ = sc.writeFrame(http2FrameGoAway, 0, 0, payload)
+}
+
+// shutdown sends GOAWAY so the client opens no more streams, the read loop
+// ends once the open ones are served.
+func (sc *http2Conn) shutdown() {
+	sc.mu.Lock()
+	sc.goingAway = true
+	lastStreamID := sc.lastStreamID
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(http2ErrNoError))
+	_ = sc.writeFrame(http2FrameGoAway, 0, 0, payload)
+	if idle {
+		_ = sc.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// closeIdle shuts the connection down when the idle timeout expires without
+// a stream being opened in the meantime.
+func (sc *http2Conn) closeIdle() {
+	sc.mu.Lock()
+	idle := len(sc.streams) == 0 && !sc.closed
+	sc.mu.Unlock()
+	if idle {
+		sc.shutdown()
+	}
+}
+
+// streamsChanged marks the connection idle and arms the idle timer when the
+// last stream is gone, and undoes both when one opens. The caller must hold
+// sc.mu.
+func (sc *http2Conn) streamsChanged() {
+	idle := len(sc.streams) == 0 && !sc.closed
+	sc.srv.conns.setIdle(sc.conn, idle)
+	if sc.srv.IdleTimeout <= 0 {
+		return
+	}
+	if !idle {
+		if sc.idleTimer != nil {
+			sc.idleTimer.Stop()
+		}
+		return
+	}
+	if sc.idleTimer == nil {
+		sc.idleTimer = time.AfterFunc(sc.srv.IdleTimeout, sc.closeIdle)
+		return
+	}
+	sc.idleTimer.Reset(sc.srv.IdleTimeout)
+}
+
+func (sc *http2Conn) writeFrame(typ, flags uint8, streamID uint32, payload []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if _, err := sc.bw.Write(appendHTTP2Frame(nil, typ, flags, streamID, payload)); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+func (sc *http2Conn) writeSettings() error {
+	var payload []byte
+	for _, s := range []struct {
+		id    uint16
+		value uint32
+	}{
+		{http2SettingMaxConcurrentStreams, http2MaxConcurrentStreams},
+		{http2SettingInitialWindowSize, http2DefaultWindowSize},
+		{http2SettingMaxFrameSize, http2DefaultMaxFrameSize},
+		{http2SettingMaxHeaderListSize, http2MaxHeaderListSize},
+		{http2SettingEnablePush, 0},
+	} {
+		payload = binary.BigEndian.AppendUint16(payload, s.id)
+		payload = binary.BigEndian.AppendUint32(payload, s.value)
+	}
+	return sc.writeFrame(http2FrameSettings, 0, 0, payload)
+}
+
+func (sc *http2Conn) writeWindowUpdate(streamID uint32, n int) error {
+	return sc.writeFrame(http2FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(n)))
+}
+
+func (sc *http2Conn) resetStream(streamID uint32, code http2ErrCode) {
+	sc.mu.Lock()
+	if st, ok := sc.streams[streamID]; ok {
+		st.abort(ErrHTTP2StreamReset)
+		delete(sc.streams, streamID)
+		sc.streamsChanged()
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+	_ = sc.writeFrame(http2FrameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func (sc *http2Conn) processFrame(f http2Frame) error {
+	if !sc.sawSettings && f.typ != http2FrameSettings {
+		return http2ConnError{http2ErrProtocol, "expected SETTINGS as first frame"}
+	}
+	if sc.headerStream != 0 && (f.typ != http2FrameContinuation || f.streamID != sc.headerStream) {
+		return http2ConnError{http2ErrProtocol, "expected CONTINUATION"}
+	}
+
+	switch f.typ {
+	case http2FrameData:
+		return sc.processData(f)
+	case http2FrameHeaders:
+		return sc.processHeaders(f)
+	case http2FrameContinuation:
+		return sc.processContinuation(f)
+	case http2FramePriority:
+		if f.streamID == 0 {
+			return http2ConnError{http2ErrProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return http2StreamError{f.streamID, http2ErrFrameSize}
+		}
+		return nil
+	case http2FrameRSTStream:
+		return sc.processRSTStream(f)
+	case http2FrameSettings:
+		return sc.processSettings(f)
+	case http2FramePushPromise:
+		return http2ConnError{http2ErrProtocol, "clients cannot push"}
+	case http2FramePing:
+		return sc.processPing(f)
+	case http2FrameGoAway:
+		return sc.processGoAway(f)
+	case http2FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	default:
+		// Unknown frame types must be ignored.
+		return nil
+	}
+}
+
+func (sc *http2Conn) processSettings(f http2Frame) error {
+	if f.streamID != 0 {
+		return http2ConnError{http2ErrProtocol, "SETTINGS on a stream"}
+	}
+	if f.has(http2FlagAck) {
+		if len(f.payload) != 0 {
+			return http2ConnError{http2ErrFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	sc.sawSettings = true
+
+	if err := sc.applySettings(f.payload); err != nil {
+		return err
+	}
+	return sc.writeFrame(http2FrameSettings, http2FlagAck, 0, nil)
+}
+
+func (sc *http2Conn) applySettings(payload []byte) error {
+	if len(payload)%6 != 0 {
+		return http2ConnError{http2ErrFrameSize, "invalid SETTINGS length"}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for ; len(payload) > 0; payload = payload[6:] {
+		id := binary.BigEndian.Uint16(payload)
+		value := binary.BigEndian.Uint32(payload[2:])
+
+		switch id {
+		case http2SettingEnablePush:
+			if value > 1 {
+				return http2ConnError{http2ErrProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case http2SettingInitialWindowSize:
+			if value > http2MaxWindowSize {
+				return http2ConnError{http2ErrFlowControl, "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			delta := int64(value) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > http2MaxWindowSize {
+					return http2ConnError{http2ErrFlowControl, "stream window overflow"}
+				}
+			}
+			sc.cond.Broadcast()
+		case http2SettingMaxFrameSize:
+			if value < http2DefaultMaxFrameSize || value > http2MaxFrameSizeLimit {
+				return http2ConnError{http2ErrProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			sc.peerMaxFrameSize = value
+		}
+		// SETTINGS_HEADER_TABLE_SIZE does not matter as the encoder never uses
+		// the dynamic table, the remaining settings are advisory.
+	}
+	return nil
+}
+
+func (sc *http2Conn) processPing(f http2Frame) error {
+	if f.streamID != 0 {
+		return http2ConnError{http2ErrProtocol, "PING on a stream"}
+	}
+	if len(f.payload) != 8 {
+		return http2ConnError{http2ErrFrameSize, "invalid PING length"}
+	}
+	if f.has(http2FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(http2FramePing, http2FlagAck, 0, f.payload)
+}
+
+func (sc *http2Conn) processGoAway(f http2Frame) error {
+	if f.streamID != 0 {
+		return http2ConnError{http2ErrProtocol, "GOAWAY on a stream"}
+	}
+	if len(f.payload) < 8 {
+		return http2ConnError{http2ErrFrameSize, "invalid GOAWAY length"}
+	}
+
+	sc.mu.Lock()
+	sc.goingAway = true
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	sc.log.Info("peer sent GOAWAY", slog.Uint64("code", uint64(binary.BigEndian.Uint32(f.payload[4:]))))
+	if idle {
+		return io.EOF
+	}
+	return nil
+}
+
+func (sc *http2Conn) processWindowUpdate(f http2Frame) error {
+	if len(f.payload) != 4 {
+		return http2ConnError{http2ErrFrameSize, "invalid WINDOW_UPDATE length"}
+	}
+	inc := int64(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if f.streamID == 0 {
+		if inc == 0 {
+			return http2ConnError{http2ErrProtocol, "zero WINDOW_UPDATE"}
+		}
+		sc.sendWindow += inc
+		if sc.sendWindow > http2MaxWindowSize {
+			return http2ConnError{http2ErrFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	if f.streamID > sc.lastStreamID {
+		return http2ConnError{http2ErrProtocol, "WINDOW_UPDATE on idle stream"}
+	}
+	st, ok := sc.streams[f.streamID]
+	if !ok {
+		// The stream is already closed on our side.
+		return nil
+	}
+	if inc == 0 {
+		return http2StreamError{f.streamID, http2ErrProtocol}
+	}
+	st.sendWindow += inc
+	if st.sendWindow > http2MaxWindowSize {
+		return http2StreamError{f.streamID, http2ErrFlowControl}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *http2Conn) processRSTStream(f http2Frame) error {
+	if f.streamID == 0 {
+		return http2ConnError{http2ErrProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.payload) != 4 {
+		return http2ConnError{http2ErrFrameSize, "invalid RST_STREAM length"}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID > sc.lastStreamID {
+		return http2ConnError{http2ErrProtocol, "RST_STREAM on idle stream"}
+	}
+	if st, ok := sc.streams[f.streamID]; ok {
+		st.abort(ErrHTTP2StreamReset)
+		delete(sc.streams, f.streamID)
+		sc.streamsChanged()
+		sc.cond.Broadcast()
+	}
+	return nil
+}
+
+func (sc *http2Conn) processData(f http2Frame) error {
+	if f.streamID == 0 {
+		return http2ConnError{http2ErrProtocol, "DATA on stream 0"}
+	}
+
+	// The whole frame, padding included, counts against flow control. The
+	// connection window is replenished right away, stream windows as the
+	// handler consumes the body.
+	if n := len(f.payload); n > 0 {
+		if err := sc.writeWindowUpdate(0, n); err != nil {
+			return err
+		}
+	}
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st, ok := sc.streams[f.streamID]
+	if !ok {
+		if f.streamID > sc.lastStreamID {
+			return http2ConnError{http2ErrProtocol, "DATA on idle stream"}
+		}
+		return http2StreamError{f.streamID, http2ErrStreamClosed}
+	}
+	if st.remoteClosed {
+		return http2StreamError{f.streamID, http2ErrStreamClosed}
+	}
+
+	st.recvWindow -= int64(len(f.payload))
+	if st.recvWindow < 0 {
+		return http2StreamError{f.streamID, http2ErrFlowControl}
+	}
+	// Padding is never handed to the handler, so give it back immediately.
+	if pad := len(f.payload) - len(data); pad > 0 {
+		st.recvWindow += int64(pad)
+		if err := sc.writeWindowUpdate(f.streamID, pad); err != nil {
+			return err
+		}
+	}
+
+	st.received += int64(len(data))
+	if st.contentLength >= 0 && st.received > st.contentLength {
+		return http2StreamError{f.streamID, http2ErrProtocol}
+	}
+	st.body.write(data)
+
+	if f.has(http2FlagEndStream) {
+		if st.contentLength >= 0 && st.received != st.contentLength {
+			return http2StreamError{f.streamID, http2ErrProtocol}
+		}
+		st.remoteClosed = true
+		st.body.closeWithError(io.EOF)
+	}
+	return nil
+}
+
+func (sc *http2Conn) processHeaders(f http2Frame) error {
+	if f.streamID == 0 || f.streamID%2 == 0 {
+		return http2ConnError{http2ErrProtocol, "invalid HEADERS stream id"}
+	}
+	block, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.has(http2FlagPriority) {
+		if len(block) < 5 {
+			return http2ConnError{http2ErrFrameSize, "HEADERS priority truncated"}
+		}
+		block = block[5:]
+	}
+
+	sc.headerBlock = append(sc.headerBlock[:0], block...)
+	sc.headerEnds = f.has(http2FlagEndStream)
+	if !f.has(http2FlagEndHeaders) {
+		sc.headerStream = f.streamID
+		return nil
+	}
+	return sc.processHeaderBlock(f.streamID)
+}
+
+func (sc *http2Conn) processContinuation(f http2Frame) error {
+	if sc.headerStream == 0 {
+		return http2ConnError{http2ErrProtocol, "unexpected CONTINUATION"}
+	}
+	if len(sc.headerBlock)+len(f.payload) > http2MaxHeaderListSize {
+		return http2ConnError{http2ErrEnhanceYourCalm, "header block too large"}
+	}
+	sc.headerBlock = append(sc.headerBlock, f.payload...)
+	if !f.has(http2FlagEndHeaders) {
+		return nil
+	}
+	streamID := sc.headerStream
+	sc.headerStream = 0
+	return sc.processHeaderBlock(streamID)
+}
+
+func (sc *http2Conn) processHeaderBlock(streamID uint32) error {
+	// The block must always be decoded to keep the HPACK state in sync.
+	fields, err := sc.decoder.Decode(sc.headerBlock)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	if st, ok := sc.streams[streamID]; ok {
+		// Trailers, they must end the stream and are otherwise ignored.
+		defer sc.mu.Unlock()
+		if !sc.headerEnds || st.remoteClosed {
+			return http2StreamError{streamID, http2ErrProtocol}
+		}
+		st.remoteClosed = true
+		st.body.closeWithError(io.EOF)
+		return nil
+	}
+	if streamID <= sc.lastStreamID {
+		sc.mu.Unlock()
+		return http2ConnError{http2ErrStreamClosed, "HEADERS on closed stream"}
+	}
+	sc.lastStreamID = streamID
+	goingAway := sc.goingAway
+	active := len(sc.streams)
+	sc.mu.Unlock()
+
+	if goingAway {
+		return nil
+	}
+	if active >= http2MaxConcurrentStreams {
+		return http2StreamError{streamID, http2ErrRefusedStream}
+	}
+
+	req, err := newHTTP2Request(fields)
+	if err != nil {
+		return http2StreamError{streamID, http2ErrProtocol}
+	}
+
+	contentLength := int64(-1)
+	if cl := req.Headers[HeaderContentLength]; cl != "" {
+		if contentLength, err = strconv.ParseInt(cl, 10, 64); err != nil || contentLength < 0 {
+			return http2StreamError{streamID, http2ErrProtocol}
+		}
+	}
+
+	sc.mu.Lock()
+	st := sc.newStream(streamID, contentLength)
+	if sc.headerEnds {
+		if contentLength > 0 {
+			sc.mu.Unlock()
+			sc.resetStream(streamID, http2ErrProtocol)
+			return nil
+		}
+		st.remoteClosed = true
+		st.body.closeWithError(io.EOF)
+	}
+	sc.mu.Unlock()
+
+	sc.dispatch(st, req)
+	return nil
+}
+
+// newStream registers a stream, the caller must hold sc.mu unless the read loop has not started yet.
+func (sc *http2Conn) newStream(id uint32, contentLength int64) *http2Stream {
+	st := &http2Stream{
+		id:            id,
+		sendWindow:    sc.peerInitialWindow,
+		recvWindow:    http2DefaultWindowSize,
+		contentLength: contentLength,
+		done:          make(chan struct{}),
+	}
+	st.body = newHTTP2Body(sc, st)
+	sc.streams[id] = st
+	sc.streamsChanged()
+	return st
+}
+
+// newHTTP2Request builds a request from decoded header fields. Header names
+// are canonicalized so handlers see the same keys as over HTTP/1.1.
+func newHTTP2Request(fields []hpackField) (*HttpRequest, error) {
+	req := &HttpRequest{
+		Version: http2Version,
+		Headers: HttpHeaders{},
+	}
+	var scheme, authority string
+	regular := false
+
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			if regular {
+				return nil, errors.New("pseudo header after regular header")
+			}
+			var dst *string
+			switch f.name {
+			case ":method":
+				dst = &req.Method
+			case ":path":
+				dst = &req.Target
+			case ":scheme":
+				dst = &scheme
+			case ":authority":
+				dst = &authority
+			default:
+				return nil, fmt.Errorf("unknown pseudo header %s", f.name)
+			}
+			if *dst != "" {
+				return nil, fmt.Errorf("duplicated pseudo header %s", f.name)
+			}
+			*dst = f.value
+			continue
+		}
+
+		regular = true
+		if f.name != strings.ToLower(f.name) {
+			return nil, fmt.Errorf("upper case header name %s", f.name)
+		}
+		switch f.name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return nil, fmt.Errorf("connection specific header %s", f.name)
+		case "te":
+			if f.value != "trailers" {
+				return nil, errors.New("invalid TE header")
+			}
+		}
+
+		key := textproto.CanonicalMIMEHeaderKey(f.name)
+		if prev, ok := req.Headers[key]; ok {
+			sep := ", "
+			if key == "Cookie" {
+				sep = "; "
+			}
+			req.Headers[key] = prev + sep + f.value
+		} else {
+			req.Headers[key] = f.value
+		}
+	}
+
+	if !methodIsValid(req.Method) {
+		return nil, ErrUnsupportedMethod
+	}
+	if req.Method != MethodConnect && (req.Target == "" || scheme == "") {
+		return nil, errors.New("missing pseudo headers")
+	}
+	if authority != "" {
+		if _, ok := req.Headers[HeaderHost]; !ok {
+			req.Headers[HeaderHost] = authority
+		}
+	}
+	return req, nil
+}
+
+func (sc *http2Conn) dispatch(st *http2Stream, req *HttpRequest) {
+	sc.mu.Lock()
+	sc.requestCount++
+	requestIndex := sc.requestCount
+	sc.mu.Unlock()
+
+	setConnMetadata(req, sc.conn, sc.connID, requestIndex)
+	req.Body = st.body
+
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		sc.serveStream(st, req)
+	}()
+}
+
+func (sc *http2Conn) serveStream(st *http2Stream, req *HttpRequest) {
+	start := time.Now()
+	if expectsContinue(req) {
+		req.Body = &continueReader{r: req.Body, send: func() error {
+			block := sc.encoder.Encode(nil, []hpackField{{name: ":status", value: strconv.Itoa(StatusContinue)}})
+			_, err := sc.writeHeaderBlock(st.id, block, false)
+			return err
+		}}
+	}
+	body := &countingReader{r: req.Body}
+	req.Body = body
+
+	res := newCleanResponse()
+	res.Version = http2Version
+	res.method = req.Method
+	res.newStream = func() (responseStream, error) {
+		return sc.newResponseStream(st, res)
+	}
+	sc.srv.serveRequest(req, res)
+
+	var (
+		n   int64
+		err error
+	)
+	if res.stream != nil {
+		err = res.finishStream()
+		n = res.stream.written()
+	} else {
+		n, err = sc.writeResponse(st, res)
+	}
+	if err != nil {
+		req.Logger().Warn("could not write response", slog.String("error", err.Error()))
+	} else {
+		sc.srv.logRequest(req, res, start, body.n, n)
+	}
+
+	sc.mu.Lock()
+	unfinished := !st.remoteClosed && !st.reset
+	delete(sc.streams, st.id)
+	sc.streamsChanged()
+	idle := sc.goingAway && len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	if unfinished && err == nil {
+		// The response is complete, tell the client to stop sending the body.
+		_ = sc.writeFrame(http2FrameRSTStream, 0, st.id, binary.BigEndian.AppendUint32(nil, uint32(http2ErrNoError)))
+	}
+	if idle {
+		// Wake up the read loop, the peer is gone and nothing is left to serve.
+		_ = sc.conn.SetReadDeadline(time.Now())
+	}
+}
+
+var http2ConnectionHeaders = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+func (sc *http2Conn) writeResponse(st *http2Stream, res *HttpResponse) (int64, error) {
+	body, err := readResponseBody(res)
+	if err != nil {
+		return 0, err
+	}
+
+	if bodyAllowedForStatus(res.Status) {
+		res.Headers[HeaderContentLength] = strconv.Itoa(len(body))
+	} else {
+		res.Headers.Del(HeaderContentLength)
+	}
+	if !res.hasBody() {
+		body = nil
+	}
+	total, err := sc.writeHeaderBlock(st.id, sc.encodeResponseHeaders(res), len(body) == 0)
+	if err != nil {
+		return total, err
+	}
+
+	n, err := sc.writeData(st, body, true)
+	if err == nil {
+		res.bodySize = int64(len(body))
+	}
+	return total + n, err
+}
+
+func (sc *http2Conn) encodeResponseHeaders(res *HttpResponse) []byte {
+	fields := []hpackField{{name: ":status", value: strconv.Itoa(res.Status)}}
+	for _, k := range slices.Sorted(maps.Keys(res.Headers)) {
+		name := strings.ToLower(k)
+		if slices.Contains(http2ConnectionHeaders, name) {
+			continue
+		}
+		fields = append(fields, hpackField{name: name, value: res.Headers[k]})
+	}
+	for _, c := range res.cookies {
+		fields = append(fields, hpackField{name: "set-cookie", value: c})
+	}
+	return sc.encoder.Encode(nil, fields)
+}
+
+// writeData sends data in DATA frames respecting flow control, the last
+// frame ends the stream when endStream is set.
+func (sc *http2Conn) writeData(st *http2Stream, data []byte, endStream bool) (int64, error) {
+	var total int64
+	for len(data) > 0 {
+		n, err := sc.reserveSendWindow(st, len(data))
+		if err != nil {
+			return total, err
+		}
+
+		var flags uint8
+		if n == len(data) && endStream {
+			flags = http2FlagEndStream
+		}
+		if err := sc.writeFrame(http2FrameData, flags, st.id, data[:n]); err != nil {
+			return total, err
+		}
+		total += int64(http2FrameHeaderLen + n)
+		data = data[n:]
+	}
+	return total, nil
+}
+
+// http2ResponseStream streams a response body as DATA frames.
+type http2ResponseStream struct {
+	sc      *http2Conn
+	st      *http2Stream
+	res     *HttpResponse
+	discard bool
+	n       int64
+}
+
+func (sc *http2Conn) newResponseStream(st *http2Stream, res *HttpResponse) (*http2ResponseStream, error) {
+	res.Headers.Del(HeaderContentLength)
+	n, err := sc.writeHeaderBlock(st.id, sc.encodeResponseHeaders(res), false)
+	if err != nil {
+		return nil, err
+	}
+	return &http2ResponseStream{sc: sc, st: st, res: res, discard: !res.hasBody(), n: n}, nil
+}
+
+func (s *http2ResponseStream) Write(p []byte) (int, error) {
+	if s.discard {
+		return len(p), nil
+	}
+	n, err := s.sc.writeData(s.st, p, false)
+	s.n += n
+	if err != nil {
+		return 0, err
+	}
+	s.res.bodySize += int64(len(p))
+	return len(p), nil
+}
+
+// Flush is a no-op, every Write is sent right away.
+func (s *http2ResponseStream) Flush() error {
+	return nil
+}
+
+func (s *http2ResponseStream) Done() <-chan struct{} {
+	return s.st.done
+}
+
+func (s *http2ResponseStream) finish() error {
+	s.n += http2FrameHeaderLen
+	return s.sc.writeFrame(http2FrameData, http2FlagEndStream, s.st.id, nil)
+}
+
+func (s *http2ResponseStream) written() int64 {
+	return s.n
+}
+
+func (sc *http2Conn) writeHeaderBlock(streamID uint32, block []byte, endStream bool) (int64, error) {
+	sc.mu.Lock()
+	maxFrame := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	var buf []byte
+	typ, flags := http2FrameHeaders, uint8(0)
+	if endStream {
+		flags |= http2FlagEndStream
+	}
+	for {
+		chunk := block
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= http2FlagEndHeaders
+		}
+		buf = appendHTTP2Frame(buf, typ, flags, streamID, chunk)
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = http2FrameContinuation, 0
+	}
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	n, err := sc.bw.Write(buf)
+	if err != nil {
+		return int64(n), err
+	}
+	return int64(n), sc.bw.Flush()
+}
+
+// reserveSendWindow blocks until both the connection and the stream windows
+// allow sending data and returns how many bytes (at most want) can be sent.
+func (sc *http2Conn) reserveSendWindow(st *http2Stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for {
+		if sc.closed {
+			return 0, ErrHTTP2ConnClosed
+		}
+		if st.reset {
+			return 0, ErrHTTP2StreamReset
+		}
+		if sc.sendWindow > 0 && st.sendWindow > 0 {
+			break
+		}
+		sc.cond.Wait()
+	}
+
+	n := int64(want)
+	n = min(n, sc.sendWindow, st.sendWindow, int64(sc.peerMaxFrameSize))
+	sc.sendWindow -= n
+	st.sendWindow -= n
+	return int(n), nil
+}
+
+// http2Body is the request body of a stream, filled by the read loop.
+type http2Body struct {
+	sc *http2Conn
+	st *http2Stream
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	err  error
+}
+
+func newHTTP2Body(sc *http2Conn, st *http2Stream) *http2Body {
+	b := &http2Body{sc: sc, st: st}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *http2Body) write(p []byte) {
+	b.mu.Lock()
+	b.buf.Write(p)
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+func (b *http2Body) closeWithError(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+func (b *http2Body) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		err := b.err
+		b.mu.Unlock()
+		return 0, err
+	}
+	n, _ := b.buf.Read(p)
+	open := b.err == nil
+	b.mu.Unlock()
+
+	if open {
+		// Let the client send more of the body.
+		b.sc.mu.Lock()
+		b.st.recvWindow += int64(n)
+		b.sc.mu.Unlock()
+		_ = b.sc.writeWindowUpdate(b.st.id, n)
+	}
+	return n, nil
+}
+
+// isHTTP2Preface reports whether the connection starts with the HTTP/2
+// client preface, i.e. the client uses HTTP/2 with prior knowledge.
+func isHTTP2Preface(br *bufio.Reader) bool {
+	b, err := br.Peek(4)
+	if err != nil || string(b) != http2Preface[:4] {
+		return false
+	}
+	b, err = br.Peek(len(http2Preface))
+	return err == nil && string(b) == http2Preface
+}
+
+// h2cUpgradeSettings returns the decoded HTTP2-Settings of a valid
+// "Upgrade: h2c" request (RFC 7540, section 3.2). The body is read before
+// switching protocols, so requests whose body is not delimited by a
+// Content-Length of at most http2MaxUpgradeBodySize are not upgraded and
+// served over HTTP/1.1 instead.
+func h2cUpgradeSettings(req *HttpRequest) ([]byte, bool) {
+	if req.TLS != nil || !headerHasToken(req.Headers.Get(HeaderUpgrade), http2UpgradeH2C) {
+		return nil, false
+	}
+	if req.Headers.Get(HeaderTransferEncoding) != "" {
+		return nil, false
+	}
+	if cl := req.Headers.Get(HeaderContentLength); cl != "" {
+		if n, err := strconv.Atoi(cl); err != nil || n > http2MaxUpgradeBodySize {
+			return nil, false
+		}
+	}
+	connection := req.Headers.Get(HeaderConnection)
+	if !headerHasToken(connection, "upgrade") || !headerHasToken(connection, "http2-settings") {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Headers.Get(HeaderHTTP2Settings), "="))
+	if err != nil {
+		return nil, false
+	}
+	return settings, true
+}
+
+// upgradeH2C switches an HTTP/1.1 connection to HTTP/2 and serves req as stream 1.
+func (srv *Server) upgradeH2C(conn net.Conn, br *bufio.Reader, connID uint64, req *HttpRequest, settings []byte) {
+	req.Version = http2Version
+	req.Headers.Del(HeaderUpgrade)
+	req.Headers.Del(HeaderConnection)
+	req.Headers.Del(HeaderHTTP2Settings)
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+	if _, err := io.WriteString(conn, resp); err != nil {
+		srv.log.Warn("could not write upgrade response", slog.String("error", err.Error()))
+		return
+	}
+	srv.serveHTTP2(conn, br, connID, req, settings)
+}
+
+// headerHasToken reports whether a comma-separated header value contains token.
+func headerHasToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHpackDecodeRFCExamples(t *testing.T) {
+	// RFC 7541, appendix C.4: requests with Huffman coding sharing one dynamic table.
+	d := newHpackDecoder(hpackDefaultTableSize, 0)
+	testCases := []struct {
+		desc       string
+		block      string
+		wantFields []hpackField
+	}{
+		{
+			desc:  "first request",
+			block: "828684418cf1e3c2e5f23a6ba0ab90f4ff",
+			wantFields: []hpackField{
+				{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+			},
+		},
+		{
+			desc:  "second request",
+			block: "828684be5886a8eb10649cbf",
+			wantFields: []hpackField{
+				{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}, {"cache-control", "no-cache"},
+			},
+		},
+		{
+			desc:  "third request",
+			block: "828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+			wantFields: []hpackField{
+				{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"}, {"custom-key", "custom-value"},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			block, _ := hex.DecodeString(tC.block)
+			fields, err := d.Decode(block)
+			if err != nil {
+				t.Fatalf("could not decode header block: %v", err)
+			}
+			if len(fields) != len(tC.wantFields) {
+				t.Fatalf("invalid number of fields, wanted: %d, got: %d", len(tC.wantFields), len(fields))
+			}
+			for i, f := range tC.wantFields {
+				if fields[i] != f {
+					t.Errorf("invalid field %d, wanted: %v, got: %v", i, f, fields[i])
+				}
+			}
+		})
+	}
+	if d.table.size != 164 {
+		t.Errorf("invalid dynamic table size, wanted: 164, got: %d", d.table.size)
+	}
+}
+
+func TestHpackInteger(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		prefix uint8
+		value  uint64
+		want   []byte
+	}{
+		{desc: "fits in prefix", prefix: 5, value: 10, want: []byte{0x0a}},
+		{desc: "exceeds prefix", prefix: 5, value: 1337, want: []byte{0x1f, 0x9a, 0x0a}},
+		{desc: "starts at octet boundary", prefix: 8, value: 42, want: []byte{0x2a}},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			got := hpackAppendInt(nil, 0, tC.prefix, tC.value)
+			if !bytes.Equal(got, tC.want) {
+				t.Errorf("invalid encoding, wanted: %x, got: %x", tC.want, got)
+			}
+			v, rest, err := hpackReadInt(got, tC.prefix)
+			if err != nil || len(rest) != 0 || v != tC.value {
+				t.Errorf("invalid decoding, wanted: %d, got: %d (rest: %x, err: %v)", tC.value, v, rest, err)
+			}
+		})
+	}
+}
+
+func TestHpackEncoderRoundTrip(t *testing.T) {
+	fields := []hpackField{
+		{":status", "200"},
+		{"content-type", "text/plain"},
+		{"x-request-id", "abc"},
+	}
+	block := hpackEncoder{}.Encode(nil, fields)
+
+	got, err := newHpackDecoder(hpackDefaultTableSize, 0).Decode(block)
+	if err != nil {
+		t.Fatalf("could not decode header block: %v", err)
+	}
+	if len(got) != len(fields) {
+		t.Fatalf("invalid number of fields, wanted: %d, got: %d", len(fields), len(got))
+	}
+	for i := range fields {
+		if got[i] != fields[i] {
+			t.Errorf("invalid field %d, wanted: %v, got: %v", i, fields[i], got[i])
+		}
+	}
+}
+
+// http2TestHandler echoes the target, the protocol and the request body size.
+func http2TestHandler(req *HttpRequest, res *HttpResponse) {
+	n, _ := io.Copy(io.Discard, req.Body)
+	if size := req.Headers.Get("X-Response-Size"); size != "" {
+		length, _ := strconv.Atoi(size)
+		res.Body = strings.NewReader(strings.Repeat("x", length))
+		return
+	}
+	res.WriteStr(fmt.Sprintf("%s %s %d %d", req.Version, req.Target, n, req.ConnID))
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	tc := newTestCert(t, "localhost", []string{"localhost"}, nil, false)
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), http2TestHandler)
+	cfg, err := srv.tlsConfig(tc.certFile, tc.keyFile)
+	if err != nil {
+		t.Fatalf("could not build tls config: %v", err)
+	}
+	addr := serveTestServer(t, srv, func(l net.Listener) net.Listener { return tls.NewListener(l, cfg) })
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+
+	testCases := []struct {
+		desc     string
+		method   string
+		body     string
+		wantBody string
+	}{
+		{desc: "get", method: MethodGet, wantBody: "HTTP/2.0 /echo/abc 0"},
+		{desc: "post with small body", method: MethodPost, body: "hello", wantBody: "HTTP/2.0 /echo/abc 5"},
+		{desc: "post with body larger than the initial window", method: MethodPost, body: strings.Repeat("a", 200_000), wantBody: "HTTP/2.0 /echo/abc 200000"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req, _ := http.NewRequest(tC.method, "https://"+addr+"/echo/abc", strings.NewReader(tC.body))
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer res.Body.Close()
+
+			if res.ProtoMajor != 2 {
+				t.Errorf("wanted HTTP/2 response, got: %s", res.Proto)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if !strings.HasPrefix(string(body), tC.wantBody+" ") {
+				t.Errorf("invalid body, wanted prefix: '%s', got: '%s'", tC.wantBody, body)
+			}
+			if ct := res.Header.Get(HeaderContentType); ct != "text/plain" {
+				t.Errorf("invalid content type, wanted: 'text/plain', got: '%s'", ct)
+			}
+		})
+	}
+
+	t.Run("response larger than the initial window", func(t *testing.T) {
+		req, _ := http.NewRequest(MethodGet, "https://"+addr+"/large", nil)
+		req.Header.Set("X-Response-Size", "300000")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if len(body) != 300000 {
+			t.Errorf("invalid body length, wanted: 300000, got: %d", len(body))
+		}
+	})
+}
+
+func TestHTTP2PriorKnowledgeMultiplexing(t *testing.T) {
+	addr := startTestServer(t, http2TestHandler)
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	defer client.CloseIdleConnections()
+
+	const requests = 20
+	var wg sync.WaitGroup
+	bodies := make([]string, requests)
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(fmt.Sprintf("http://%s/echo/%d", addr, i))
+			if err != nil {
+				t.Errorf("request %d failed: %v", i, err)
+				return
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			bodies[i] = string(body)
+		}()
+	}
+	wg.Wait()
+
+	connIDs := map[string]bool{}
+	for i, body := range bodies {
+		fields := strings.Fields(body)
+		if len(fields) != 4 {
+			t.Fatalf("invalid body of request %d: '%s'", i, body)
+		}
+		if want := fmt.Sprintf("/echo/%d", i); fields[0] != http2Version || fields[1] != want {
+			t.Errorf("invalid body of request %d, wanted: '%s %s', got: '%s'", i, http2Version, want, body)
+		}
+		connIDs[fields[3]] = true
+	}
+	if len(connIDs) != 1 {
+		t.Errorf("wanted every request to share one connection, got: %d connections", len(connIDs))
+	}
+}
+
+func TestHTTP2UpgradeH2C(t *testing.T) {
+	addr := startTestServer(t, http2TestHandler)
+
+	// HTTP2-Settings carries SETTINGS_MAX_CONCURRENT_STREAMS=100 and SETTINGS_ENABLE_PUSH=0.
+	const upgradeHeaders = "Host: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAIAAAAA\r\n"
+
+	testCases := []struct {
+		desc     string
+		request  string
+		wantBody string
+	}{
+		{
+			desc:     "post with body",
+			request:  "POST /echo/up HTTP/1.1\r\nContent-Length: 3\r\n" + upgradeHeaders + "\r\nabc",
+			wantBody: "HTTP/2.0 /echo/up 3 ",
+		},
+		{
+			desc:     "get without content length",
+			request:  "GET /echo/up HTTP/1.1\r\n" + upgradeHeaders + "\r\n",
+			wantBody: "HTTP/2.0 /echo/up 0 ",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("could not dial server: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			br := bufio.NewReader(conn)
+
+			io.WriteString(conn, tC.request)
+			status, _ := br.ReadString('\n')
+			if status != "HTTP/1.1 101 Switching Protocols\r\n" {
+				t.Fatalf("invalid status line, wanted: 'HTTP/1.1 101 Switching Protocols', got: '%s'", status)
+			}
+			for {
+				line, _ := br.ReadString('\n')
+				if line == "\r\n" || line == "" {
+					break
+				}
+			}
+
+			io.WriteString(conn, http2Preface)
+			conn.Write(appendHTTP2Frame(nil, http2FrameSettings, 0, 0, nil))
+
+			decoder := newHpackDecoder(hpackDefaultTableSize, 0)
+			var gotStatus, gotBody string
+			for done := false; !done; {
+				f, err := readHTTP2Frame(br, http2MaxFrameSizeLimit)
+				if err != nil {
+					t.Fatalf("could not read frame: %v", err)
+				}
+				switch f.typ {
+				case http2FrameHeaders:
+					if f.streamID != 1 {
+						t.Fatalf("wanted response on stream 1, got: %d", f.streamID)
+					}
+					fields, err := decoder.Decode(f.payload)
+					if err != nil {
+						t.Fatalf("could not decode headers: %v", err)
+					}
+					gotStatus = fields[0].value
+					done = f.has(http2FlagEndStream)
+				case http2FrameData:
+					gotBody += string(f.payload)
+					done = f.has(http2FlagEndStream)
+				}
+			}
+
+			if gotStatus != "200" {
+				t.Errorf("invalid status, wanted: '200', got: '%s'", gotStatus)
+			}
+			if !strings.HasPrefix(gotBody, tC.wantBody) {
+				t.Errorf("invalid body, wanted prefix: '%s', got: '%s'", tC.wantBody, gotBody)
+			}
+		})
+	}
+
+	t.Run("body over the upgrade limit is served over HTTP/1.1", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("could not dial server: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		size := http2MaxUpgradeBodySize + 1
+		go io.WriteString(conn, fmt.Sprintf("POST /echo/up HTTP/1.1\r\nContent-Length: %d\r\n%s\r\n%s", size, upgradeHeaders, strings.Repeat("a", size)))
+		status, _, body := roundTrip(t, conn, bufio.NewReader(conn), "")
+		if status != "HTTP/1.1 200 OK" {
+			t.Errorf("invalid status line, wanted: 'HTTP/1.1 200 OK', got: '%s'", status)
+		}
+		if want := fmt.Sprintf("HTTP/1.1 /echo/up %d ", size); !strings.HasPrefix(body, want) {
+			t.Errorf("invalid body, wanted prefix: '%s', got: '%s'", want, body)
+		}
+	})
+}
+
+// dialHTTP2 opens a prior knowledge HTTP/2 connection to addr, the preface
+// and an empty SETTINGS frame are already sent.
+func dialHTTP2(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, http2Preface)
+	conn.Write(appendHTTP2Frame(nil, http2FrameSettings, 0, 0, nil))
+	return conn, bufio.NewReader(conn)
+}
+
+// readGoAway reads frames until a GOAWAY and returns its error code, it fails
+// if a frame of stream is still to come.
+func readGoAway(t *testing.T, br *bufio.Reader, streamID uint32) uint32 {
+	t.Helper()
+	streamEnded := streamID == 0
+	for {
+		f, err := readHTTP2Frame(br, http2MaxFrameSizeLimit)
+		if err != nil {
+			t.Fatalf("could not read frame: %v", err)
+		}
+		switch {
+		case f.typ == http2FrameGoAway:
+			if !streamEnded {
+				t.Fatalf("wanted stream %d to end before GOAWAY", streamID)
+			}
+			return binary.BigEndian.Uint32(f.payload[4:])
+		case f.streamID == streamID && f.has(http2FlagEndStream):
+			streamEnded = true
+		}
+	}
+}
+
+func TestHTTP2IdleTimeout(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), func(req *HttpRequest, res *HttpResponse) {
+		time.Sleep(300 * time.Millisecond)
+		res.WriteStr("slow")
+	})
+	srv.IdleTimeout = 100 * time.Millisecond
+	addr := serveTestServer(t, srv, nil)
+
+	testCases := []struct {
+		desc string
+		// streamID is the stream opened right away, none when zero.
+		streamID uint32
+	}{
+		{desc: "without streams"},
+		{desc: "after a stream outlasting the timeout", streamID: 1},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn, br := dialHTTP2(t, addr)
+			if tC.streamID != 0 {
+				block := hpackEncoder{}.Encode(nil, []hpackField{
+					{name: ":method", value: MethodGet},
+					{name: ":scheme", value: "http"},
+					{name: ":path", value: "/slow"},
+					{name: ":authority", value: "localhost"},
+				})
+				conn.Write(appendHTTP2Frame(nil, http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, tC.streamID, block))
+			}
+
+			if code := readGoAway(t, br, tC.streamID); code != uint32(http2ErrNoError) {
+				t.Errorf("invalid GOAWAY code, wanted: 0, got: %d", code)
+			}
+			if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+				t.Errorf("wanted the connection to be closed, got: %v", err)
+			}
+		})
+	}
+}
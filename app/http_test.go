@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"strings"
 	"testing"
@@ -162,11 +163,12 @@ func TestWrite(t *testing.T) {
 		desc      string
 		res       HttpResponse
 		wantValue string
+		wantErr   error
 	}{
 		{
-			desc:      "write empty response",
-			res:       HttpResponse{},
-			wantValue: " 0 \r\n\r\n",
+			desc:    "write empty response",
+			res:     HttpResponse{},
+			wantErr: ErrInvalidStatusCode,
 		},
 		{
 			desc: "write unsupported status code",
@@ -174,7 +176,24 @@ func TestWrite(t *testing.T) {
 				Version: "HTTP/1.1",
 				Status:  1234567890,
 			},
-			wantValue: "HTTP/1.1 1234567890 \r\n\r\n",
+			wantErr: ErrInvalidStatusCode,
+		},
+		{
+			desc: "write unregistered status code",
+			res: HttpResponse{
+				Version: "HTTP/1.1",
+				Status:  599,
+			},
+			wantValue: "HTTP/1.1 599 \r\n\r\n",
+		},
+		{
+			desc: "write custom reason phrase",
+			res: HttpResponse{
+				Version: "HTTP/1.1",
+				Status:  200,
+				Reason:  "Fine\r\nX-Injected: 1",
+			},
+			wantValue: "HTTP/1.1 200 FineX-Injected: 1\r\n\r\n",
 		},
 		{
 			desc: "write full response",
@@ -194,11 +213,47 @@ func TestWrite(t *testing.T) {
 			},
 			wantValue: "HTTP/1.1 200 OK\r\n\r\n",
 		},
+		{
+			desc: "write head response",
+			res: HttpResponse{
+				Version: "HTTP/1.1",
+				Status:  200,
+				Headers: map[string]string{},
+				Body:    strings.NewReader("Hello, World!"),
+				method:  MethodHead,
+			},
+			wantValue: "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\n",
+		},
+		{
+			desc: "write no content response",
+			res: HttpResponse{
+				Version: "HTTP/1.1",
+				Status:  204,
+				Headers: map[string]string{"Content-Length": "5"},
+				Body:    strings.NewReader("Hello"),
+			},
+			wantValue: "HTTP/1.1 204 No Content\r\n\r\n",
+		},
+		{
+			desc: "write not modified response",
+			res: HttpResponse{
+				Version: "HTTP/1.1",
+				Status:  304,
+				Headers: map[string]string{},
+			},
+			wantValue: "HTTP/1.1 304 Not Modified\r\n\r\n",
+		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
 			var sb strings.Builder
 			_, err := Write(&sb, &tC.res)
+			if tC.wantErr != nil {
+				if !errors.Is(err, tC.wantErr) {
+					t.Fatalf("invalid error, wanted: '%v', got: '%v'", tC.wantErr, err)
+				}
+				return
+			}
 			if err != nil {
 				t.Fatalf("wanted no errors but write(HttpResponse) returned error: %v", err)
 			}
@@ -272,3 +327,31 @@ func TestNewCleanResponse(t *testing.T) {
 		t.Errorf("wanted Body to be nil but got non-nil value")
 	}
 }
+
+func TestResponseError(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		code     int
+		msg      string
+		wantBody string
+	}{
+		{desc: "without message", code: StatusTooManyRequests, wantBody: "429 Too Many Requests\n"},
+		{desc: "with message", code: StatusNotFound, msg: "no such file", wantBody: "404 Not Found: no such file\n"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res := newCleanResponse()
+			res.Error(tC.code, tC.msg)
+
+			if res.Status != tC.code {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.code, res.Status)
+			}
+			if body := readerToString(t, res.Body); body != tC.wantBody {
+				t.Errorf("invalid body, wanted: '%s', got: '%s'", tC.wantBody, body)
+			}
+			if ct := res.Headers[HeaderContentType]; ct != "text/plain" {
+				t.Errorf("invalid content type, wanted: 'text/plain', got: '%s'", ct)
+			}
+		})
+	}
+}
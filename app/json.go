@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+)
+
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeProblemJSON = "application/problem+json"
+
+	// maxJSONBodySize is the limit used by DecodeJSON.
+	maxJSONBodySize = 1 << 20
+)
+
+var (
+	ErrNotJSON          = errors.New("http: request body is not JSON")
+	ErrJSONTooLarge     = errors.New("http: JSON body too large")
+	ErrJSONTrailingData = errors.New("http: JSON body has data after the value")
+)
+
+// DecodeJSON decodes a JSON body of at most 1 MiB into v, see DecodeJSONLimit.
+func (r *HttpRequest) DecodeJSON(v any) error {
+	return r.DecodeJSONLimit(v, maxJSONBodySize)
+}
+
+// DecodeJSONLimit decodes a JSON body of at most maxSize bytes into v.
+// Fields unknown to v and anything after the JSON value are rejected, as
+// are bodies declaring a content type other than JSON.
+func (r *HttpRequest) DecodeJSONLimit(v any, maxSize int64) error {
+	if ct := r.Headers.Get(HeaderContentType); ct != "" && !isJSONMediaType(ct) {
+		return ErrNotJSON
+	}
+	if r.Body == nil {
+		return io.EOF
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxSize {
+		return ErrJSONTooLarge
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return ErrJSONTrailingData
+	}
+	return nil
+}
+
+// isJSONMediaType reports whether contentType is application/json or a
+// +json structured syntax type.
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == ContentTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// JSON sets status and a JSON encoded v as the response body.
+func (r *HttpResponse) JSON(status int, v any) error {
+	return r.writeJSON(status, ContentTypeJSON, v)
+}
+
+func (r *HttpResponse) writeJSON(status int, contentType string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.Status = status
+	r.Body = bytes.NewReader(append(body, '\n'))
+	if r.Headers == nil {
+		r.Headers = HttpHeaders{}
+	}
+	r.Headers[HeaderContentType] = contentType
+	return nil
+}
+
+// Problem is an RFC 9457 problem details object.
+type Problem struct {
+	// Type is a URI identifying the problem type, "about:blank" when empty.
+	Type     string `json:"type,omitempty"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// RequestID is an extension member matching the X-Request-ID header.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Problem sends p as an application/problem+json response, the title
+// defaults to the reason phrase of the status.
+func (r *HttpResponse) Problem(p Problem) error {
+	if p.Title == "" {
+		p.Title = statusString(p.Status)
+	}
+	return r.writeJSON(p.Status, ContentTypeProblemJSON, p)
+}
+
+// ErrorFor responds with a problem+json error when req accepts JSON and falls
+// back to Error otherwise.
+func (r *HttpResponse) ErrorFor(req *HttpRequest, code int, msg string) *HttpResponse {
+	if !acceptsJSON(req) {
+		return r.Error(code, msg)
+	}
+	if err := r.Problem(Problem{Status: code, Detail: msg, Instance: req.Path(), RequestID: req.ID}); err != nil {
+		return r.Error(code, msg)
+	}
+	return r
+}
+
+// acceptsJSON reports whether the client prefers JSON or problem+json over plain text.
+func acceptsJSON(req *HttpRequest) bool {
+	switch req.NegotiateContentType("text/plain", ContentTypeProblemJSON, ContentTypeJSON) {
+	case ContentTypeProblemJSON, ContentTypeJSON:
+		return true
+	default:
+		return false
+	}
+}
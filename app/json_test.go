@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	type payload struct {
+		Name string `json:"name"`
+	}
+	testCases := []struct {
+		desc        string
+		contentType string
+		body        string
+		limit       int64
+		wantName    string
+		wantErr     error
+	}{
+		{desc: "valid body", contentType: "application/json; charset=utf-8", body: `{"name":"a"}`, wantName: "a"},
+		{desc: "structured syntax suffix", contentType: "application/merge-patch+json", body: `{"name":"b"}`, wantName: "b"},
+		{desc: "other content type", contentType: "text/plain", body: `{"name":"a"}`, wantErr: ErrNotJSON},
+		{desc: "too large", body: `{"name":"abcdefgh"}`, limit: 10, wantErr: ErrJSONTooLarge},
+		{desc: "trailing data", body: `{"name":"a"} {}`, wantName: "a", wantErr: ErrJSONTrailingData},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Headers: HttpHeaders{}, Body: strings.NewReader(tC.body)}
+			if tC.contentType != "" {
+				req.Headers[HeaderContentType] = tC.contentType
+			}
+			if tC.limit == 0 {
+				tC.limit = maxJSONBodySize
+			}
+
+			var p payload
+			err := req.DecodeJSONLimit(&p, tC.limit)
+			if !errors.Is(err, tC.wantErr) {
+				t.Fatalf("invalid error, wanted: '%v', got: '%v'", tC.wantErr, err)
+			}
+			if p.Name != tC.wantName {
+				t.Errorf("invalid name, wanted: '%s', got: '%s'", tC.wantName, p.Name)
+			}
+		})
+	}
+
+	t.Run("unknown field", func(t *testing.T) {
+		req := &HttpRequest{Headers: HttpHeaders{}, Body: strings.NewReader(`{"name":"a","admin":true}`)}
+		var p payload
+		if err := req.DecodeJSON(&p); err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("wanted unknown field error, got: %v", err)
+		}
+	})
+}
+
+func TestResponseJSON(t *testing.T) {
+	res := newCleanResponse()
+	if err := res.JSON(StatusCreated, map[string]int{"id": 7}); err != nil {
+		t.Fatalf("could not write json: %v", err)
+	}
+	if res.Status != StatusCreated {
+		t.Errorf("invalid status, wanted: %d, got: %d", StatusCreated, res.Status)
+	}
+	if ct := res.Headers[HeaderContentType]; ct != ContentTypeJSON {
+		t.Errorf("invalid content type, wanted: '%s', got: '%s'", ContentTypeJSON, ct)
+	}
+	if body := readerToString(t, res.Body); body != "{\"id\":7}\n" {
+		t.Errorf("invalid body, wanted: '{\"id\":7}', got: '%s'", body)
+	}
+}
+
+func TestErrorFor(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		accept          string
+		wantContentType string
+	}{
+		{desc: "json client", accept: "application/json", wantContentType: ContentTypeProblemJSON},
+		{desc: "problem client", accept: "text/html, application/problem+json;q=0.9", wantContentType: ContentTypeProblemJSON},
+		{desc: "plain client", accept: "*/*", wantContentType: "text/plain"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Target: "/files/x?y=1", ID: "req-1", Headers: HttpHeaders{HeaderAccept: tC.accept}}
+			res := newCleanResponse()
+			res.ErrorFor(req, StatusNotFound, "no such file")
+
+			if res.Status != StatusNotFound {
+				t.Errorf("invalid status, wanted: %d, got: %d", StatusNotFound, res.Status)
+			}
+			if ct := res.Headers[HeaderContentType]; ct != tC.wantContentType {
+				t.Fatalf("invalid content type, wanted: '%s', got: '%s'", tC.wantContentType, ct)
+			}
+			if tC.wantContentType != ContentTypeProblemJSON {
+				return
+			}
+
+			var p Problem
+			if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+				t.Fatalf("could not decode problem: %v", err)
+			}
+			want := Problem{Title: "Not Found", Status: StatusNotFound, Detail: "no such file", Instance: "/files/x", RequestID: "req-1"}
+			if p != want {
+				t.Errorf("invalid problem, wanted: %+v, got: %+v", want, p)
+			}
+		})
+	}
+}
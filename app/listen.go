@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// unixAddrPrefix marks listen addresses naming a Unix domain socket.
+const unixAddrPrefix = "unix:"
+
+// DefaultUnixSocketMode lets the owner and group of a socket connect to it.
+const DefaultUnixSocketMode os.FileMode = 0o660
+
+var ErrNoListeners = errors.New("http: no listeners to serve")
+
+// Listen opens a listener on addr, either a TCP address such as
+// "0.0.0.0:4221" or "[::]:4221", or "unix:" followed by the path of a Unix
+// domain socket created with mode.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixAddrPrefix); ok {
+		return listenUnix(path, mode)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix replaces a socket file left behind by a previous run, but not
+// one a running server still accepts on.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: socket in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve accepts connections on l until it fails permanently or is closed,
+// see Close. Serve may run on several listeners at once.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.listeners == nil {
+		srv.listeners = map[net.Listener]struct{}{}
+	}
+	srv.listeners[l] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+	}()
+	return srv.serve(l)
+}
+
+// ServeTLS serves HTTPS on l, see StartTLS for certFile and keyFile.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	cfg, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(tls.NewListener(l, cfg))
+}
+
+// ServeAll serves every listener, once one of them stops the others are
+// closed and its error is returned.
+func (srv *Server) ServeAll(listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return ErrNoListeners
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() { errs <- srv.Serve(l) }()
+	}
+	err := <-errs
+	for _, l := range listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			srv.log.Warn("could not close listener", slog.String("error", err.Error()))
+		}
+	}
+	for range len(listeners) - 1 {
+		<-errs
+	}
+	return err
+}
+
+// Close closes the listeners of srv, ending Serve and Start, and stops the
+// certificate reloads of StartTLS and ServeTLS. Open connections are left to
+// finish.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, f := range srv.closers {
+		f()
+	}
+	srv.closers = nil
+	var errs []error
+	for l := range srv.listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// onClose registers f to be run by Close.
+func (srv *Server) onClose(f func()) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closers = append(srv.closers, f)
+}
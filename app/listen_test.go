@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// socketPath returns a path short enough for a Unix socket, t.TempDir may
+// exceed the limit.
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "http.sock")
+}
+
+func TestServeAll(t *testing.T) {
+	path := socketPath(t)
+	addrs := []string{"127.0.0.1:0", unixAddrPrefix + path}
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		l.Close()
+		addrs = append(addrs, "[::1]:0")
+	}
+
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := Listen(addr, 0o600)
+		if err != nil {
+			t.Fatalf("could not listen on %s: %v", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("invalid socket permissions, wanted: 0600, got: %v (err: %v)", fi.Mode().Perm(), err)
+	}
+
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	done := make(chan error)
+	go func() { done <- srv.ServeAll(listeners...) }()
+
+	for _, l := range listeners {
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			t.Fatalf("could not dial %s: %v", l.Addr(), err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		status, _, _ := roundTrip(t, conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+		if status != "HTTP/1.1 200 OK" {
+			t.Errorf("invalid status on %s, wanted: '200 OK', got: '%s'", l.Addr(), status)
+		}
+		conn.Close()
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Errorf("could not close server: %v", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("invalid error, wanted: '%v', got: '%v'", net.ErrClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeAll did not return after Close")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("wanted the socket to be removed, got: %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := socketPath(t)
+
+	// A socket left behind by a crashed server is replaced.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen(unixAddrPrefix+path, DefaultUnixSocketMode)
+	if err != nil {
+		t.Fatalf("wanted the stale socket to be replaced, got: %v", err)
+	}
+	defer l.Close()
+
+	// One still accepting connections is not.
+	if _, err := Listen(unixAddrPrefix+path, DefaultUnixSocketMode); err == nil {
+		t.Error("wanted an error listening on a socket in use")
+	}
+}
+
+func TestServeAllWithoutListeners(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	if err := srv.ServeAll(); !errors.Is(err, ErrNoListeners) {
+		t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrNoListeners, err)
+	}
+}
@@ -1,69 +1,459 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Config struct {
-	FileDir string
+	FileDir           string
+	AccessLogPath     string
+	AccessLogFormat   string
+	TLSCertFiles      stringsFlag
+	TLSKeyFiles       stringsFlag
+	TLSClientCAFile   string
+	HTTPSRedirectAddr string
+	KeepAliveTimeout  time.Duration
+	MaxConnRequests   int
+	ServerName        string
+	CORSOrigins       stringsFlag
+	HtpasswdFile      string
+	TokensFile        string
+	DigestUsersFile   string
+	AuthRead          bool
+	URLSigningKeys    stringsFlag
+	RateLimits        stringsFlag
+	TrustedProxies    stringsFlag
+	MaxConnections    int
+	MaxConnsPerIP     int
+	MaxConcurrentReqs int
+	RequestQueueWait  time.Duration
+	Listen            stringsFlag
+	UnixSocketMode    string
 }
 
 func (c Config) Debug() string {
-	return fmt.Sprintf("cfg{FileDir: %s,}", c.FileDir)
+	return fmt.Sprintf("cfg{FileDir: %s, AccessLogPath: %s, AccessLogFormat: %s, TLSCertFiles: %s, TLSClientCAFile: %s, HTTPSRedirectAddr: %s, KeepAliveTimeout: %s, MaxConnRequests: %d, ServerName: %s, CORSOrigins: %s, HtpasswdFile: %s, TokensFile: %s, DigestUsersFile: %s, AuthRead: %t, URLSigningKeys: %d, RateLimits: %s, TrustedProxies: %s, MaxConnections: %d, MaxConnsPerIP: %d, MaxConcurrentReqs: %d, RequestQueueWait: %s, Listen: %s, UnixSocketMode: %s,}",
+		c.FileDir, c.AccessLogPath, c.AccessLogFormat, c.TLSCertFiles.String(), c.TLSClientCAFile, c.HTTPSRedirectAddr, c.KeepAliveTimeout, c.MaxConnRequests, c.ServerName, c.CORSOrigins.String(), c.HtpasswdFile, c.TokensFile, c.DigestUsersFile, c.AuthRead, len(c.URLSigningKeys), c.RateLimits.String(), c.TrustedProxies.String(), c.MaxConnections, c.MaxConnsPerIP, c.MaxConcurrentReqs, c.RequestQueueWait, c.Listen.String(), c.UnixSocketMode)
+}
+
+// stringsFlag is a flag.Value that can be repeated on the command line.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
 }
 
 func parseConfig() Config {
 	var cfg Config
 	flag.StringVar(&cfg.FileDir, "directory", "", "Directory where the files are stored (as an absolute path)")
+	flag.StringVar(&cfg.AccessLogPath, "access-log", "", "Access log file path, '-' for stdout (disabled when empty)")
+	flag.StringVar(&cfg.AccessLogFormat, "access-log-format", string(AccessLogCombined), "Access log format: common, combined or json")
+	flag.Var(&cfg.TLSCertFiles, "tls-cert", "TLS certificate file, can be repeated (paired with --tls-key by position)")
+	flag.Var(&cfg.TLSKeyFiles, "tls-key", "TLS private key file, can be repeated (paired with --tls-cert by position)")
+	flag.StringVar(&cfg.TLSClientCAFile, "tls-client-ca", "", "CA bundle used to require and verify client certificates")
+	flag.StringVar(&cfg.HTTPSRedirectAddr, "https-redirect-addr", "", "Address of a plain HTTP listener redirecting to HTTPS (e.g. 0.0.0.0:8080)")
+	flag.DurationVar(&cfg.KeepAliveTimeout, "keep-alive-timeout", 60*time.Second, "How long an idle keep-alive connection waits for the next request (0 disables the limit)")
+	flag.IntVar(&cfg.MaxConnRequests, "max-conn-requests", 0, "Maximum number of requests served on one connection (0 disables the limit)")
+	flag.StringVar(&cfg.ServerName, "server-name", "http-server-go", "Value of the Server response header (omitted when empty)")
+	flag.Var(&cfg.CORSOrigins, "cors-origin", "Origin allowed to make cross-origin requests, can be repeated ('*' allows any origin)")
+	flag.StringVar(&cfg.HtpasswdFile, "htpasswd", "", "htpasswd-style file of users allowed to write files with Basic auth (bcrypt or {SHA256} hashes)")
+	flag.StringVar(&cfg.TokensFile, "tokens", "", "File of 'name:token' lines allowed to write files with Bearer auth")
+	flag.StringVar(&cfg.DigestUsersFile, "digest-users", "", "File of 'user:password' lines allowed to write files with Digest auth, instead of --htpasswd and --tokens")
+	flag.BoolVar(&cfg.AuthRead, "auth-read", false, "Also require authentication to read files (needs --htpasswd, --tokens or --digest-users)")
+	flag.Var(&cfg.URLSigningKeys, "url-signing-key", "Key signing file URLs minted by POST /signed-urls, can be repeated (the first one signs)")
+	flag.Var(&cfg.RateLimits, "rate-limit", "Per client rate limit of the routes under a prefix as prefix=requests/duration (e.g. /files/=100/1m), can be repeated")
+	flag.Var(&cfg.TrustedProxies, "trusted-proxy", "CIDR of a proxy whose X-Forwarded-For header identifies clients for rate limiting, can be repeated")
+	flag.IntVar(&cfg.MaxConnections, "max-connections", 0, "Maximum number of open connections, idle keep-alive ones are closed first (0 disables the limit)")
+	flag.IntVar(&cfg.MaxConnsPerIP, "max-connections-per-ip", 0, "Maximum number of open connections per client IP (0 disables the limit)")
+	flag.IntVar(&cfg.MaxConcurrentReqs, "max-concurrent-requests", 0, "Maximum number of requests handled at once (0 disables the limit)")
+	flag.DurationVar(&cfg.RequestQueueWait, "request-queue-timeout", time.Second, "How long a request waits for one of --max-concurrent-requests before getting 503")
+	flag.Var(&cfg.Listen, "listen", "Address to listen on, host:port or unix:/path/to/socket, can be repeated (default 0.0.0.0:4221)")
+	flag.StringVar(&cfg.UnixSocketMode, "unix-socket-mode", "0660", "Permissions of the Unix sockets given to --listen, in octal")
 	flag.Parse()
+	if len(cfg.Listen) == 0 {
+		cfg.Listen = stringsFlag{defaultListenAddr}
+	}
 	return cfg
 }
 
 type app struct {
 	cfg Config
 	log *slog.Logger
+	// auth protects the files API, nil when no credentials are configured.
+	auth authScheme
+	// signer mints and checks signed file URLs, nil without signing keys.
+	signer *URLSigner
+	// rateLimits are sorted by decreasing prefix length.
+	rateLimits []routeRateLimit
+
+	handlerOnce sync.Once
+	handler     Handler
 }
 
 func main() {
 	logger := slog.Default()
-	port := 4221
 
 	cfg := parseConfig()
 	logger.Info("parsed config", slog.String("cfg", cfg.Debug()))
 
-	addr := fmt.Sprintf("0.0.0.0:%d", port)
-
 	app := app{
 		cfg: cfg,
 		log: logger,
 	}
+	auth, err := newAuthenticator(cfg)
+	if err != nil {
+		logger.Error("failed to load credentials", slog.String("err", err.Error()))
+		return
+	}
+	app.auth = auth
+	if len(cfg.URLSigningKeys) > 0 {
+		keys := make([][]byte, len(cfg.URLSigningKeys))
+		for i, k := range cfg.URLSigningKeys {
+			keys[i] = []byte(k)
+		}
+		if app.signer, err = NewURLSigner(keys); err != nil {
+			logger.Error("failed to create URL signer", slog.String("err", err.Error()))
+			return
+		}
+		app.signer.MaxTTL = maxSignedURLTTL
+	}
+	if app.rateLimits, err = newRateLimits(cfg); err != nil {
+		logger.Error("invalid rate limits", slog.String("err", err.Error()))
+		return
+	}
 
-	server, err := NewServerFromConfig(addr, logger, app.Handle)
+	server, err := NewServerFromConfig(cfg.Listen[0], logger, app.Handle)
 	if err != nil {
 		logger.Error("failed to create HTTP server", slog.String("err", err.Error()))
 		return
 	}
+	server.IdleTimeout = cfg.KeepAliveTimeout
+	server.MaxRequestsPerConn = cfg.MaxConnRequests
+	server.Name = cfg.ServerName
+	server.MaxConnections = cfg.MaxConnections
+	server.MaxConnectionsPerIP = cfg.MaxConnsPerIP
+	server.MaxConcurrentRequests = cfg.MaxConcurrentReqs
+	server.RequestQueueTimeout = cfg.RequestQueueWait
+
+	if cfg.AccessLogPath != "" {
+		format, err := ParseAccessLogFormat(cfg.AccessLogFormat)
+		if err != nil {
+			logger.Error("invalid access log format", slog.String("err", err.Error()))
+			return
+		}
+		accessLog, err := NewAccessLogger(cfg.AccessLogPath, format, logger)
+		if err != nil {
+			logger.Error("failed to open access log", slog.String("err", err.Error()))
+			return
+		}
+		defer accessLog.Close()
+		accessLog.ReopenOnSignal(syscall.SIGHUP)
+		server.AccessLog = accessLog
+	}
+
+	listeners, err := listenAll(cfg)
+	if err != nil {
+		logger.Error("could not listen", slog.String("err", err.Error()))
+		return
+	}
 
-	logger.Info("starting server", slog.String("address", addr))
-	if err := server.Start(); err != nil {
+	if len(cfg.TLSCertFiles) > 0 {
+		if err := startTLS(server, cfg, listeners, logger); err != nil {
+			logger.Error("could not start HTTPS server", slog.String("err", err.Error()))
+		}
+		return
+	}
+
+	logger.Info("starting server", slog.String("addresses", cfg.Listen.String()))
+	if err := server.ServeAll(listeners...); err != nil {
 		logger.Error("could not start HTTP server", slog.String("err", err.Error()))
 		return
 	}
 }
 
+const defaultListenAddr = "0.0.0.0:4221"
+
+// listenAll opens the --listen addresses, closing those already open when
+// one fails.
+func listenAll(cfg Config) ([]net.Listener, error) {
+	mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --unix-socket-mode %q: %w", cfg.UnixSocketMode, err)
+	}
+
+	var listeners []net.Listener
+	for _, addr := range cfg.Listen {
+		l, err := Listen(addr, os.FileMode(mode))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// httpsPort returns the port of the first TCP listener, the one plain HTTP
+// requests are redirected to.
+func httpsPort(listeners []net.Listener) string {
+	for _, l := range listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			return strconv.Itoa(addr.Port)
+		}
+	}
+	return "443"
+}
+
+func startTLS(server *Server, cfg Config, listeners []net.Listener, logger *slog.Logger) error {
+	if len(cfg.TLSCertFiles) != len(cfg.TLSKeyFiles) {
+		return fmt.Errorf("got %d --tls-cert and %d --tls-key flags", len(cfg.TLSCertFiles), len(cfg.TLSKeyFiles))
+	}
+
+	store := NewCertStore(logger)
+	for i := range cfg.TLSCertFiles {
+		if err := store.Add(cfg.TLSCertFiles[i], cfg.TLSKeyFiles[i]); err != nil {
+			return err
+		}
+	}
+	defer store.Watch(certReloadInterval)()
+
+	server.TLSConfig = &tls.Config{GetCertificate: store.GetCertificate}
+	if cfg.TLSClientCAFile != "" {
+		pool, err := ClientCertPool(cfg.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if cfg.HTTPSRedirectAddr != "" {
+		redirect, err := NewServerFromConfig(cfg.HTTPSRedirectAddr, logger, HTTPSRedirectHandler(httpsPort(listeners)))
+		if err != nil {
+			return err
+		}
+		redirect.Name = server.Name
+		go func() {
+			logger.Info("starting HTTPS redirect server", slog.String("address", cfg.HTTPSRedirectAddr))
+			if err := redirect.Start(); err != nil {
+				logger.Error("could not start HTTPS redirect server", slog.String("err", err.Error()))
+			}
+		}()
+	}
+
+	tlsConfig, err := server.tlsConfig("", "")
+	if err != nil {
+		return err
+	}
+	for i, l := range listeners {
+		listeners[i] = tls.NewListener(l, tlsConfig)
+	}
+	logger.Info("starting HTTPS server", slog.String("addresses", cfg.Listen.String()))
+	return server.ServeAll(listeners...)
+}
+
 func (a *app) Handle(req *HttpRequest, res *HttpResponse) {
-	if req.Target == "/" {
-		a.rootHandler(res, req)
-	} else if strings.HasPrefix(req.Target, "/echo/") {
-		a.echoHandler(res, req)
-	} else if strings.HasPrefix(req.Target, "/user-agent") {
-		a.userAgentHandler(res, req)
-	} else if strings.HasPrefix(req.Target, "/files/") {
-		a.filesHandler(res, req)
-	} else {
-		a.notFoundHandler(res, req)
+	a.handlerOnce.Do(func() {
+		a.handler = a.routes().Serve
+		if len(a.cfg.CORSOrigins) > 0 {
+			a.handler = CORS(CORSOptions{
+				AllowedOrigins: a.cfg.CORSOrigins,
+				AllowedHeaders: []string{HeaderContentType, HeaderRequestID, HeaderAuthorization},
+				ExposedHeaders: []string{HeaderRequestID, HeaderRetryAfter, HeaderRateLimitLimit, HeaderRateLimitRemaining, HeaderRateLimitReset},
+				MaxAge:         10 * time.Minute,
+			})(a.handler)
+		}
+	})
+	a.handler(req, res)
+}
+
+func (a *app) routes() *Router {
+	ws := WebSocketHandler{Handle: a.webSocketEchoHandler, EnableCompression: true}
+
+	// Rate limits apply after authentication, so authenticated clients are
+	// limited per user, and to the failed attempts of a client IP before it.
+	limit, limitFailures := a.rateLimit, a.limitAuthFailures
+	r := NewRouter()
+	r.NotFound = limit(appHandler(a.notFoundHandler))
+	r.Handle(MethodGet, "/", limit(appHandler(a.rootHandler)))
+	r.Handle(MethodGet, "/ws/echo", limit(ws.Serve))
+	r.HandlePrefix(MethodGet, "/echo/", limit(appHandler(a.echoHandler)))
+	r.HandlePrefix(MethodGet, "/user-agent", limit(appHandler(a.userAgentHandler)))
+	r.HandlePrefix(MethodGet, "/files/", limitFailures(a.protectFiles(limit(appHandler(a.readFileHandler)))))
+	r.HandlePrefix(MethodPost, "/files/", limitFailures(a.protectFiles(limit(appHandler(a.createFileHandler)))))
+	// Minting URLs needs credentials, it is disabled without them.
+	if a.signer != nil && a.auth != nil {
+		r.Handle(MethodPost, "/signed-urls", limitFailures(a.auth.Require()(limit(appHandler(a.signURLHandler)))))
+	}
+	return r
+}
+
+// newAuthenticator loads the credentials files of cfg, it returns nil when
+// none are configured.
+func newAuthenticator(cfg Config) (authScheme, error) {
+	if cfg.DigestUsersFile != "" {
+		if cfg.HtpasswdFile != "" || cfg.TokensFile != "" {
+			return nil, errors.New("--digest-users cannot be combined with --htpasswd or --tokens")
+		}
+		passwords, err := LoadDigestUsers(cfg.DigestUsersFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewDigestAuthenticator("files", passwords), nil
+	}
+	if cfg.HtpasswdFile == "" && cfg.TokensFile == "" {
+		return nil, nil
+	}
+	auth := &Authenticator{Realm: "files"}
+	if cfg.HtpasswdFile != "" {
+		users, err := LoadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.Users = users
+	}
+	if cfg.TokensFile != "" {
+		tokens, err := LoadTokens(cfg.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.Tokens = tokens
+	}
+	return auth, nil
+}
+
+// protectFiles lets anyone read files and requires credentials for the other
+// methods, or for all of them with --auth-read. A signed URL stands in for
+// the credentials, a tampered or expired one is rejected with 403.
+func (a *app) protectFiles(h Handler) Handler {
+	protected := h
+	if a.auth != nil {
+		policy := AuthPolicy{Public: []string{MethodGet}}
+		if a.cfg.AuthRead {
+			policy.Public = nil
+		}
+		protected = a.auth.Protect(policy, h)
+	}
+	if a.signer == nil {
+		return protected
+	}
+	return func(req *HttpRequest, res *HttpResponse) {
+		err := a.signer.Verify(req)
+		switch {
+		case errors.Is(err, ErrNoURLSignature):
+			protected(req, res)
+		case err != nil:
+			a.fileError(res, req, StatusForbidden, "")
+		default:
+			h(req, res)
+		}
+	}
+}
+
+// appHandler adapts the app handlers, which take the response first.
+func appHandler(h func(*HttpResponse, *HttpRequest)) Handler {
+	return func(req *HttpRequest, res *HttpResponse) {
+		h(res, req)
+	}
+}
+
+type routeRateLimit struct {
+	prefix  string
+	limiter *RateLimiter
+	// failures limits the requests failing authentication by client IP.
+	failures *RateLimiter
+}
+
+// newRateLimits parses the --rate-limit flags, the clients being identified
+// by user once authenticated and otherwise by IP as resolved through the
+// --trusted-proxy flags. Failed authentications count against the IP.
+func newRateLimits(cfg Config) ([]routeRateLimit, error) {
+	var proxies []netip.Prefix
+	for _, p := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, prefix)
+	}
+
+	var limits []routeRateLimit
+	for _, v := range cfg.RateLimits {
+		prefix, rate, ok := strings.Cut(v, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid rate limit %q, expected prefix=requests/duration", v)
+		}
+		limit, period, err := ParseRateLimit(rate)
+		if err != nil {
+			return nil, err
+		}
+		limiter := NewRateLimiter(limit, period)
+		limiter.Key = UserKey(ClientIPKey(proxies...))
+		failures := NewRateLimiter(limit, period)
+		failures.Key = ClientIPKey(proxies...)
+		limits = append(limits, routeRateLimit{prefix: prefix, limiter: limiter, failures: failures})
+	}
+	slices.SortStableFunc(limits, func(a, b routeRateLimit) int { return len(b.prefix) - len(a.prefix) })
+	return limits, nil
+}
+
+// rateLimit applies the limiter of the longest prefix matching the request.
+func (a *app) rateLimit(next Handler) Handler {
+	return a.limitByPrefix(next, func(rl routeRateLimit) Handler {
+		return rl.limiter.Wrap(next)
+	})
+}
+
+// limitAuthFailures applies the limit of the longest prefix matching the
+// request to the client IPs failing to authenticate in next.
+func (a *app) limitAuthFailures(next Handler) Handler {
+	return a.limitByPrefix(next, func(rl routeRateLimit) Handler {
+		return rl.failures.WrapFailures(next, func(res *HttpResponse) bool {
+			return res.Status == StatusUnauthorized || res.Status == StatusForbidden
+		})
+	})
+}
+
+// limitByPrefix serves requests through the handler wrap builds for the
+// longest rate limit prefix matching them, and through next otherwise.
+func (a *app) limitByPrefix(next Handler, wrap func(routeRateLimit) Handler) Handler {
+	if len(a.rateLimits) == 0 {
+		return next
+	}
+	limited := make([]Handler, len(a.rateLimits))
+	for i, rl := range a.rateLimits {
+		limited[i] = wrap(rl)
+	}
+	return func(req *HttpRequest, res *HttpResponse) {
+		for i, rl := range a.rateLimits {
+			if strings.HasPrefix(req.Path(), rl.prefix) {
+				limited[i](req, res)
+				return
+			}
+		}
+		next(req, res)
 	}
 }
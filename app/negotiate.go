@@ -0,0 +1,202 @@
+package main
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+const (
+	HeaderAcceptLanguage = "Accept-Language"
+	HeaderAcceptCharset  = "Accept-Charset"
+	HeaderVary           = "Vary"
+)
+
+// acceptRange is one entry of an Accept, Accept-Language or Accept-Charset header.
+type acceptRange struct {
+	value  string
+	params map[string]string
+	q      float64
+}
+
+// parseAccept splits an Accept-style header into its ranges, entries with an
+// invalid weight are ignored.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, item := range strings.Split(header, ",") {
+		value, rawParams, _ := strings.Cut(item, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+
+		r := acceptRange{value: value, q: 1}
+		valid := true
+		for _, p := range strings.Split(rawParams, ";") {
+			k, v, ok := strings.Cut(p, "=")
+			if !ok {
+				continue
+			}
+			k = strings.ToLower(strings.TrimSpace(k))
+			v = strings.Trim(strings.TrimSpace(v), `"`)
+			if k == "q" {
+				q, err := strconv.ParseFloat(v, 64)
+				if err != nil || q < 0 || q > 1 {
+					valid = false
+				}
+				r.q = q
+				// Parameters after the weight are accept extensions.
+				break
+			}
+			if r.params == nil {
+				r.params = map[string]string{}
+			}
+			r.params[k] = v
+		}
+		if valid {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// negotiate returns the offer with the highest weight, ties going to the
+// earlier offer. match returns the specificity of a range for an offer, or
+// -1 when it does not match; the most specific range decides the weight.
+func negotiate(header string, offers []string, match func(r acceptRange, offer string) int) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+
+	ranges := parseAccept(header)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		specificity, q := -1, 0.0
+		for _, r := range ranges {
+			if s := match(r, offer); s > specificity {
+				specificity, q = s, r.q
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// NegotiateContentType returns the offered media type preferred by the Accept
+// header, or "" when none is acceptable. Offers are in server preference order.
+func (r *HttpRequest) NegotiateContentType(offers ...string) string {
+	return negotiate(r.Headers.Get(HeaderAccept), offers, matchMediaRange)
+}
+
+func matchMediaRange(r acceptRange, offer string) int {
+	mediaType, params, err := mime.ParseMediaType(offer)
+	if err != nil {
+		return -1
+	}
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	rangeType, rangeSubtype, _ := strings.Cut(r.value, "/")
+
+	switch {
+	case rangeType == "*" && rangeSubtype == "*":
+		return 0
+	case rangeType != typ:
+		return -1
+	case rangeSubtype == "*":
+		return 1
+	case rangeSubtype != subtype:
+		return -1
+	}
+	for k, v := range r.params {
+		if !strings.EqualFold(params[k], v) {
+			return -1
+		}
+	}
+	return 2 + len(r.params)
+}
+
+// NegotiateLanguage returns the offered language tag preferred by the
+// Accept-Language header using basic filtering (RFC 4647), or "" when none
+// is acceptable.
+func (r *HttpRequest) NegotiateLanguage(offers ...string) string {
+	return negotiate(r.Headers.Get(HeaderAcceptLanguage), offers, func(r acceptRange, offer string) int {
+		offer = strings.ToLower(offer)
+		switch {
+		case r.value == "*":
+			return 0
+		case offer == r.value || strings.HasPrefix(offer, r.value+"-"):
+			return len(r.value)
+		default:
+			return -1
+		}
+	})
+}
+
+// NegotiateCharset returns the offered charset preferred by the
+// Accept-Charset header, or "" when none is acceptable.
+func (r *HttpRequest) NegotiateCharset(offers ...string) string {
+	return negotiate(r.Headers.Get(HeaderAcceptCharset), offers, func(r acceptRange, offer string) int {
+		switch {
+		case r.value == "*":
+			return 0
+		case strings.EqualFold(offer, r.value):
+			return 1
+		default:
+			return -1
+		}
+	})
+}
+
+// Offers lists the representations a handler can produce, empty lists are
+// not negotiated.
+type Offers struct {
+	ContentTypes []string
+	Languages    []string
+	Charsets     []string
+}
+
+// Negotiated holds the representation chosen by Negotiate.
+type Negotiated struct {
+	ContentType string
+	Language    string
+	Charset     string
+}
+
+// Negotiate picks the best representation for req. When one of the lists has
+// no acceptable offer it responds with 406 Not Acceptable and returns false.
+func Negotiate(req *HttpRequest, res *HttpResponse, offers Offers) (Negotiated, bool) {
+	n := Negotiated{
+		ContentType: req.NegotiateContentType(offers.ContentTypes...),
+		Language:    req.NegotiateLanguage(offers.Languages...),
+		Charset:     req.NegotiateCharset(offers.Charsets...),
+	}
+	if len(offers.ContentTypes) > 0 && n.ContentType == "" ||
+		len(offers.Languages) > 0 && n.Language == "" ||
+		len(offers.Charsets) > 0 && n.Charset == "" {
+		res.ErrorFor(req, StatusNotAcceptable, "")
+		return n, false
+	}
+
+	for _, h := range varyHeaders(offers) {
+		addVary(res, h)
+	}
+	return n, true
+}
+
+func varyHeaders(offers Offers) []string {
+	var vary []string
+	if len(offers.ContentTypes) > 1 {
+		vary = append(vary, HeaderAccept)
+	}
+	if len(offers.Languages) > 1 {
+		vary = append(vary, HeaderAcceptLanguage)
+	}
+	if len(offers.Charsets) > 1 {
+		vary = append(vary, HeaderAcceptCharset)
+	}
+	return vary
+}
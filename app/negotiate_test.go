@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/plain;charset=utf-8"}
+	testCases := []struct {
+		desc   string
+		accept string
+		want   string
+	}{
+		{desc: "no accept header", accept: "", want: "text/html"},
+		{desc: "any", accept: "*/*", want: "text/html"},
+		{desc: "exact match", accept: "application/json", want: "application/json"},
+		{desc: "weights", accept: "text/html;q=0.5, application/json;q=0.8", want: "application/json"},
+		{desc: "type wildcard", accept: "text/*", want: "text/html"},
+		{desc: "specific range overrides wildcard", accept: "text/*, text/html;q=0", want: "text/plain;charset=utf-8"},
+		{desc: "params must match", accept: "text/plain;charset=utf-8;q=0.9, */*;q=0.1", want: "text/plain;charset=utf-8"},
+		{desc: "mismatched params", accept: "text/plain;charset=latin1", want: ""},
+		{desc: "invalid weight is ignored", accept: "application/json;q=2, text/html;q=0.1", want: "text/html"},
+		{desc: "nothing acceptable", accept: "image/png", want: ""},
+		{desc: "case insensitive", accept: "Application/JSON", want: "application/json"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Headers: HttpHeaders{}}
+			if tC.accept != "" {
+				req.Headers[HeaderAccept] = tC.accept
+			}
+			if got := req.NegotiateContentType(offers...); got != tC.want {
+				t.Errorf("invalid content type, wanted: '%s', got: '%s'", tC.want, got)
+			}
+		})
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	offers := []string{"en-US", "fr", "de-CH"}
+	testCases := []struct {
+		desc   string
+		accept string
+		want   string
+	}{
+		{desc: "no header", accept: "", want: "en-US"},
+		{desc: "prefix match", accept: "de", want: "de-CH"},
+		{desc: "exact match", accept: "fr-FR, fr;q=0.9", want: "fr"},
+		{desc: "longer range does not match shorter tag", accept: "fr-FR", want: ""},
+		{desc: "weights", accept: "en;q=0.2, de;q=0.7", want: "de-CH"},
+		{desc: "wildcard", accept: "*;q=0.5, fr;q=0", want: "en-US"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Headers: HttpHeaders{HeaderAcceptLanguage: tC.accept}}
+			if got := req.NegotiateLanguage(offers...); got != tC.want {
+				t.Errorf("invalid language, wanted: '%s', got: '%s'", tC.want, got)
+			}
+		})
+	}
+}
+
+func TestNegotiateCharset(t *testing.T) {
+	offers := []string{"utf-8", "iso-8859-1"}
+	testCases := []struct {
+		desc   string
+		accept string
+		want   string
+	}{
+		{desc: "no header", accept: "", want: "utf-8"},
+		{desc: "exact match", accept: "ISO-8859-1", want: "iso-8859-1"},
+		{desc: "wildcard", accept: "*", want: "utf-8"},
+		{desc: "excluded by weight", accept: "utf-8;q=0, *", want: "iso-8859-1"},
+		{desc: "nothing acceptable", accept: "utf-16", want: ""},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Headers: HttpHeaders{HeaderAcceptCharset: tC.accept}}
+			if got := req.NegotiateCharset(offers...); got != tC.want {
+				t.Errorf("invalid charset, wanted: '%s', got: '%s'", tC.want, got)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := Offers{
+		ContentTypes: []string{"text/plain", "application/json"},
+		Languages:    []string{"en"},
+	}
+	testCases := []struct {
+		desc       string
+		headers    HttpHeaders
+		wantOk     bool
+		wantStatus int
+		wantType   string
+		wantVary   string
+	}{
+		{
+			desc:       "acceptable",
+			headers:    HttpHeaders{HeaderAccept: "application/json", HeaderAcceptLanguage: "en-GB, en"},
+			wantOk:     true,
+			wantStatus: StatusOK,
+			wantType:   "application/json",
+			wantVary:   "Accept",
+		},
+		{
+			desc:       "unacceptable content type",
+			headers:    HttpHeaders{HeaderAccept: "image/png"},
+			wantStatus: StatusNotAcceptable,
+		},
+		{
+			desc:       "unacceptable language",
+			headers:    HttpHeaders{HeaderAcceptLanguage: "fr"},
+			wantStatus: StatusNotAcceptable,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Target: "/", Headers: tC.headers}
+			res := newCleanResponse()
+			res.Status = StatusOK
+
+			n, ok := Negotiate(req, res, offers)
+			if ok != tC.wantOk {
+				t.Fatalf("invalid result, wanted: '%v', got: '%v'", tC.wantOk, ok)
+			}
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: '%d', got: '%d'", tC.wantStatus, res.Status)
+			}
+			if ok && n.ContentType != tC.wantType {
+				t.Errorf("invalid content type, wanted: '%s', got: '%s'", tC.wantType, n.ContentType)
+			}
+			if got := res.Headers[HeaderVary]; got != tC.wantVary {
+				t.Errorf("invalid Vary header, wanted: '%s', got: '%s'", tC.wantVary, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// rejectWriteTimeout bounds the write of the 503 sent to turned away
+// connections, so the accept loop never waits on a slow client.
+const rejectWriteTimeout = 100 * time.Millisecond
+
+// connTracker counts the open connections, in total and per client IP, and
+// knows which ones are idle between keep-alive requests or, for HTTP/2, have
+// no open streams.
+type connTracker struct {
+	mu sync.Mutex
+	// conns holds the admitted connections until they are closed, shed ones
+	// included, while open and perIP only count those not shed.
+	conns map[net.Conn]*trackedConn
+	open  int
+	perIP map[string]int
+}
+
+type trackedConn struct {
+	ip   string
+	idle bool
+	// shed is set once the connection gave up its slot to a new one.
+	shed bool
+	// shutdown sheds HTTP/2 connections, nil for HTTP/1 ones.
+	shutdown func()
+}
+
+// admit registers conn unless it would exceed the limits of srv. At the
+// connection limit an idle keep-alive connection is shed to make room.
+func (srv *Server) admit(conn net.Conn) (ok bool, reason string) {
+	if srv.MaxConnections <= 0 && srv.MaxConnectionsPerIP <= 0 {
+		return true, ""
+	}
+	t := &srv.conns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[net.Conn]*trackedConn{}
+		t.perIP = map[string]int{}
+	}
+
+	// Clients of Unix sockets have no IP and only count towards the total.
+	ip, _, _ := net.SplitHostPort(remoteAddr(conn))
+	if srv.MaxConnectionsPerIP > 0 && ip != "" && t.perIP[ip] >= srv.MaxConnectionsPerIP {
+		return false, "too many connections from client"
+	}
+	if srv.MaxConnections > 0 && t.open >= srv.MaxConnections && !t.shedIdle() {
+		return false, "too many connections"
+	}
+	t.conns[conn] = &trackedConn{ip: ip}
+	t.open++
+	if ip != "" {
+		t.perIP[ip]++
+	}
+	return true, ""
+}
+
+// shedIdle closes one idle connection. HTTP/1 ones get their read deadline
+// moved to now so their goroutine ends like on an idle timeout, HTTP/2 ones
+// are sent GOAWAY.
+func (t *connTracker) shedIdle() bool {
+	for conn, tc := range t.conns {
+		if !tc.idle || tc.shed {
+			continue
+		}
+		tc.shed = true
+		t.uncount(tc)
+		if tc.shutdown != nil {
+			// The write must not hold up the accept loop.
+			go tc.shutdown()
+		} else {
+			_ = conn.SetReadDeadline(time.Now())
+		}
+		return true
+	}
+	return false
+}
+
+func (t *connTracker) uncount(tc *trackedConn) {
+	t.open--
+	if tc.ip == "" {
+		return
+	}
+	if t.perIP[tc.ip]--; t.perIP[tc.ip] <= 0 {
+		delete(t.perIP, tc.ip)
+	}
+}
+
+// release forgets conn once it is closed.
+func (t *connTracker) release(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.conns[conn]
+	if !ok {
+		return
+	}
+	if !tc.shed {
+		t.uncount(tc)
+	}
+	delete(t.conns, conn)
+}
+
+// setIdle marks conn as waiting for its next request or busy serving one.
+// It reports false when conn was shed and must be closed.
+func (t *connTracker) setIdle(conn net.Conn, idle bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.conns[conn]
+	if !ok {
+		return true
+	}
+	if tc.shed {
+		return false
+	}
+	tc.idle = idle
+	return true
+}
+
+// setShutdown marks conn as an HTTP/2 connection shed by calling shutdown.
+func (t *connTracker) setShutdown(conn net.Conn, shutdown func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc, ok := t.conns[conn]; ok {
+		tc.shutdown = shutdown
+	}
+}
+
+// remoteAddr returns the address of the peer of conn, Unix socket clients
+// may have none.
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// nearConnLimit reports whether the open connections reach 90% of
+// MaxConnections, responses then close their connection instead of keeping
+// it alive.
+func (srv *Server) nearConnLimit() bool {
+	if srv.MaxConnections <= 0 {
+		return false
+	}
+	srv.conns.mu.Lock()
+	defer srv.conns.mu.Unlock()
+	return srv.conns.open*10 >= srv.MaxConnections*9
+}
+
+// reject turns away a connection over the limits. Plain connections get a
+// 503, TLS ones are closed since answering would need a handshake.
+func (srv *Server) reject(conn net.Conn, reason string) {
+	srv.log.Warn("rejected connection", slog.String("remote_addr", remoteAddr(conn)), slog.String("reason", reason))
+	defer conn.Close()
+	if _, ok := conn.(*tls.Conn); ok {
+		return
+	}
+
+	res := newCleanResponse()
+	srv.setDefaultHeaders(res)
+	res.Error(StatusServiceUnavailable, reason)
+	res.Headers[HeaderRetryAfter] = "1"
+	res.Headers[HeaderConnection] = "close"
+	_ = conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	_, _ = Write(conn, res)
+}
+
+// acquireRequest takes one of the MaxConcurrentRequests slots, waiting at
+// most RequestQueueTimeout for one to be released.
+func (srv *Server) acquireRequest() bool {
+	if srv.MaxConcurrentRequests <= 0 {
+		return true
+	}
+	srv.requestSlotsOnce.Do(func() {
+		srv.requestSlots = make(chan struct{}, srv.MaxConcurrentRequests)
+	})
+
+	select {
+	case srv.requestSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if srv.RequestQueueTimeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(srv.RequestQueueTimeout)
+	defer timer.Stop()
+	select {
+	case srv.requestSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (srv *Server) releaseRequest() {
+	if srv.MaxConcurrentRequests > 0 {
+		<-srv.requestSlots
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func dialTestServer(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// waitForConns waits until srv tracks open connections, idle ones among them.
+func waitForConns(t *testing.T, srv *Server, open, idle int) {
+	t.Helper()
+	for range 500 {
+		srv.conns.mu.Lock()
+		gotIdle := 0
+		for _, tc := range srv.conns.conns {
+			if tc.idle && !tc.shed {
+				gotIdle++
+			}
+		}
+		gotOpen := srv.conns.open
+		srv.conns.mu.Unlock()
+		if gotOpen == open && gotIdle == idle {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("wanted %d open and %d idle connections", open, idle)
+}
+
+const overloadTestRequest = "GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n"
+
+func TestMaxConnections(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	srv.MaxConnections = 2
+	addr := serveTestServer(t, srv, nil)
+
+	idle, idleBr := dialTestServer(t, addr)
+	if status, headers, _ := roundTrip(t, idle, idleBr, overloadTestRequest); status != "HTTP/1.1 200 OK" || headers[HeaderConnection] == "close" {
+		t.Fatalf("wanted a kept alive response below the limit, got: '%s' (Connection: '%s')", status, headers[HeaderConnection])
+	}
+	waitForConns(t, srv, 1, 1)
+
+	busy, busyBr := dialTestServer(t, addr)
+	waitForConns(t, srv, 2, 1)
+
+	// At the limit the idle connection makes room for the new one.
+	shedding, _ := dialTestServer(t, addr)
+	if _, err := idle.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("wanted the idle connection to be closed, got: %v", err)
+	}
+	waitForConns(t, srv, 2, 0)
+
+	// Without idle connections new ones are turned away.
+	rejected, rejectedBr := dialTestServer(t, addr)
+	status, headers, _ := roundTrip(t, rejected, rejectedBr, "")
+	if status != "HTTP/1.1 503 Service Unavailable" || headers[HeaderRetryAfter] != "1" {
+		t.Errorf("wanted a 503 with Retry-After, got: '%s' (Retry-After: '%s')", status, headers[HeaderRetryAfter])
+	}
+
+	// Near the limit connections are no longer kept alive.
+	status, headers, _ = roundTrip(t, busy, busyBr, overloadTestRequest)
+	if status != "HTTP/1.1 200 OK" || headers[HeaderConnection] != "close" {
+		t.Errorf("wanted a 200 closing the connection, got: '%s' (Connection: '%s')", status, headers[HeaderConnection])
+	}
+	waitForConns(t, srv, 1, 0)
+
+	shedding.Close()
+	waitForConns(t, srv, 0, 0)
+}
+
+func TestMaxConnectionsHTTP2(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	srv.MaxConnections = 2
+	addr := serveTestServer(t, srv, nil)
+
+	// An HTTP/2 connection without open streams is idle.
+	_, h2Br := dialHTTP2(t, addr)
+	waitForConns(t, srv, 1, 1)
+	dialTestServer(t, addr)
+	waitForConns(t, srv, 2, 1)
+
+	// At the limit it is sent GOAWAY to make room for the new one.
+	conn, br := dialTestServer(t, addr)
+	if status, _, _ := roundTrip(t, conn, br, overloadTestRequest); status != "HTTP/1.1 200 OK" {
+		t.Errorf("invalid status for the new connection, wanted: 200, got: '%s'", status)
+	}
+	if code := readGoAway(t, h2Br, 0); code != uint32(http2ErrNoError) {
+		t.Errorf("invalid GOAWAY code, wanted: 0, got: %d", code)
+	}
+	if _, err := h2Br.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("wanted the HTTP/2 connection to be closed, got: %v", err)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	srv.MaxConnectionsPerIP = 1
+	addr := serveTestServer(t, srv, nil)
+
+	first, firstBr := dialTestServer(t, addr)
+	waitForConns(t, srv, 1, 0)
+
+	second, secondBr := dialTestServer(t, addr)
+	if status, _, _ := roundTrip(t, second, secondBr, ""); status != "HTTP/1.1 503 Service Unavailable" {
+		t.Errorf("invalid status for the second connection, wanted: 503, got: '%s'", status)
+	}
+	if status, _, _ := roundTrip(t, first, firstBr, overloadTestRequest); status != "HTTP/1.1 200 OK" {
+		t.Errorf("invalid status for the first connection, wanted: 200, got: '%s'", status)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), func(req *HttpRequest, res *HttpResponse) {
+		if req.Target == "/block" {
+			close(started)
+			<-unblock
+		}
+	})
+	srv.MaxConcurrentRequests = 1
+	srv.RequestQueueTimeout = 20 * time.Millisecond
+	addr := serveTestServer(t, srv, nil)
+
+	blocked, blockedBr := dialTestServer(t, addr)
+	done := make(chan string)
+	go func() {
+		status, _, _ := roundTrip(t, blocked, blockedBr, "GET /block HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+		done <- status
+	}()
+	<-started
+
+	queued, queuedBr := dialTestServer(t, addr)
+	status, headers, _ := roundTrip(t, queued, queuedBr, overloadTestRequest)
+	if status != "HTTP/1.1 503 Service Unavailable" || headers[HeaderRetryAfter] != "1" {
+		t.Errorf("wanted a 503 with Retry-After after the queue timeout, got: '%s' (Retry-After: '%s')", status, headers[HeaderRetryAfter])
+	}
+
+	close(unblock)
+	if status := <-done; status != "HTTP/1.1 200 OK" {
+		t.Errorf("invalid status for the blocked request, wanted: 200, got: '%s'", status)
+	}
+	// The released slot serves the next request.
+	if status, _, _ := roundTrip(t, queued, queuedBr, overloadTestRequest); status != "HTTP/1.1 200 OK" {
+		t.Errorf("invalid status once the slot is released, wanted: 200, got: '%s'", status)
+	}
+}
+
+func TestMaxConcurrentRequestsLongLived(t *testing.T) {
+	ws := WebSocketHandler{Handle: func(ws *WebSocketConn, req *HttpRequest) {
+		// Hold the connection until the client closes it.
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}}
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), func(req *HttpRequest, res *HttpResponse) {
+		switch req.Target {
+		case "/ws":
+			ws.Serve(req, res)
+		case "/events":
+			w, err := NewSSEWriter(req, res, 0)
+			if err != nil {
+				return
+			}
+			defer w.Close()
+			<-w.Done()
+		}
+	})
+	srv.MaxConcurrentRequests = 1
+	srv.RequestQueueTimeout = 20 * time.Millisecond
+	addr := serveTestServer(t, srv, nil)
+
+	testCases := []struct {
+		desc       string
+		request    string
+		wantStatus string
+	}{
+		{
+			desc:       "websocket",
+			request:    "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+			wantStatus: "HTTP/1.1 101 Switching Protocols",
+		},
+		{
+			desc:       "event stream",
+			request:    "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			wantStatus: "HTTP/1.1 200 OK",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			long, longBr := dialTestServer(t, addr)
+			io.WriteString(long, tC.request)
+			if status, _ := longBr.ReadString('\n'); status != tC.wantStatus+"\r\n" {
+				t.Fatalf("invalid status line, wanted: '%s', got: '%s'", tC.wantStatus, status)
+			}
+
+			// The long-lived response gave its slot back.
+			conn, br := dialTestServer(t, addr)
+			if status, _, _ := roundTrip(t, conn, br, overloadTestRequest); status != "HTTP/1.1 200 OK" {
+				t.Errorf("invalid status while the %s is open, wanted: 200, got: '%s'", tC.desc, status)
+			}
+			long.Close()
+		})
+	}
+}
+
+func TestMaxConnectionsPerIPUnix(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	srv.MaxConnectionsPerIP = 1
+	path := socketPath(t)
+	l, err := Listen(unixAddrPrefix+path, DefaultUnixSocketMode)
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	// Unix clients have no IP to be counted under.
+	for i := range 2 {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("could not dial server: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if status, _, _ := roundTrip(t, conn, bufio.NewReader(conn), overloadTestRequest); status != "HTTP/1.1 200 OK" {
+			t.Errorf("invalid status for connection %d, wanted: 200, got: '%s'", i, status)
+		}
+	}
+}
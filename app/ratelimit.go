@@ -0,0 +1,280 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderRetryAfter         = "Retry-After"
+	HeaderForwardedFor       = "X-Forwarded-For"
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRateLimitPolicy    = "RateLimit-Policy"
+
+	defaultRateLimitMaxKeys = 100_000
+)
+
+// RateLimiter is a token bucket per client: each holds up to Limit requests
+// and refills at Limit per Period. Buckets idle long enough to be full again
+// are forgotten, and the least recently used ones are evicted past MaxKeys.
+type RateLimiter struct {
+	Limit  int
+	Period time.Duration
+	// Key identifies the client of a request, the remote IP by default, or
+	// the connection for clients without an IP such as those of Unix
+	// sockets. Requests with an empty key are not limited.
+	Key func(req *HttpRequest) string
+	// MaxKeys bounds the number of clients tracked, 100000 when zero.
+	MaxKeys int
+
+	// now is replaced by tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// lru holds the buckets, most recently used first.
+	lru *list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(limit int, period time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Limit:   limit,
+		Period:  period,
+		now:     time.Now,
+		buckets: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// rateLimitResult is the state of a bucket after taking a request from it.
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+func (l *RateLimiter) take(key string) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.evict(now)
+
+	capacity := float64(l.Limit)
+	rate := capacity / l.Period.Seconds()
+	b := &tokenBucket{key: key, tokens: capacity, last: now}
+	if e, ok := l.buckets[key]; ok {
+		b = e.Value.(*tokenBucket)
+		l.lru.MoveToFront(e)
+	} else {
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	r := rateLimitResult{allowed: b.tokens >= 1}
+	if r.allowed {
+		b.tokens--
+	} else {
+		r.retryAfter = seconds((1 - b.tokens) / rate)
+	}
+	r.remaining = int(b.tokens)
+	r.reset = seconds((capacity - b.tokens) / rate)
+	return r
+}
+
+// evict drops the buckets refilled since their last use, which behave like
+// new ones, then the least recently used beyond MaxKeys.
+func (l *RateLimiter) evict(now time.Time) {
+	maxKeys := l.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultRateLimitMaxKeys
+	}
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		b := e.Value.(*tokenBucket)
+		if l.lru.Len() < maxKeys && now.Sub(b.last) < l.Period {
+			return
+		}
+		l.lru.Remove(e)
+		delete(l.buckets, b.key)
+	}
+}
+
+// refund gives back the request taken from the bucket of key.
+func (l *RateLimiter) refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.buckets[key]; ok {
+		b := e.Value.(*tokenBucket)
+		b.tokens = min(float64(l.Limit), b.tokens+1)
+	}
+}
+
+// Len returns the number of clients tracked.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Wrap limits the requests reaching next. Responses carry the RateLimit
+// headers, rejected requests get 429 with Retry-After.
+func (l *RateLimiter) Wrap(next Handler) Handler {
+	return func(req *HttpRequest, res *HttpResponse) {
+		key := l.key(req)
+		if key == "" {
+			next(req, res)
+			return
+		}
+
+		r := l.take(key)
+		res.Headers[HeaderRateLimitLimit] = strconv.Itoa(l.Limit)
+		res.Headers[HeaderRateLimitRemaining] = strconv.Itoa(r.remaining)
+		res.Headers[HeaderRateLimitReset] = ceilSeconds(r.reset)
+		res.Headers[HeaderRateLimitPolicy] = strconv.Itoa(l.Limit) + ";w=" + ceilSeconds(l.Period)
+		if !r.allowed {
+			res.Headers[HeaderRetryAfter] = ceilSeconds(r.retryAfter)
+			res.ErrorFor(req, StatusTooManyRequests, "")
+			return
+		}
+		next(req, res)
+	}
+}
+
+// WrapFailures limits the failed requests reaching next, such as those an
+// auth middleware in next rejects: only the responses for which failed is
+// true use up a request. Clients without requests left get 429 with
+// Retry-After.
+func (l *RateLimiter) WrapFailures(next Handler, failed func(*HttpResponse) bool) Handler {
+	return func(req *HttpRequest, res *HttpResponse) {
+		key := l.key(req)
+		if key == "" {
+			next(req, res)
+			return
+		}
+
+		// The request is taken up front so concurrent ones cannot overrun
+		// the limit, and given back when it succeeds.
+		r := l.take(key)
+		if !r.allowed {
+			res.Headers[HeaderRetryAfter] = ceilSeconds(r.retryAfter)
+			res.ErrorFor(req, StatusTooManyRequests, "")
+			return
+		}
+		next(req, res)
+		if !failed(res) {
+			l.refund(key)
+		}
+	}
+}
+
+func (l *RateLimiter) key(req *HttpRequest) string {
+	if l.Key != nil {
+		return l.Key(req)
+	}
+	return clientKey(req, req.RemoteIP())
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// ClientIPKey keys requests by client IP. The X-Forwarded-For header is only
+// trusted on requests from trustedProxies, the client being the last address
+// not belonging to them. Clients without an IP are keyed by connection.
+func ClientIPKey(trustedProxies ...netip.Prefix) func(*HttpRequest) string {
+	return func(req *HttpRequest) string {
+		return clientKey(req, ClientIP(req, trustedProxies))
+	}
+}
+
+// clientKey returns ip, or a key of the connection of req when empty.
+func clientKey(req *HttpRequest, ip string) string {
+	if ip == "" {
+		return "conn:" + strconv.FormatUint(req.ConnID, 10)
+	}
+	return ip
+}
+
+// ClientIP returns the address of the client of req, see ClientIPKey.
+func ClientIP(req *HttpRequest, trustedProxies []netip.Prefix) string {
+	remote := req.RemoteIP()
+	if !isTrustedProxy(remote, trustedProxies) {
+		return remote
+	}
+	hops := splitHeaderList(req.Headers.Get(HeaderForwardedFor))
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrustedProxy(hops[i], trustedProxies) {
+			if addr, err := netip.ParseAddr(hops[i]); err == nil {
+				return addr.Unmap().String()
+			}
+			// A malformed hop was not added by a trusted proxy.
+			return remote
+		}
+		remote = hops[i]
+	}
+	return remote
+}
+
+func isTrustedProxy(ip string, trustedProxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserKey keys authenticated requests by user and the others with fallback.
+// The auth middleware must run before the limiter, so the requests it
+// rejects are to be limited around it, see WrapFailures.
+func UserKey(fallback func(*HttpRequest) string) func(*HttpRequest) string {
+	return func(req *HttpRequest) string {
+		if user := req.User(); user != "" {
+			return "user:" + user
+		}
+		return fallback(req)
+	}
+}
+
+// ParseRateLimit parses limits written as "100/1m", a number of requests
+// per duration; "10/s" is short for "10/1s".
+func ParseRateLimit(s string) (int, time.Duration, error) {
+	n, period, ok := strings.Cut(s, "/")
+	limit, err := strconv.Atoi(n)
+	if !ok || err != nil || limit <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit %q, expected requests/duration such as 100/1m", s)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit %q, expected requests/duration such as 100/1m", s)
+	}
+	return limit, d, nil
+}
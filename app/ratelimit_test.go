@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+	handler := limiter.Wrap(func(req *HttpRequest, res *HttpResponse) {
+		res.WriteStr("ok")
+	})
+
+	testCases := []struct {
+		desc           string
+		remoteAddr     string
+		wait           time.Duration
+		wantStatus     int
+		wantRemaining  string
+		wantReset      string
+		wantRetryAfter string
+	}{
+		{desc: "first request", remoteAddr: "10.0.0.1:1000", wantStatus: StatusOK, wantRemaining: "1", wantReset: "30"},
+		{desc: "second request", remoteAddr: "10.0.0.1:1001", wantStatus: StatusOK, wantRemaining: "0", wantReset: "60"},
+		{desc: "limited", remoteAddr: "10.0.0.1:1002", wantStatus: StatusTooManyRequests, wantRemaining: "0", wantReset: "60", wantRetryAfter: "30"},
+		{desc: "other client", remoteAddr: "10.0.0.2:1000", wantStatus: StatusOK, wantRemaining: "1", wantReset: "30"},
+		{desc: "refilled token", remoteAddr: "10.0.0.1:1003", wait: 30 * time.Second, wantStatus: StatusOK, wantRemaining: "0", wantReset: "60"},
+		{desc: "partially refilled", remoteAddr: "10.0.0.1:1004", wait: 15 * time.Second, wantStatus: StatusTooManyRequests, wantRemaining: "0", wantReset: "45", wantRetryAfter: "15"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			now = now.Add(tC.wait)
+			res := newCleanResponse()
+			handler(&HttpRequest{Method: MethodGet, Target: "/", Headers: HttpHeaders{}, RemoteAddr: tC.remoteAddr}, res)
+
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+			want := map[string]string{
+				HeaderRateLimitLimit:     "2",
+				HeaderRateLimitRemaining: tC.wantRemaining,
+				HeaderRateLimitReset:     tC.wantReset,
+				HeaderRateLimitPolicy:    "2;w=60",
+				HeaderRetryAfter:         tC.wantRetryAfter,
+			}
+			for k, v := range want {
+				if got := res.Headers[k]; got != v {
+					t.Errorf("invalid %s header, wanted: '%s', got: '%s'", k, v, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(1, time.Minute)
+	limiter.MaxKeys = 3
+	limiter.now = func() time.Time { return now }
+
+	for i := range 5 {
+		limiter.take(strconv.Itoa(i))
+	}
+	if n := limiter.Len(); n != 3 {
+		t.Errorf("invalid number of keys past MaxKeys, wanted: 3, got: %d", n)
+	}
+	// The most recent keys are kept.
+	if r := limiter.take("4"); r.allowed {
+		t.Error("wanted key '4' to still be limited")
+	}
+
+	now = now.Add(time.Minute)
+	limiter.take("5")
+	if n := limiter.Len(); n != 1 {
+		t.Errorf("invalid number of keys after they idled, wanted: 1, got: %d", n)
+	}
+}
+
+func TestRateLimiterUnixClients(t *testing.T) {
+	limiter := NewRateLimiter(1, time.Minute)
+	handler := limiter.Wrap(func(req *HttpRequest, res *HttpResponse) {})
+
+	// Clients of Unix sockets have no IP, they are limited per connection.
+	testCases := []struct {
+		desc       string
+		connID     uint64
+		wantStatus int
+	}{
+		{desc: "first request", connID: 1, wantStatus: StatusOK},
+		{desc: "same connection", connID: 1, wantStatus: StatusTooManyRequests},
+		{desc: "other connection", connID: 2, wantStatus: StatusOK},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res := newCleanResponse()
+			handler(&HttpRequest{Method: MethodGet, Target: "/", Headers: HttpHeaders{}, ConnID: tC.connID}, res)
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{desc: "direct client", remoteAddr: "203.0.113.7:5000", want: "203.0.113.7"},
+		{desc: "header from untrusted client", remoteAddr: "203.0.113.7:5000", forwarded: "1.2.3.4", want: "203.0.113.7"},
+		{desc: "trusted proxy", remoteAddr: "10.0.0.1:5000", forwarded: "198.51.100.2", want: "198.51.100.2"},
+		{desc: "spoofed hops are skipped", remoteAddr: "10.0.0.1:5000", forwarded: "1.2.3.4, 198.51.100.2, 10.0.0.9", want: "198.51.100.2"},
+		{desc: "ipv6 proxy", remoteAddr: "[::1]:5000", forwarded: "2001:db8::1", want: "2001:db8::1"},
+		{desc: "malformed hop", remoteAddr: "10.0.0.1:5000", forwarded: "unknown", want: "10.0.0.1"},
+		{desc: "only proxies", remoteAddr: "10.0.0.1:5000", forwarded: "10.0.0.2, 10.0.0.3", want: "10.0.0.2"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Headers: HttpHeaders{}, RemoteAddr: tC.remoteAddr}
+			if tC.forwarded != "" {
+				req.Headers[HeaderForwardedFor] = tC.forwarded
+			}
+			if got := ClientIP(req, proxies); got != tC.want {
+				t.Errorf("invalid client IP, wanted: '%s', got: '%s'", tC.want, got)
+			}
+		})
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	testCases := []struct {
+		value      string
+		wantLimit  int
+		wantPeriod time.Duration
+		wantErr    bool
+	}{
+		{value: "100/1m", wantLimit: 100, wantPeriod: time.Minute},
+		{value: "10/s", wantLimit: 10, wantPeriod: time.Second},
+		{value: "5/h", wantLimit: 5, wantPeriod: time.Hour},
+		{value: "0/1m", wantErr: true},
+		{value: "10", wantErr: true},
+		{value: "10/soon", wantErr: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.value, func(t *testing.T) {
+			limit, period, err := ParseRateLimit(tC.value)
+			if (err != nil) != tC.wantErr {
+				t.Fatalf("invalid error, wanted error: %v, got: %v", tC.wantErr, err)
+			}
+			if limit != tC.wantLimit || period != tC.wantPeriod {
+				t.Errorf("invalid rate limit, wanted: %d/%s, got: %d/%s", tC.wantLimit, tC.wantPeriod, limit, period)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+const HeaderRequestID = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+// newRequestID returns a random 128-bit identifier encoded as hex.
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether an incoming request ID is safe to reuse,
+// i.e. it is short and contains no characters that could break log lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '+', c == '/', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setRequestID reuses a valid incoming X-Request-ID or generates a new one,
+// echoes it in the response and attaches it to the request-scoped logger.
+func setRequestID(req *HttpRequest, res *HttpResponse, logger *slog.Logger) {
+	id := req.Headers.Get(HeaderRequestID)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+
+	req.ID = id
+	req.log = logger.With(slog.String("request_id", id))
+	res.Headers[HeaderRequestID] = id
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// Router dispatches requests to handlers by method and path, the query string
+// of the target is ignored. HEAD requests
+// are served by the GET handler of a route unless one is registered for HEAD,
+// the server then drops the body while keeping the headers.
+type Router struct {
+	// NotFound handles targets matching no route, it responds with 404 when nil.
+	NotFound Handler
+
+	routes []route
+}
+
+type route struct {
+	method  string
+	pattern string
+	prefix  bool
+	handler Handler
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for requests whose path equals pattern.
+func (rt *Router) Handle(method, pattern string, handler Handler) {
+	rt.routes = append(rt.routes, route{method: method, pattern: pattern, handler: handler})
+}
+
+// HandlePrefix registers handler for requests whose path starts with prefix.
+func (rt *Router) HandlePrefix(method, prefix string, handler Handler) {
+	rt.routes = append(rt.routes, route{method: method, pattern: prefix, prefix: true, handler: handler})
+}
+
+func (r route) matches(path string) bool {
+	if r.prefix {
+		return strings.HasPrefix(path, r.pattern)
+	}
+	return path == r.pattern
+}
+
+// Serve runs the handler of the first route matching the request, routes are
+// tried in registration order. OPTIONS requests without a route of their own
+// are answered with the methods allowed for the target, or for the whole
+// router when the target is "*".
+func (rt *Router) Serve(req *HttpRequest, res *HttpResponse) {
+	server := req.Method == MethodOptions && req.Target == "*"
+	path := req.Path()
+	var get Handler
+	var allowed []string
+	for _, r := range rt.routes {
+		if !server && !r.matches(path) {
+			continue
+		}
+		if r.method == req.Method && !server {
+			r.handler(req, res)
+			return
+		}
+		if r.method == MethodGet && get == nil {
+			get = r.handler
+		}
+		allowed = append(allowed, r.method)
+	}
+
+	if req.Method == MethodHead && get != nil {
+		get(req, res)
+		return
+	}
+	if len(allowed) > 0 {
+		res.Headers[HeaderAllow] = allowHeader(allowed)
+		if req.Method == MethodOptions {
+			res.Status = StatusNoContent
+			return
+		}
+		res.Status = StatusMethodNotAllowed
+		return
+	}
+
+	if rt.NotFound != nil {
+		rt.NotFound(req, res)
+		return
+	}
+	res.Status = StatusNotFound
+}
+
+// allowHeader lists methods sorted and deduplicated, along with the HEAD and
+// OPTIONS requests the router answers by itself.
+func allowHeader(methods []string) string {
+	methods = append(methods, MethodOptions)
+	if slices.Contains(methods, MethodGet) {
+		methods = append(methods, MethodHead)
+	}
+	slices.Sort(methods)
+	return strings.Join(slices.Compact(methods), ", ")
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestRouter(t *testing.T) {
+	handler := func(name string) Handler {
+		return func(req *HttpRequest, res *HttpResponse) {
+			res.WriteStr(name)
+		}
+	}
+	rt := NewRouter()
+	rt.Handle(MethodGet, "/", handler("root"))
+	rt.HandlePrefix(MethodGet, "/files/", handler("read"))
+	rt.HandlePrefix(MethodPost, "/files/", handler("create"))
+	rt.Handle(MethodGet, "/status", handler("status"))
+	rt.Handle(MethodHead, "/status", handler("status head"))
+
+	testCases := []struct {
+		desc       string
+		method     string
+		target     string
+		wantStatus int
+		wantBody   string
+		wantAllow  string
+	}{
+		{desc: "exact match", method: MethodGet, target: "/", wantStatus: StatusOK, wantBody: "root"},
+		{desc: "exact match with a query", method: MethodGet, target: "/?x=1", wantStatus: StatusOK, wantBody: "root"},
+		{desc: "prefix match", method: MethodPost, target: "/files/a", wantStatus: StatusOK, wantBody: "create"},
+		{desc: "prefix match with a query", method: MethodPost, target: "/files/a?x=1", wantStatus: StatusOK, wantBody: "create"},
+		{desc: "query not part of the path", method: MethodGet, target: "/missing?/status", wantStatus: StatusNotFound},
+		{desc: "head served by get", method: MethodHead, target: "/files/a", wantStatus: StatusOK, wantBody: "read"},
+		{desc: "explicit head", method: MethodHead, target: "/status", wantStatus: StatusOK, wantBody: "status head"},
+		{desc: "method not allowed", method: MethodDelete, target: "/files/a", wantStatus: StatusMethodNotAllowed, wantAllow: "GET, HEAD, OPTIONS, POST"},
+		{desc: "automatic options", method: MethodOptions, target: "/files/a", wantStatus: StatusNoContent, wantAllow: "GET, HEAD, OPTIONS, POST"},
+		{desc: "options for the server", method: MethodOptions, target: "*", wantStatus: StatusNoContent, wantAllow: "GET, HEAD, OPTIONS, POST"},
+		{desc: "options not found", method: MethodOptions, target: "/missing", wantStatus: StatusNotFound},
+		{desc: "not found", method: MethodGet, target: "/missing", wantStatus: StatusNotFound},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res := newCleanResponse()
+			rt.Serve(&HttpRequest{Method: tC.method, Target: tC.target, Headers: HttpHeaders{}}, res)
+
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+			if tC.wantBody != "" {
+				if body := readerToString(t, res.Body); body != tC.wantBody {
+					t.Errorf("invalid body, wanted: '%s', got: '%s'", tC.wantBody, body)
+				}
+			}
+			if allow := res.Headers[HeaderAllow]; allow != tC.wantAllow {
+				t.Errorf("invalid allow header, wanted: '%s', got: '%s'", tC.wantAllow, allow)
+			}
+		})
+	}
+}
@@ -1,19 +1,70 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
 	"log/slog"
 	"net"
+	"net/http/httputil"
+	"os"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Handler func(*HttpRequest, *HttpResponse)
 
 type Server struct {
-	Addr     string
-	Handler  Handler
-	log      *slog.Logger
-	listener net.Listener
+	Addr    string
+	Handler Handler
+	// TLSConfig is used by StartTLS, it may be nil.
+	TLSConfig *tls.Config
+	// AccessLog, when set, receives an entry for every handled request.
+	AccessLog *AccessLogger
+	// IdleTimeout is how long a keep-alive connection may wait for the next
+	// request, zero means no limit.
+	IdleTimeout time.Duration
+	// MaxRequestsPerConn closes a connection after that many requests, zero
+	// means no limit.
+	MaxRequestsPerConn int
+	// Name is sent in the Server header of every response, none is sent when empty.
+	Name string
+	// MaxConnections caps the open connections, zero means no limit. At the
+	// limit an idle keep-alive connection, or an HTTP/2 one without streams,
+	// is closed to make room for a new one, which is otherwise turned away
+	// with 503. Past 90% of the limit connections are no longer kept alive.
+	MaxConnections int
+	// MaxConnectionsPerIP caps the open connections of a client IP, zero
+	// means no limit. Clients of Unix sockets have no IP and are exempt.
+	MaxConnectionsPerIP int
+	// MaxConcurrentRequests caps the requests handled at once, zero means no
+	// limit. Requests wait up to RequestQueueTimeout for a slot, then get 503.
+	// Hijacked and streamed responses give their slot back once started.
+	MaxConcurrentRequests int
+	RequestQueueTimeout   time.Duration
+	// OnAcceptError is called for every failed Accept with the delay before
+	// the next attempt, zero when the error is permanent and ends the server.
+	OnAcceptError func(err error, delay time.Duration)
+
+	log     *slog.Logger
+	connSeq atomic.Uint64
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	// closers are run by Close, like stopping certificate reloads.
+	closers []func()
+
+	acceptErrors atomic.Uint64
+
+	conns            connTracker
+	requestSlotsOnce sync.Once
+	requestSlots     chan struct{}
 }
 
 func NewServerFromConfig(addr string, logger *slog.Logger, handler Handler) (*Server, error) {
@@ -42,63 +93,225 @@ func (srv *Server) Start() error {
 	if err != nil {
 		return err
 	}
+	return srv.Serve(l)
+}
+
+func (srv *Server) serve(l net.Listener) error {
 	defer func() {
-		if err := l.Close(); err != nil {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			srv.log.Error("could not close server", slog.String("error", err.Error()))
 		}
 	}()
-	srv.listener = l
 
+	var delay time.Duration
 	for {
-		conn, err := srv.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			srv.log.Warn("could not accept connection", slog.String("error", err.Error()))
+			srv.acceptErrors.Add(1)
+			if !isTemporaryAcceptError(err) {
+				if srv.OnAcceptError != nil {
+					srv.OnAcceptError(err, 0)
+				}
+				return err
+			}
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			if srv.OnAcceptError != nil {
+				srv.OnAcceptError(err, delay)
+			}
+			srv.log.Warn("could not accept connection, retrying", slog.String("error", err.Error()), slog.Duration("delay", delay))
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
+		srv.dispatch(conn)
+	}
+}
+
+// Bounds of the exponential backoff between failed accepts.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// isTemporaryAcceptError reports whether Accept may succeed later, like when
+// the process runs out of file descriptors. Other errors, a closed listener
+// among them, are permanent.
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.EINTR)
+}
 
-		go srv.handleConn(conn)
+// AcceptErrors returns the number of failed accepts since the server started.
+func (srv *Server) AcceptErrors() uint64 {
+	return srv.acceptErrors.Load()
+}
+
+// dispatch serves conn on its own goroutine if the connection limits allow it.
+func (srv *Server) dispatch(conn net.Conn) {
+	if ok, reason := srv.admit(conn); !ok {
+		srv.reject(conn, reason)
+		return
 	}
+	go func() {
+		defer srv.conns.release(conn)
+		srv.handleConn(conn)
+	}()
 }
 
 func (srv *Server) handleConn(conn net.Conn) {
+	hijacked := false
 	defer func() {
+		if hijacked {
+			return
+		}
 		if err := conn.Close(); err != nil {
 			srv.log.Warn("could not close connection", slog.String("error", err.Error()))
 		}
 	}()
 
+	connID := srv.connSeq.Add(1)
+	br := bufio.NewReader(conn)
+
+	if srv.IdleTimeout > 0 {
+		// The handshake and the first request must arrive in time as well.
+		_ = conn.SetReadDeadline(time.Now().Add(srv.IdleTimeout))
+	}
+
+	var h2 bool
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			srv.log.Warn("tls handshake failed", slog.String("error", err.Error()))
+			return
+		}
+		h2 = tlsConn.ConnectionState().NegotiatedProtocol == http2ALPN
+	} else {
+		h2 = isHTTP2Preface(br)
+	}
+	if h2 {
+		// Streams may outlast IdleTimeout, serveHTTP2 applies it to the time
+		// spent without any.
+		_ = conn.SetReadDeadline(time.Time{})
+		srv.serveHTTP2(conn, br, connID, nil, nil)
+		return
+	}
+
+	requestIndex := 0
 	for {
-		req, err := Read(conn)
+		if srv.IdleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(srv.IdleTimeout))
+		}
+		if requestIndex > 0 {
+			srv.conns.setIdle(conn, true)
+		}
+		req, err := Read(br)
+		if !srv.conns.setIdle(conn, false) {
+			// Shed to make room for a new connection, see admit.
+			break
+		}
 		if err != nil {
-			srv.log.Error("could not read request", slog.String("error", err.Error()))
+			// Clients closing or idling out between requests are not errors.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				srv.log.Error("could not read request", slog.String("error", err.Error()))
+			}
+			break
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+		start := time.Now()
+		requestIndex++
+		setConnMetadata(req, conn, connID, requestIndex)
+
+		if !slices.Contains(supportedVersions, req.Version) {
+			srv.refuseRequest(conn, req, start, StatusHTTPVersionNotSupported)
 			break
 		}
+		if err := delimitBody(req, br); err != nil {
+			req.Logger().Warn("could not read request body", slog.String("error", err.Error()))
+			status := StatusBadRequest
+			if errors.Is(err, ErrUnsupportedTransferEncoding) {
+				status = StatusNotImplemented
+			}
+			srv.refuseRequest(conn, req, start, status)
+			break
+		}
+
+		if settings, ok := h2cUpgradeSettings(req); ok {
+			srv.upgradeH2C(conn, br, connID, req, settings)
+			return
+		}
+
+		framed := req.Body
+		var cont *continueReader
+		if expectsContinue(req) && req.Headers.Get(HeaderContentLength) != "0" {
+			cont = &continueReader{r: req.Body, send: func() error {
+				return writeInterimResponse(bufio.NewWriter(conn), StatusContinue, nil)
+			}}
+			req.Body = cont
+		}
+		body := &countingReader{r: req.Body}
+		req.Body = body
 
 		res := newCleanResponse()
-		srv.Handler(req, res)
+		res.method = req.Method
+		res.conn, res.br = conn, br
+		res.newStream = func() (responseStream, error) {
+			n, bounded := bodyRemaining(framed)
+			return newHTTP1Stream(conn, br, req, res, bounded && n == 0 && br.Buffered() == 0)
+		}
+
+		if req.Version == "HTTP/1.0" {
+			res.Version = req.Version
+		}
+		closeConnection := !srv.setKeepAlive(req, res, requestIndex)
+
+		srv.serveRequest(req, res)
 
-		acceptEncoding := parseAcceptEncodings(req.Headers[HeaderAcceptEncoding])
-		if slices.Contains(acceptEncoding, EncodingGzip) {
-			res.Headers[HeaderContentEncoding] = EncodingGzip
+		if res.hijacked {
+			hijacked = true
+			srv.logRequest(req, res, start, body.n, 0)
+			return
 		}
 
-		var closeConnection bool
-		if strings.ToLower(req.Headers[HeaderConnection]) == "close" {
+		// The body left unread by the handler is skipped so the next request
+		// can be read. A body the client may still be holding back, or one
+		// that cannot be skipped, makes the connection unusable.
+		if cont != nil && !cont.sent || res.Status == StatusExpectationFailed {
 			closeConnection = true
-			res.Headers[HeaderConnection] = "close"
+			setConnectionClose(res)
+		} else {
+			if srv.IdleTimeout > 0 {
+				_ = conn.SetReadDeadline(time.Now().Add(srv.IdleTimeout))
+			}
+			if !discardBody(framed, body) {
+				closeConnection = true
+				setConnectionClose(res)
+			}
+			_ = conn.SetReadDeadline(time.Time{})
 		}
 
-		n, err := Write(conn, res)
+		var n int64
+		if res.stream != nil {
+			err = res.finishStream()
+			n = res.stream.written()
+		} else {
+			n, err = Write(conn, res)
+		}
+		// Handlers and streams may close the connection themselves.
+		if headerHasToken(res.Headers.Get(HeaderConnection), "close") {
+			closeConnection = true
+		}
 		if err != nil {
-			srv.log.Error("could not write request", slog.String("error", err.Error()))
+			req.Logger().Error("could not write request", slog.String("error", err.Error()))
 			break
 		}
-
-		srv.log.Info("handled request",
-			slog.String("method", req.Method),
-			slog.String("target", req.Target),
-			slog.Int64("bytes", n),
-		)
+		srv.logRequest(req, res, start, body.n, n)
 
 		if closeConnection {
 			break
@@ -106,6 +319,260 @@ func (srv *Server) handleConn(conn net.Conn) {
 	}
 }
 
+// refuseRequest answers req with status and no body, the connection is then
+// closed.
+func (srv *Server) refuseRequest(conn net.Conn, req *HttpRequest, start time.Time, status int) {
+	res := newCleanResponse()
+	setRequestID(req, res, srv.log)
+	srv.setDefaultHeaders(res)
+	res.Status = status
+	res.Headers[HeaderConnection] = "close"
+	if n, err := Write(conn, res); err == nil {
+		srv.logRequest(req, res, start, 0, n)
+	}
+}
+
+// delimitBody frames the body of req as RFC 9112, section 6.3 does: chunked
+// bodies are decoded and requests without Content-Length nor
+// Transfer-Encoding have none, Read would otherwise hand the handler the rest
+// of the connection. Other transfer codings are not supported.
+func delimitBody(req *HttpRequest, br *bufio.Reader) error {
+	te := req.Headers.Get(HeaderTransferEncoding)
+	switch {
+	case te == "":
+		if req.Body == io.Reader(br) {
+			req.Body = strings.NewReader("")
+		}
+	case req.Headers.Get(HeaderContentLength) != "":
+		// Both framings may disagree, as in request smuggling attempts.
+		return ErrContentLengthWithEncoding
+	case !strings.EqualFold(strings.TrimSpace(te), "chunked"):
+		return ErrUnsupportedTransferEncoding
+	default:
+		req.Body = &chunkedBody{r: httputil.NewChunkedReader(br), br: br}
+	}
+	return nil
+}
+
+// chunkedBody is a chunked request body, it knows whether it was read up to
+// the end of its trailer section.
+type chunkedBody struct {
+	r    io.Reader
+	br   *bufio.Reader
+	done bool
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		// The chunked reader stops at the last chunk, the trailer fields
+		// following it are skipped.
+		for {
+			line, terr := b.br.ReadString('\n')
+			if terr != nil {
+				return n, terr
+			}
+			if strings.TrimRight(line, "\r\n") == "" {
+				break
+			}
+		}
+		b.done = true
+	}
+	return n, err
+}
+
+// bodyRemaining returns how much of a body delimited by Read or delimitBody
+// is left to read, bounded is false for a body ending with the connection or
+// a chunked one not read to its end.
+func bodyRemaining(body io.Reader) (n int64, bounded bool) {
+	switch b := body.(type) {
+	case *io.LimitedReader:
+		return b.N, true
+	case *strings.Reader:
+		return int64(b.Len()), true
+	case *chunkedBody:
+		return 0, b.done
+	}
+	return 0, false
+}
+
+// maxDiscardBodySize bounds the unread request body skipped to keep a
+// connection alive, larger ones close it.
+const maxDiscardBodySize = 256 << 10
+
+// discardBody reads what is left of the body framed, through body, and
+// reports whether the connection is positioned on the next request. Chunked
+// bodies are read up to maxDiscardBodySize to find their end.
+func discardBody(framed, body io.Reader) bool {
+	n, bounded := bodyRemaining(framed)
+	switch {
+	case bounded && n == 0:
+		return true
+	case bounded && n > maxDiscardBodySize:
+		return false
+	case !bounded:
+		if _, ok := framed.(*chunkedBody); !ok {
+			return false
+		}
+	}
+	_, err := io.CopyN(io.Discard, body, maxDiscardBodySize+1)
+	n, bounded = bodyRemaining(framed)
+	return errors.Is(err, io.EOF) && bounded && n == 0
+}
+
+// supportedVersions are the versions served by the HTTP/1 connection loop.
+var supportedVersions = []string{"HTTP/1.0", "HTTP/1.1"}
+
+// setKeepAlive applies the persistence rules of req's version, HTTP/1.0
+// connections close unless the client asks for keep-alive and HTTP/1.1
+// connections persist unless either side asks to close. It reports whether
+// the connection stays open after res.
+func (srv *Server) setKeepAlive(req *HttpRequest, res *HttpResponse, requestIndex int) bool {
+	connection := req.Headers.Get(HeaderConnection)
+	keepAlive := !headerHasToken(connection, "close")
+	if req.Version == "HTTP/1.0" {
+		keepAlive = keepAlive && headerHasToken(connection, "keep-alive")
+	}
+	if srv.MaxRequestsPerConn > 0 && requestIndex >= srv.MaxRequestsPerConn || srv.nearConnLimit() {
+		keepAlive = false
+	}
+
+	if !keepAlive {
+		setConnectionClose(res)
+		return false
+	}
+	if req.Version == "HTTP/1.0" {
+		res.Headers[HeaderConnection] = "keep-alive"
+	}
+
+	var params []string
+	if srv.IdleTimeout > 0 {
+		params = append(params, "timeout="+strconv.Itoa(int(srv.IdleTimeout.Seconds())))
+	}
+	if srv.MaxRequestsPerConn > 0 {
+		params = append(params, "max="+strconv.Itoa(srv.MaxRequestsPerConn-requestIndex))
+	}
+	if len(params) > 0 {
+		res.Headers[HeaderKeepAlive] = strings.Join(params, ", ")
+	}
+	return true
+}
+
+func setConnectionClose(res *HttpResponse) {
+	res.Headers[HeaderConnection] = "close"
+	res.Headers.Del(HeaderKeepAlive)
+}
+
+// serveRequest runs the handler for req and applies the server-wide response
+// policies, it is shared by every protocol version.
+func (srv *Server) serveRequest(req *HttpRequest, res *HttpResponse) {
+	setRequestID(req, res, srv.log)
+	srv.setDefaultHeaders(res)
+
+	if expectationFailed(req) {
+		res.Status = StatusExpectationFailed
+		return
+	}
+
+	if !srv.acquireRequest() {
+		res.Error(StatusServiceUnavailable, "")
+		res.Headers[HeaderRetryAfter] = "1"
+		return
+	}
+	if srv.MaxConcurrentRequests > 0 {
+		res.releaseSlot = sync.OnceFunc(srv.releaseRequest)
+	}
+	srv.Handler(req, res)
+	res.detach()
+	if res.hijacked || res.stream != nil {
+		return
+	}
+	if !statusIsValid(res.Status) {
+		req.Logger().Error("handler set an invalid status code", slog.Int("status", res.Status))
+		res.Reason = ""
+		res.Error(StatusInternalServerError, "")
+	}
+
+	acceptEncoding := parseAcceptEncodings(req.Headers[HeaderAcceptEncoding])
+	if slices.Contains(acceptEncoding, EncodingGzip) {
+		res.Headers[HeaderContentEncoding] = EncodingGzip
+	}
+}
+
+// setDefaultHeaders adds the Date and Server headers before the handler runs,
+// so handlers can override them or suppress them with Headers.Del.
+func (srv *Server) setDefaultHeaders(res *HttpResponse) {
+	res.Headers[HeaderDate] = httpDate(time.Now())
+	if srv.Name != "" {
+		res.Headers[HeaderServer] = srv.Name
+	}
+}
+
+// dateCache holds the formatted Date of the current second, most responses
+// within a second share it.
+var dateCache atomic.Pointer[cachedDate]
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+// httpDate formats t as an IMF-fixdate (RFC 9110, section 5.6.7).
+func httpDate(t time.Time) string {
+	unix := t.Unix()
+	if d := dateCache.Load(); d != nil && d.unix == unix {
+		return d.value
+	}
+	d := &cachedDate{unix: unix, value: t.UTC().Format(TimeFormat)}
+	dateCache.Store(d)
+	return d.value
+}
+
+func (srv *Server) logRequest(req *HttpRequest, res *HttpResponse, start time.Time, requestSize, responseSize int64) {
+	req.Logger().Info("handled request",
+		slog.String("method", req.Method),
+		slog.String("target", req.Target),
+		slog.Int64("bytes", responseSize),
+	)
+	if srv.AccessLog != nil {
+		srv.AccessLog.Log(AccessLogEntry{
+			Time:         start,
+			RemoteAddr:   req.RemoteIP(),
+			User:         req.User(),
+			Method:       req.Method,
+			Target:       req.Target,
+			Version:      req.Version,
+			Status:       res.Status,
+			Duration:     time.Since(start),
+			RequestSize:  requestSize,
+			ResponseSize: responseSize,
+			BodySize:     res.bodySize,
+			UserAgent:    req.Headers["User-Agent"],
+			Referer:      req.Headers["Referer"],
+			RequestID:    req.ID,
+		})
+	}
+}
+
+func setConnMetadata(req *HttpRequest, conn net.Conn, connID uint64, requestIndex int) {
+	if addr := conn.RemoteAddr(); addr != nil {
+		req.RemoteAddr = addr.String()
+	}
+	if addr := conn.LocalAddr(); addr != nil {
+		req.LocalAddr = addr.String()
+	}
+	req.ConnID = connID
+	req.ConnRequestIndex = requestIndex
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+}
+
 func parseAcceptEncodings(acceptEncHeader string) []string {
 	if acceptEncHeader == "" {
 		return []string{}
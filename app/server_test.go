@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startTestServer serves handler on a random local port and returns its address.
+func startTestServer(t *testing.T, handler Handler) string {
+	t.Helper()
+	srv, err := NewServerFromConfig("127.0.0.1:0", slog.New(NewNoopHandler()), handler)
+	if err != nil {
+		t.Fatalf("could not create server: %v", err)
+	}
+	return serveTestServer(t, srv, nil)
+}
+
+// serveTestServer serves srv on a random local port, wrapping the listener
+// when wrap is not nil, and returns its address.
+func serveTestServer(t *testing.T, srv *Server, wrap func(net.Listener) net.Listener) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	addr := l.Addr().String()
+	if wrap != nil {
+		l = wrap(l)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.dispatch(conn)
+		}
+	}()
+
+	return addr
+}
+
+// roundTrip writes raw requests to conn and reads a single response.
+func roundTrip(t *testing.T, conn net.Conn, br *bufio.Reader, rawReq string) (status string, headers HttpHeaders, body string) {
+	t.Helper()
+	if _, err := io.WriteString(conn, rawReq); err != nil {
+		t.Fatalf("could not write request: %v", err)
+	}
+
+	status, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("could not read status line: %v", err)
+	}
+	status = strings.TrimRight(status, "\r\n")
+
+	headers = HttpHeaders{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read headers: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		k, v, _ := strings.Cut(line, ":")
+		headers[k] = strings.TrimSpace(v)
+	}
+
+	if cl := headers[HeaderContentLength]; cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil {
+			t.Fatalf("invalid content length: %v", err)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(br, buf); err != nil && !errors.Is(err, io.EOF) {
+			t.Fatalf("could not read body: %v", err)
+		}
+		body = string(buf)
+	}
+
+	return status, headers, body
+}
+
+func TestConnMetadata(t *testing.T) {
+	reqs := make(chan HttpRequest, 2)
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		reqs <- *req
+		res.Status = StatusOK
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	roundTrip(t, conn, br, "GET / HTTP/1.1\r\n\r\n")
+	roundTrip(t, conn, br, "GET / HTTP/1.1\r\n\r\n")
+
+	got := []HttpRequest{<-reqs, <-reqs}
+	for i, req := range got {
+		if req.RemoteAddr != conn.LocalAddr().String() {
+			t.Errorf("invalid remote address, wanted: '%s', got: '%s'", conn.LocalAddr(), req.RemoteAddr)
+		}
+		if req.LocalAddr != addr {
+			t.Errorf("invalid local address, wanted: '%s', got: '%s'", addr, req.LocalAddr)
+		}
+		if req.RemoteIP() != "127.0.0.1" {
+			t.Errorf("invalid remote ip, wanted: '127.0.0.1', got: '%s'", req.RemoteIP())
+		}
+		if req.ConnRequestIndex != i+1 {
+			t.Errorf("invalid request index, wanted: %d, got: %d", i+1, req.ConnRequestIndex)
+		}
+		if req.TLS != nil {
+			t.Errorf("wanted TLS to be nil for plain-text connection")
+		}
+	}
+	if got[0].ConnID == 0 || got[0].ConnID != got[1].ConnID {
+		t.Errorf("wanted the same non-zero connection id, got: %d and %d", got[0].ConnID, got[1].ConnID)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ids := make(chan string, 1)
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		ids <- req.ID
+	})
+
+	testCases := []struct {
+		desc     string
+		header   string
+		wantSame bool
+	}{
+		{
+			desc:     "no incoming request id",
+			header:   "",
+			wantSame: false,
+		},
+		{
+			desc:     "valid incoming request id",
+			header:   "X-Request-ID: 6f1c2a9e-4b8d-4b1e-9d62-07b3f1f1a2c3\r\n",
+			wantSame: true,
+		},
+		{
+			desc:     "incoming request id in lower case",
+			header:   "x-request-id: abc.123\r\n",
+			wantSame: true,
+		},
+		{
+			desc:     "invalid incoming request id",
+			header:   "X-Request-ID: bad id\"\r\n",
+			wantSame: false,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("could not dial server: %v", err)
+			}
+			defer conn.Close()
+
+			_, headers, _ := roundTrip(t, conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\n"+tC.header+"\r\n")
+			gotID := <-ids
+
+			if gotID == "" {
+				t.Fatalf("wanted request id to be set")
+			}
+			if headers[HeaderRequestID] != gotID {
+				t.Errorf("wanted response header '%s' to be '%s', got: '%s'", HeaderRequestID, gotID, headers[HeaderRequestID])
+			}
+			_, incoming, _ := strings.Cut(strings.TrimSpace(tC.header), ": ")
+			if same := gotID == incoming; same != tC.wantSame {
+				t.Errorf("wanted incoming id reuse to be %t, incoming: '%s', got: '%s'", tC.wantSame, incoming, gotID)
+			}
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		if req.Target == "/reject" {
+			res.Status = StatusForbidden
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		res.WriteStr(string(body))
+	})
+
+	dial := func(t *testing.T) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("could not dial server: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, bufio.NewReader(conn)
+	}
+
+	t.Run("continue sent on first read", func(t *testing.T) {
+		conn, br := dial(t)
+		status, _, _ := roundTrip(t, conn, br, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+		if status != "HTTP/1.1 100 Continue" {
+			t.Fatalf("invalid interim status line, wanted: 'HTTP/1.1 100 Continue', got: '%s'", status)
+		}
+		status, _, body := roundTrip(t, conn, br, "hello")
+		if status != "HTTP/1.1 200 OK" || body != "hello" {
+			t.Errorf("invalid response, wanted: 'HTTP/1.1 200 OK' with body 'hello', got: '%s' with body '%s'", status, body)
+		}
+
+		// The connection stays usable.
+		status, _, _ = roundTrip(t, conn, br, "GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n")
+		if status != "HTTP/1.1 200 OK" {
+			t.Errorf("invalid status line of second request, got: '%s'", status)
+		}
+	})
+
+	t.Run("early rejection", func(t *testing.T) {
+		conn, br := dial(t)
+		status, headers, _ := roundTrip(t, conn, br, "POST /reject HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+		if status != "HTTP/1.1 403 Forbidden" {
+			t.Errorf("invalid status line, wanted: 'HTTP/1.1 403 Forbidden', got: '%s'", status)
+		}
+		if headers[HeaderConnection] != "close" {
+			t.Errorf("wanted connection to be closed, got: '%s'", headers[HeaderConnection])
+		}
+		if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+			t.Errorf("wanted server to close the connection, got: %v", err)
+		}
+	})
+
+	t.Run("unknown expectation", func(t *testing.T) {
+		conn, br := dial(t)
+		status, _, _ := roundTrip(t, conn, br, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: something-else\r\n\r\n")
+		if status != "HTTP/1.1 417 Expectation Failed" {
+			t.Errorf("invalid status line, wanted: 'HTTP/1.1 417 Expectation Failed', got: '%s'", status)
+		}
+	})
+}
+
+func TestUnreadBody(t *testing.T) {
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		if req.Target == "/secret" {
+			res.WriteStr("secret")
+			return
+		}
+		res.Status = StatusUnauthorized
+	})
+
+	testCases := []struct {
+		desc       string
+		body       string
+		wantClosed bool
+	}{
+		{
+			desc: "skipped before the next request",
+			body: "GET /secret HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		},
+		{
+			desc:       "too large to skip",
+			body:       strings.Repeat("a", maxDiscardBodySize+1),
+			wantClosed: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("could not dial server: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			br := bufio.NewReader(conn)
+
+			// Both requests are pipelined, the body is never read by the handler.
+			raw := fmt.Sprintf("POST /x HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n%sGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n", len(tC.body), tC.body)
+			go io.WriteString(conn, raw)
+
+			status, headers, _ := roundTrip(t, conn, br, "")
+			if status != "HTTP/1.1 401 Unauthorized" {
+				t.Errorf("invalid status line, wanted: 'HTTP/1.1 401 Unauthorized', got: '%s'", status)
+			}
+			if tC.wantClosed {
+				if headers[HeaderConnection] != "close" {
+					t.Errorf("wanted connection to be closed, got: '%s'", headers[HeaderConnection])
+				}
+				// The unread body may turn the close into a reset.
+				if _, err := br.ReadByte(); err == nil {
+					t.Errorf("wanted server to close the connection")
+				}
+				return
+			}
+			status, _, body := roundTrip(t, conn, br, "")
+			if status != "HTTP/1.1 401 Unauthorized" || body == "secret" {
+				t.Errorf("wanted the body not to be served as a request, got: '%s' with body '%s'", status, body)
+			}
+		})
+	}
+}
+
+func TestChunkedRequestBody(t *testing.T) {
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		if req.Target == "/unread" {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		res.WriteStr(string(body))
+	})
+
+	testCases := []struct {
+		desc       string
+		target     string
+		headers    string
+		body       string
+		wantStatus string
+		wantBody   string
+		wantClosed bool
+	}{
+		{
+			desc:       "decoded",
+			target:     "/echo",
+			headers:    "Transfer-Encoding: chunked\r\n",
+			body:       "5\r\nhello\r\n6;ext=1\r\n world\r\n0\r\n\r\n",
+			wantStatus: "HTTP/1.1 200 OK",
+			wantBody:   "hello world",
+		},
+		{
+			desc:       "skipped when unread",
+			target:     "/unread",
+			headers:    "Transfer-Encoding: chunked\r\n",
+			body:       "5\r\nhello\r\n0\r\nX-Trailer: 1\r\n\r\n",
+			wantStatus: "HTTP/1.1 200 OK",
+		},
+		{
+			desc:       "other transfer coding",
+			target:     "/echo",
+			headers:    "Transfer-Encoding: gzip, chunked\r\n",
+			body:       "5\r\nhello\r\n0\r\n\r\n",
+			wantStatus: "HTTP/1.1 501 Not Implemented",
+			wantClosed: true,
+		},
+		{
+			desc:       "with content length",
+			target:     "/echo",
+			headers:    "Transfer-Encoding: chunked\r\nContent-Length: 3\r\n",
+			body:       "5\r\nhello\r\n0\r\n\r\n",
+			wantStatus: "HTTP/1.1 400 Bad Request",
+			wantClosed: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn, br := dialTestServer(t, addr)
+
+			status, headers, body := roundTrip(t, conn, br, "POST "+tC.target+" HTTP/1.1\r\nHost: localhost\r\n"+tC.headers+"\r\n"+tC.body)
+			if status != tC.wantStatus {
+				t.Fatalf("invalid status line, wanted: '%s', got: '%s'", tC.wantStatus, status)
+			}
+			if body != tC.wantBody {
+				t.Errorf("invalid body, wanted: '%s', got: '%s'", tC.wantBody, body)
+			}
+			if tC.wantClosed {
+				if headers[HeaderConnection] != "close" {
+					t.Errorf("wanted connection to be closed, got: '%s'", headers[HeaderConnection])
+				}
+				return
+			}
+			// The connection is positioned on the next request.
+			if status, _, body := roundTrip(t, conn, br, "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nnext"); status != "HTTP/1.1 200 OK" || body != "next" {
+				t.Errorf("invalid response to the next request, got: '%s' with body '%s'", status, body)
+			}
+		})
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	srv.IdleTimeout = 5 * time.Second
+	srv.MaxRequestsPerConn = 3
+	addr := serveTestServer(t, srv, nil)
+
+	testCases := []struct {
+		desc          string
+		requests      []string
+		wantStatus    string
+		wantKeepAlive []string
+		wantClosed    bool
+	}{
+		{
+			desc:       "http/1.0 closes by default",
+			requests:   []string{"GET / HTTP/1.0\r\n\r\n"},
+			wantStatus: "HTTP/1.0 200 OK",
+			wantClosed: true,
+		},
+		{
+			desc:          "http/1.0 keep-alive",
+			requests:      []string{"GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"},
+			wantStatus:    "HTTP/1.0 200 OK",
+			wantKeepAlive: []string{"timeout=5, max=2", "timeout=5, max=1"},
+		},
+		{
+			desc:       "http/1.1 close among other tokens",
+			requests:   []string{"GET / HTTP/1.1\r\nConnection: TE, Close\r\n\r\n"},
+			wantStatus: "HTTP/1.1 200 OK",
+			wantClosed: true,
+		},
+		{
+			desc:          "http/1.1 persists until the request limit",
+			requests:      []string{"GET / HTTP/1.1\r\n\r\n", "GET / HTTP/1.1\r\n\r\n", "GET / HTTP/1.1\r\n\r\n"},
+			wantStatus:    "HTTP/1.1 200 OK",
+			wantKeepAlive: []string{"timeout=5, max=2", "timeout=5, max=1", ""},
+			wantClosed:    true,
+		},
+		{
+			desc:       "unsupported version",
+			requests:   []string{"GET / HTTP/3.0\r\n\r\n"},
+			wantStatus: "HTTP/1.1 505 HTTP Version Not Supported",
+			wantClosed: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("could not dial server: %v", err)
+			}
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+
+			for i, raw := range tC.requests {
+				status, headers, _ := roundTrip(t, conn, br, raw)
+				if status != tC.wantStatus {
+					t.Errorf("invalid status line of request %d, wanted: '%s', got: '%s'", i, tC.wantStatus, status)
+				}
+				if tC.wantKeepAlive != nil && headers[HeaderKeepAlive] != tC.wantKeepAlive[i] {
+					t.Errorf("invalid keep-alive header of request %d, wanted: '%s', got: '%s'", i, tC.wantKeepAlive[i], headers[HeaderKeepAlive])
+				}
+			}
+
+			if tC.wantClosed {
+				if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+					t.Errorf("wanted server to close the connection, got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	srv.IdleTimeout = 50 * time.Millisecond
+	addr := serveTestServer(t, srv, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("wanted idle connection to be closed, got: %v", err)
+	}
+}
+
+func TestHeadResponse(t *testing.T) {
+	app := newMockApp(t)
+	addr := startTestServer(t, app.Handle)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// roundTrip would wait for the body announced by Content-Length.
+	io.WriteString(conn, "HEAD /echo/abc HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	var head []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		head = append(head, strings.TrimRight(line, "\r\n"))
+	}
+	if head[0] != "HTTP/1.1 200 OK" || !slices.Contains(head, "Content-Length: 3") {
+		t.Errorf("wanted 200 with the content length of GET, got: %v", head)
+	}
+
+	// Nothing follows the headers, the next response starts right away.
+	status, _, body := roundTrip(t, conn, br, "GET /echo/xyz HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if status != "HTTP/1.1 200 OK" || body != "xyz" {
+		t.Errorf("invalid response to the next request, got: '%s' with body '%s'", status, body)
+	}
+}
+
+func TestHTTPDate(t *testing.T) {
+	d := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.FixedZone("CET", 3600))
+	if got := httpDate(d); got != "Sun, 06 Nov 1994 07:49:37 GMT" {
+		t.Errorf("invalid date, wanted: 'Sun, 06 Nov 1994 07:49:37 GMT', got: '%s'", got)
+	}
+	// Within the same second the cached value is returned.
+	if got := httpDate(d.Add(500 * time.Millisecond)); got != "Sun, 06 Nov 1994 07:49:37 GMT" {
+		t.Errorf("invalid cached date, got: '%s'", got)
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), func(req *HttpRequest, res *HttpResponse) {
+		switch req.Target {
+		case "/override":
+			res.Headers[HeaderServer] = "custom"
+		case "/suppress":
+			res.Headers.Del(HeaderDate)
+			res.Headers.Del(HeaderServer)
+		}
+	})
+	srv.Name = "test-server"
+	addr := serveTestServer(t, srv, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	testCases := []struct {
+		desc       string
+		target     string
+		wantServer string
+		wantDate   bool
+	}{
+		{desc: "defaults", target: "/", wantServer: "test-server", wantDate: true},
+		{desc: "override", target: "/override", wantServer: "custom", wantDate: true},
+		{desc: "suppress", target: "/suppress", wantServer: "", wantDate: false},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, headers, _ := roundTrip(t, conn, br, "GET "+tC.target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			if headers[HeaderServer] != tC.wantServer {
+				t.Errorf("invalid server header, wanted: '%s', got: '%s'", tC.wantServer, headers[HeaderServer])
+			}
+			date, ok := headers[HeaderDate]
+			if ok != tC.wantDate {
+				t.Fatalf("invalid presence of the date header, wanted: %t, got: %t", tC.wantDate, ok)
+			}
+			if ok {
+				if _, err := time.Parse(TimeFormat, date); err != nil {
+					t.Errorf("invalid date header '%s': %v", date, err)
+				}
+			}
+		})
+	}
+}
+
+// flakyListener returns the queued errors from Accept, then ErrClosed.
+type flakyListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func (l *flakyListener) Close() error {
+	return nil
+}
+
+func TestAcceptErrors(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	var delays []time.Duration
+	srv.OnAcceptError = func(err error, delay time.Duration) {
+		delays = append(delays, delay)
+	}
+
+	err := srv.serve(&flakyListener{errs: []error{emfile, emfile, emfile}})
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("invalid error, wanted: '%v', got: '%v'", net.ErrClosed, err)
+	}
+	want := []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 0}
+	if !slices.Equal(delays, want) {
+		t.Errorf("invalid delays, wanted: %v, got: %v", want, delays)
+	}
+	if n := srv.AcceptErrors(); n != 4 {
+		t.Errorf("invalid accept error count, wanted: 4, got: %d", n)
+	}
+}
+
+func TestIsTemporaryAcceptError(t *testing.T) {
+	testCases := []struct {
+		desc string
+		err  error
+		want bool
+	}{
+		{desc: "closed listener", err: net.ErrClosed, want: false},
+		{desc: "too many open files", err: &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}, want: true},
+		{desc: "connection aborted", err: syscall.ECONNABORTED, want: true},
+		{desc: "timeout", err: &net.OpError{Op: "accept", Err: os.ErrDeadlineExceeded}, want: true},
+		{desc: "other error", err: errors.New("boom"), want: false},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if got := isTemporaryAcceptError(tC.err); got != tC.want {
+				t.Errorf("invalid result, wanted: %v, got: %v", tC.want, got)
+			}
+		})
+	}
+}
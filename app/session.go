@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+const HeaderCSRFToken = "X-CSRF-Token"
+
+var (
+	ErrNoSession            = errors.New("http: request has no session")
+	ErrInvalidSession       = errors.New("http: invalid session")
+	ErrSessionExpired       = errors.New("http: session expired")
+	ErrNoSessionKeys        = errors.New("http: at least one session signing key is required")
+	ErrInvalidEncryptionKey = errors.New("http: session encryption keys must be 16, 24 or 32 bytes long")
+)
+
+// Middleware wraps a handler with behaviour shared by several routes.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with mws, the first middleware runs first.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Session holds the values of a client across requests. It is not safe for
+// concurrent use, handlers must not share it between goroutines.
+type Session struct {
+	ID string
+	// Expires is set by the store when the session is saved.
+	Expires time.Time
+
+	values  map[string]string
+	changed bool
+	// staleID is the ID replaced by Regenerate, removed from the store on save.
+	staleID string
+}
+
+func newSession() *Session {
+	return &Session{ID: newSessionID(), values: map[string]string{}}
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Session returns the session attached by the session middleware, nil without it.
+func (r *HttpRequest) Session() *Session {
+	return r.session
+}
+
+func (s *Session) Get(key string) string {
+	return s.values[key]
+}
+
+func (s *Session) Set(key, value string) {
+	s.values[key] = value
+	s.changed = true
+}
+
+func (s *Session) Delete(key string) {
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		s.changed = true
+	}
+}
+
+// Regenerate gives the session a new ID while keeping its values, it should be
+// called whenever the privilege level changes, e.g. after logging in.
+func (s *Session) Regenerate() {
+	if s.staleID == "" {
+		s.staleID = s.ID
+	}
+	s.ID = newSessionID()
+	s.changed = true
+}
+
+// SessionStore persists sessions, the cookie only carries the value returned by Save.
+type SessionStore interface {
+	// Load returns the session referenced by a cookie value.
+	Load(value string) (*Session, error)
+	// Save persists s, sets s.Expires and returns the new cookie value.
+	Save(s *Session) (string, error)
+	// Delete forgets the session with id, if the store is able to.
+	Delete(id string)
+}
+
+type SessionOptions struct {
+	// CookieName defaults to "session".
+	CookieName string
+	Path       string
+	Domain     string
+	Secure     bool
+	// SameSite defaults to Lax.
+	SameSite SameSite
+}
+
+// Sessions attaches a session to every request and saves it once the handler
+// returns if it was modified. Sessions of hijacked or streamed responses are
+// not saved since their headers are already written by then.
+func Sessions(store SessionStore, opts SessionOptions) Middleware {
+	if opts.CookieName == "" {
+		opts.CookieName = "session"
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.SameSite == SameSiteDefault {
+		opts.SameSite = SameSiteLax
+	}
+
+	return func(next Handler) Handler {
+		return func(req *HttpRequest, res *HttpResponse) {
+			var s *Session
+			if c, err := req.Cookie(opts.CookieName); err == nil {
+				s, err = store.Load(c.Value)
+				if err != nil && !errors.Is(err, ErrSessionExpired) {
+					req.Logger().Info("discarding session", slog.String("reason", err.Error()))
+				}
+			}
+			if s == nil {
+				s = newSession()
+			}
+			req.session = s
+
+			next(req, res)
+
+			if !s.changed || res.hijacked || res.stream != nil {
+				return
+			}
+			if s.staleID != "" {
+				store.Delete(s.staleID)
+				s.staleID = ""
+			}
+			value, err := store.Save(s)
+			if err != nil {
+				req.Logger().Error("could not save session", slog.String("error", err.Error()))
+				return
+			}
+			_ = res.SetCookie(&Cookie{
+				Name:     opts.CookieName,
+				Value:    value,
+				Path:     opts.Path,
+				Domain:   opts.Domain,
+				Expires:  s.Expires,
+				Secure:   opts.Secure || opts.SameSite == SameSiteNone,
+				HttpOnly: true,
+				SameSite: opts.SameSite,
+			})
+		}
+	}
+}
+
+// CookieSessionStore keeps the whole session in the cookie, signed with
+// HMAC-SHA256 and optionally encrypted with AES-GCM. The first key of each
+// list is used for new cookies, the others are still accepted so keys can
+// be rotated without logging everyone out.
+type CookieSessionStore struct {
+	ttl            time.Duration
+	signingKeys    [][]byte
+	encryptionKeys [][]byte
+}
+
+type cookieSession struct {
+	ID      string            `json:"id"`
+	Values  map[string]string `json:"v"`
+	Expires int64             `json:"exp"`
+}
+
+// NewCookieSessionStore creates a store of sessions valid for ttl. Without
+// encryption keys the values are readable, though not modifiable, by the client.
+func NewCookieSessionStore(ttl time.Duration, signingKeys, encryptionKeys [][]byte) (*CookieSessionStore, error) {
+	if len(signingKeys) == 0 {
+		return nil, ErrNoSessionKeys
+	}
+	for _, k := range encryptionKeys {
+		if _, err := aes.NewCipher(k); err != nil {
+			return nil, ErrInvalidEncryptionKey
+		}
+	}
+	return &CookieSessionStore{ttl: ttl, signingKeys: signingKeys, encryptionKeys: encryptionKeys}, nil
+}
+
+func (cs *CookieSessionStore) Save(s *Session) (string, error) {
+	s.Expires = time.Now().Add(cs.ttl).Truncate(time.Second)
+	payload, err := json.Marshal(cookieSession{ID: s.ID, Values: s.values, Expires: s.Expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+	if len(cs.encryptionKeys) > 0 {
+		if payload, err = sealSession(cs.encryptionKeys[0], payload); err != nil {
+			return "", err
+		}
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(cs.signingKeys[0], encoded)), nil
+}
+
+func (cs *CookieSessionStore) Load(value string) (*Session, error) {
+	encoded, mac, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrInvalidSession
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil {
+		return nil, ErrInvalidSession
+	}
+	if !verifySignature(cs.signingKeys, encoded, sig) {
+		return nil, ErrInvalidSession
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidSession
+	}
+	if len(cs.encryptionKeys) > 0 {
+		if payload, err = openSession(cs.encryptionKeys, payload); err != nil {
+			return nil, ErrInvalidSession
+		}
+	}
+
+	var cookie cookieSession
+	if err := json.Unmarshal(payload, &cookie); err != nil {
+		return nil, ErrInvalidSession
+	}
+	expires := time.Unix(cookie.Expires, 0)
+	if time.Now().After(expires) {
+		return nil, ErrSessionExpired
+	}
+	if cookie.Values == nil {
+		cookie.Values = map[string]string{}
+	}
+	return &Session{ID: cookie.ID, Expires: expires, values: cookie.Values}, nil
+}
+
+// Delete is a no-op, a cookie session stays valid until it expires.
+func (cs *CookieSessionStore) Delete(string) {}
+
+func sign(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func verifySignature(keys [][]byte, data string, sig []byte) bool {
+	for _, k := range keys {
+		if hmac.Equal(sign(k, data), sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func sealSession(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openSession(keys [][]byte, ciphertext []byte) ([]byte, error) {
+	for _, k := range keys {
+		aead, err := newGCM(k)
+		if err != nil || len(ciphertext) < aead.NonceSize() {
+			continue
+		}
+		nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+		if plaintext, err := aead.Open(nil, nonce, sealed, nil); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, ErrInvalidSession
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// MemorySessionStore keeps sessions in memory, the cookie only carries the
+// session ID. Expired sessions are evicted when accessed and by a sweep that
+// runs at most once per ttl.
+type MemorySessionStore struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+}
+
+type memorySession struct {
+	values  map[string]string
+	expires time.Time
+}
+
+func NewMemorySessionStore(ttl time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{
+		ttl:       ttl,
+		sessions:  make(map[string]memorySession),
+		lastSweep: time.Now(),
+	}
+}
+
+func (ms *MemorySessionStore) Load(id string) (*Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.sessions[id]
+	if !ok {
+		return nil, ErrInvalidSession
+	}
+	if time.Now().After(entry.expires) {
+		delete(ms.sessions, id)
+		return nil, ErrSessionExpired
+	}
+	return &Session{ID: id, Expires: entry.expires, values: maps.Clone(entry.values)}, nil
+}
+
+func (ms *MemorySessionStore) Save(s *Session) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(ms.lastSweep) >= ms.ttl {
+		ms.sweep(now)
+	}
+	s.Expires = now.Add(ms.ttl)
+	ms.sessions[s.ID] = memorySession{values: maps.Clone(s.values), expires: s.Expires}
+	return s.ID, nil
+}
+
+func (ms *MemorySessionStore) Delete(id string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, id)
+}
+
+// Len returns the number of stored sessions, including expired ones not yet evicted.
+func (ms *MemorySessionStore) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.sessions)
+}
+
+// sweep evicts expired sessions, the caller must hold ms.mu.
+func (ms *MemorySessionStore) sweep(now time.Time) {
+	for id, entry := range ms.sessions {
+		if now.After(entry.expires) {
+			delete(ms.sessions, id)
+		}
+	}
+	ms.lastSweep = now
+}
+
+const csrfSessionKey = "_csrf"
+
+// CSRFToken returns the CSRF token of the request session, creating it on
+// first use. Pages embed it so unsafe requests can send it back in the
+// X-CSRF-Token header.
+func CSRFToken(req *HttpRequest) (string, error) {
+	s := req.Session()
+	if s == nil {
+		return "", ErrNoSession
+	}
+	token := s.Get(csrfSessionKey)
+	if token == "" {
+		token = newSessionID()
+		s.Set(csrfSessionKey, token)
+	}
+	return token, nil
+}
+
+// CSRF rejects requests with unsafe methods whose X-CSRF-Token header does
+// not match the token of their session, it must run after Sessions.
+func CSRF(next Handler) Handler {
+	return func(req *HttpRequest, res *HttpResponse) {
+		switch req.Method {
+		case MethodGet, MethodHead, MethodOptions, MethodTrace:
+			next(req, res)
+			return
+		}
+
+		var want string
+		if s := req.Session(); s != nil {
+			want = s.Get(csrfSessionKey)
+		}
+		got := req.Headers.Get(HeaderCSRFToken)
+		if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			res.Error(StatusForbidden, "invalid CSRF token")
+			return
+		}
+		next(req, res)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieSessionStore(t *testing.T) {
+	oldKey, newKey := []byte("old-signing-key"), []byte("new-signing-key")
+	encKey := []byte("0123456789abcdef")
+
+	testCases := []struct {
+		desc           string
+		encryptionKeys [][]byte
+	}{
+		{desc: "signed"},
+		{desc: "signed and encrypted", encryptionKeys: [][]byte{encKey}},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			oldStore, err := NewCookieSessionStore(time.Hour, [][]byte{oldKey}, tC.encryptionKeys)
+			if err != nil {
+				t.Fatalf("could not create store: %v", err)
+			}
+			s := newSession()
+			s.Set("user", "admin")
+			value, err := oldStore.Save(s)
+			if err != nil {
+				t.Fatalf("could not save session: %v", err)
+			}
+			if tC.encryptionKeys != nil && strings.Contains(value, "YWRtaW4") {
+				t.Errorf("wanted session values to be encrypted, got: '%s'", value)
+			}
+
+			// A store rotated to a new key still accepts the old cookies.
+			store, _ := NewCookieSessionStore(time.Hour, [][]byte{newKey, oldKey}, tC.encryptionKeys)
+			loaded, err := store.Load(value)
+			if err != nil {
+				t.Fatalf("could not load session: %v", err)
+			}
+			if loaded.ID != s.ID || loaded.Get("user") != "admin" {
+				t.Errorf("invalid session, wanted id '%s' with user 'admin', got: '%s' with user '%s'", s.ID, loaded.ID, loaded.Get("user"))
+			}
+
+			tampered := strings.Replace(value, value[:4], "AAAA", 1)
+			if _, err := store.Load(tampered); !errors.Is(err, ErrInvalidSession) {
+				t.Errorf("invalid error for tampered cookie, wanted: '%v', got: '%v'", ErrInvalidSession, err)
+			}
+			retired, _ := NewCookieSessionStore(time.Hour, [][]byte{newKey}, tC.encryptionKeys)
+			if _, err := retired.Load(value); !errors.Is(err, ErrInvalidSession) {
+				t.Errorf("invalid error for retired key, wanted: '%v', got: '%v'", ErrInvalidSession, err)
+			}
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		store, _ := NewCookieSessionStore(-time.Hour, [][]byte{oldKey}, nil)
+		value, _ := store.Save(newSession())
+		if _, err := store.Load(value); !errors.Is(err, ErrSessionExpired) {
+			t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrSessionExpired, err)
+		}
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		if _, err := NewCookieSessionStore(time.Hour, nil, nil); !errors.Is(err, ErrNoSessionKeys) {
+			t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrNoSessionKeys, err)
+		}
+		if _, err := NewCookieSessionStore(time.Hour, [][]byte{oldKey}, [][]byte{[]byte("short")}); !errors.Is(err, ErrInvalidEncryptionKey) {
+			t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrInvalidEncryptionKey, err)
+		}
+	})
+}
+
+func TestMemorySessionStoreEviction(t *testing.T) {
+	store := NewMemorySessionStore(20 * time.Millisecond)
+	expired := newSession()
+	store.Save(expired)
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := store.Load(expired.ID); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrSessionExpired, err)
+	}
+
+	stale := newSession()
+	store.Save(stale)
+	time.Sleep(30 * time.Millisecond)
+	// Saving after a full ttl sweeps the sessions nobody loaded.
+	store.Save(newSession())
+	if n := store.Len(); n != 1 {
+		t.Errorf("invalid number of sessions after sweep, wanted: 1, got: %d", n)
+	}
+}
+
+// serveWithCookie runs h for a request carrying cookie and returns the response.
+func serveWithCookie(h Handler, method, cookie string, headers HttpHeaders) *HttpResponse {
+	if headers == nil {
+		headers = HttpHeaders{}
+	}
+	if cookie != "" {
+		headers[HeaderCookie] = cookie
+	}
+	res := newCleanResponse()
+	h(&HttpRequest{Method: method, Target: "/", Headers: headers}, res)
+	return res
+}
+
+func TestSessionsMiddleware(t *testing.T) {
+	store := NewMemorySessionStore(time.Hour)
+	var seen []string
+	h := Sessions(store, SessionOptions{CookieName: "sid"})(func(req *HttpRequest, res *HttpResponse) {
+		s := req.Session()
+		seen = append(seen, s.Get("count"))
+		s.Set("count", s.Get("count")+"i")
+	})
+
+	res := serveWithCookie(h, MethodGet, "", nil)
+	if len(res.cookies) != 1 || !strings.HasPrefix(res.cookies[0], "sid=") {
+		t.Fatalf("wanted a session cookie, got: %v", res.cookies)
+	}
+	if !strings.Contains(res.cookies[0], "HttpOnly") || !strings.Contains(res.cookies[0], "SameSite=Lax") {
+		t.Errorf("wanted an HttpOnly and SameSite=Lax cookie, got: '%s'", res.cookies[0])
+	}
+	cookie, _, _ := strings.Cut(res.cookies[0], ";")
+
+	serveWithCookie(h, MethodGet, cookie, nil)
+	if want := []string{"", "i"}; strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Errorf("invalid session values, wanted: %v, got: %v", want, seen)
+	}
+
+	t.Run("regenerate", func(t *testing.T) {
+		regen := Sessions(store, SessionOptions{CookieName: "sid"})(func(req *HttpRequest, res *HttpResponse) {
+			req.Session().Regenerate()
+		})
+		res := serveWithCookie(regen, MethodGet, cookie, nil)
+		if len(res.cookies) != 1 || strings.HasPrefix(res.cookies[0], cookie+";") {
+			t.Fatalf("wanted a new session cookie, got: %v", res.cookies)
+		}
+		oldID := strings.TrimPrefix(cookie, "sid=")
+		if _, err := store.Load(oldID); !errors.Is(err, ErrInvalidSession) {
+			t.Errorf("wanted old session to be deleted, got: %v", err)
+		}
+	})
+}
+
+func TestCSRF(t *testing.T) {
+	store := NewMemorySessionStore(time.Hour)
+	var token string
+	h := Chain(func(req *HttpRequest, res *HttpResponse) {
+		if req.Method == MethodGet {
+			token, _ = CSRFToken(req)
+		}
+	}, Sessions(store, SessionOptions{}), CSRF)
+
+	res := serveWithCookie(h, MethodGet, "", nil)
+	if token == "" || len(res.cookies) != 1 {
+		t.Fatalf("wanted a token stored in a new session, got token '%s' and cookies %v", token, res.cookies)
+	}
+	cookie, _, _ := strings.Cut(res.cookies[0], ";")
+
+	testCases := []struct {
+		desc       string
+		cookie     string
+		token      string
+		wantStatus int
+	}{
+		{desc: "valid token", cookie: cookie, token: token, wantStatus: StatusOK},
+		{desc: "missing token", cookie: cookie, wantStatus: StatusForbidden},
+		{desc: "wrong token", cookie: cookie, token: "nope", wantStatus: StatusForbidden},
+		{desc: "token without session", token: token, wantStatus: StatusForbidden},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			headers := HttpHeaders{}
+			if tC.token != "" {
+				headers[HeaderCSRFToken] = tC.token
+			}
+			res := serveWithCookie(h, MethodPost, tC.cookie, headers)
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	oldSigner, err := NewURLSigner([][]byte{[]byte("old key")})
+	if err != nil {
+		t.Fatalf("could not create signer: %v", err)
+	}
+	oldSigner.now = func() time.Time { return now }
+	signer, err := NewURLSigner([][]byte{[]byte("new key"), []byte("old key")})
+	if err != nil {
+		t.Fatalf("could not create signer: %v", err)
+	}
+	signer.now = func() time.Time { return now }
+
+	sign := func(s *URLSigner, method string) string {
+		target, err := s.Sign(method, "/files/a.txt", time.Hour)
+		if err != nil {
+			t.Fatalf("could not sign URL: %v", err)
+		}
+		return target
+	}
+	get := sign(signer, MethodGet)
+
+	testCases := []struct {
+		desc    string
+		method  string
+		target  string
+		wait    time.Duration
+		wantErr error
+	}{
+		{desc: "valid", method: MethodGet, target: get},
+		{desc: "head allowed by get", method: MethodHead, target: get},
+		{desc: "rotated key", method: MethodGet, target: sign(oldSigner, MethodGet)},
+		{desc: "post", method: MethodPost, target: sign(signer, MethodPost)},
+		{desc: "wrong method", method: MethodPost, target: get, wantErr: ErrSignedURLMethod},
+		{desc: "expired", method: MethodGet, target: get, wait: time.Hour, wantErr: ErrSignedURLExpired},
+		{desc: "other path", method: MethodGet, target: strings.Replace(get, "a.txt", "b.txt", 1), wantErr: ErrInvalidSignature},
+		{desc: "extended expiry", method: MethodGet, target: strings.Replace(get, "expires=17", "expires=27", 1), wantErr: ErrInvalidSignature},
+		{desc: "method changed", method: MethodPost, target: strings.Replace(get, "method=GET", "method=POST", 1), wantErr: ErrInvalidSignature},
+		{desc: "unsigned", method: MethodGet, target: "/files/a.txt", wantErr: ErrNoURLSignature},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			signer.now = func() time.Time { return now.Add(tC.wait) }
+			err := signer.Verify(&HttpRequest{Method: tC.method, Target: tC.target, Headers: HttpHeaders{}})
+			if !errors.Is(err, tC.wantErr) {
+				t.Errorf("invalid error, wanted: '%v', got: '%v'", tC.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestURLSignerMaxTTL(t *testing.T) {
+	signer, err := NewURLSigner([][]byte{[]byte("key")})
+	if err != nil {
+		t.Fatalf("could not create signer: %v", err)
+	}
+	signer.MaxTTL = time.Hour
+	if _, err := signer.Sign(MethodGet, "/files/a", 2*time.Hour); !errors.Is(err, ErrSignedURLTTL) {
+		t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrSignedURLTTL, err)
+	}
+	if _, err := NewURLSigner(nil); !errors.Is(err, ErrNoURLSigningKeys) {
+		t.Errorf("invalid error, wanted: '%v', got: '%v'", ErrNoURLSigningKeys, err)
+	}
+}
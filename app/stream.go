@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const HeaderTransferEncoding = "Transfer-Encoding"
+
+var (
+	ErrStreamingNotSupported = errors.New("http: response streaming not supported")
+	ErrStreamClosed          = errors.New("http: stream closed")
+)
+
+// ResponseStream sends the response body incrementally: headers are written
+// when the stream is started and data reaches the client on every Flush.
+type ResponseStream interface {
+	io.Writer
+	// Flush sends buffered data to the client.
+	Flush() error
+	// Done is closed when the client disconnects.
+	Done() <-chan struct{}
+}
+
+// responseStream is implemented by the protocol specific streams.
+type responseStream interface {
+	ResponseStream
+	// finish terminates the body once the handler returned.
+	finish() error
+	// written returns the number of bytes written to the connection.
+	written() int64
+}
+
+// Stream switches the response to streaming mode and writes the status line
+// and headers right away. Res.Body is ignored afterwards.
+func (r *HttpResponse) Stream() (ResponseStream, error) {
+	if r.stream != nil {
+		return r.stream, nil
+	}
+	if r.newStream == nil {
+		return nil, ErrStreamingNotSupported
+	}
+	if !statusIsValid(r.Status) {
+		return nil, ErrInvalidStatusCode
+	}
+	s, err := r.newStream()
+	if err != nil {
+		return nil, err
+	}
+	r.stream = s
+	r.detach()
+	return s, nil
+}
+
+// finishStream terminates the stream once the handler returned, after the
+// onFinish hooks stopped the goroutines still writing to it.
+func (r *HttpResponse) finishStream() error {
+	for _, f := range r.onFinish {
+		f()
+	}
+	return r.stream.finish()
+}
+
+// http1Stream writes a chunked body, or a raw body delimited by closing the
+// connection for HTTP/1.0 clients.
+type http1Stream struct {
+	conn    net.Conn
+	res     *HttpResponse
+	br      *bufio.Reader
+	bw      *bufio.Writer
+	chunked bool
+	// discard drops the body of HEAD, 204 and 304 responses.
+	discard bool
+	n       int64
+
+	done     chan struct{}
+	doneOnce sync.Once
+	stopOnce sync.Once
+	watched  bool
+	watching sync.WaitGroup
+	stopped  atomic.Bool
+}
+
+// newHTTP1Stream starts streaming res. With watch set a disconnect is noticed
+// by reading from br, which is only safe once the request body was read and
+// nothing else is buffered: the handler may still read the body and a pending
+// read returns right away. Otherwise a disconnect is noticed by a failed write.
+func newHTTP1Stream(conn net.Conn, br *bufio.Reader, req *HttpRequest, res *HttpResponse, watch bool) (*http1Stream, error) {
+	s := &http1Stream{
+		conn:    conn,
+		res:     res,
+		br:      br,
+		bw:      bufio.NewWriter(conn),
+		chunked: req.Version != "HTTP/1.0" && res.hasBody(),
+		discard: !res.hasBody(),
+		done:    make(chan struct{}),
+	}
+
+	res.Headers.Del(HeaderContentLength)
+	if s.chunked {
+		res.Headers[HeaderTransferEncoding] = "chunked"
+	} else if !s.discard {
+		setConnectionClose(res)
+	}
+
+	if err := s.writeHeader(res); err != nil {
+		return nil, err
+	}
+
+	if watch {
+		s.watched = true
+		s.watching.Add(1)
+		go s.watchDisconnect()
+	}
+	return s, nil
+}
+
+func (s *http1Stream) writeHeader(res *HttpResponse) error {
+	n, _ := fmt.Fprintf(s.bw, "%s %d %s\r\n", res.Version, res.Status, res.reasonPhrase())
+	s.n += int64(n)
+	for _, k := range slices.Sorted(maps.Keys(res.Headers)) {
+		n, _ = fmt.Fprintf(s.bw, "%s: %s\r\n", k, res.Headers[k])
+		s.n += int64(n)
+	}
+	for _, c := range res.cookies {
+		n, _ = fmt.Fprintf(s.bw, "%s: %s\r\n", HeaderSetCookie, c)
+		s.n += int64(n)
+	}
+	n, _ = s.bw.WriteString("\r\n")
+	s.n += int64(n)
+	return s.bw.Flush()
+}
+
+// watchDisconnect waits for the client to close the connection. Anything
+// readable, such as a pipelined request, stays buffered in br.
+func (s *http1Stream) watchDisconnect() {
+	defer s.watching.Done()
+	_, err := s.br.Peek(1)
+	if err != nil && !(s.stopped.Load() && errors.Is(err, os.ErrDeadlineExceeded)) {
+		s.disconnected()
+	}
+}
+
+func (s *http1Stream) disconnected() {
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+func (s *http1Stream) Write(p []byte) (int, error) {
+	n, err := s.write(p)
+	if err != nil {
+		s.disconnected()
+	}
+	return n, err
+}
+
+func (s *http1Stream) write(p []byte) (int, error) {
+	if s.discard {
+		return len(p), nil
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !s.chunked {
+		n, err := s.bw.Write(p)
+		s.n += int64(n)
+		s.res.bodySize += int64(n)
+		return n, err
+	}
+
+	n, _ := fmt.Fprintf(s.bw, "%x\r\n", len(p))
+	s.n += int64(n)
+	n, err := s.bw.Write(p)
+	s.n += int64(n)
+	s.res.bodySize += int64(n)
+	if err != nil {
+		return n, err
+	}
+	nn, err := s.bw.WriteString("\r\n")
+	s.n += int64(nn)
+	return n, err
+}
+
+func (s *http1Stream) Flush() error {
+	err := s.bw.Flush()
+	if err != nil {
+		s.disconnected()
+	}
+	return err
+}
+
+func (s *http1Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *http1Stream) finish() error {
+	s.stopWatching()
+	if s.chunked {
+		n, _ := s.bw.WriteString("0\r\n\r\n")
+		s.n += int64(n)
+	}
+	return s.bw.Flush()
+}
+
+// stopWatching interrupts the pending Peek so the connection can be reused.
+func (s *http1Stream) stopWatching() {
+	s.stopOnce.Do(func() {
+		if !s.watched {
+			return
+		}
+		s.stopped.Store(true)
+		_ = s.conn.SetReadDeadline(time.Now())
+		s.watching.Wait()
+		_ = s.conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (s *http1Stream) written() int64 {
+	return s.n
+}
+
+// SSEvent is a single server-sent event, empty fields are omitted.
+type SSEvent struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// SSEWriter sends server-sent events (text/event-stream) over a response stream.
+type SSEWriter struct {
+	// LastEventID is the Last-Event-ID sent by a reconnecting client, the
+	// handler can use it to resume the event stream.
+	LastEventID string
+
+	stream ResponseStream
+	stop   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewSSEWriter starts an event stream, a comment is sent every heartbeat
+// (when positive) to keep intermediaries from closing an idle connection.
+// The writer is closed when the handler returns if it did not do so.
+func NewSSEWriter(req *HttpRequest, res *HttpResponse, heartbeat time.Duration) (*SSEWriter, error) {
+	res.Status = StatusOK
+	res.Headers[HeaderContentType] = "text/event-stream"
+	res.Headers["Cache-Control"] = "no-cache"
+
+	stream, err := res.Stream()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &SSEWriter{
+		LastEventID: req.Headers.Get("Last-Event-ID"),
+		stream:      stream,
+		stop:        make(chan struct{}),
+	}
+	// Close waits for a pending write, none happens once the stream ends.
+	res.onFinish = append(res.onFinish, w.Close)
+	if heartbeat > 0 {
+		go w.heartbeat(heartbeat)
+	}
+	return w, nil
+}
+
+func (w *SSEWriter) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.stream.Done():
+			return
+		case <-ticker.C:
+			if err := w.write(": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Send writes ev and flushes it to the client.
+func (w *SSEWriter) Send(ev SSEvent) error {
+	return w.write(ev.String())
+}
+
+// Done is closed when the client disconnects.
+func (w *SSEWriter) Done() <-chan struct{} {
+	return w.stream.Done()
+}
+
+// Close stops the heartbeats, the stream itself ends when the handler returns.
+func (w *SSEWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.stop)
+	}
+}
+
+func (w *SSEWriter) write(s string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrStreamClosed
+	}
+	if _, err := io.WriteString(w.stream, s); err != nil {
+		return err
+	}
+	return w.stream.Flush()
+}
+
+// String renders ev in the text/event-stream format.
+func (ev SSEvent) String() string {
+	var sb strings.Builder
+	if ev.ID != "" {
+		sb.WriteString("id: " + stripNewlines(ev.ID) + "\n")
+	}
+	if ev.Event != "" {
+		sb.WriteString("event: " + stripNewlines(ev.Event) + "\n")
+	}
+	if ev.Retry > 0 {
+		sb.WriteString("retry: " + strconv.FormatInt(ev.Retry.Milliseconds(), 10) + "\n")
+	}
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+func stripNewlines(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEventString(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		event SSEvent
+		want  string
+	}{
+		{
+			desc:  "data only",
+			event: SSEvent{Data: "hello"},
+			want:  "data: hello\n\n",
+		},
+		{
+			desc:  "multi-line data",
+			event: SSEvent{Data: "first\r\nsecond\nthird"},
+			want:  "data: first\ndata: second\ndata: third\n\n",
+		},
+		{
+			desc:  "all fields",
+			event: SSEvent{ID: "42", Event: "update", Data: "{}", Retry: 3 * time.Second},
+			want:  "id: 42\nevent: update\nretry: 3000\ndata: {}\n\n",
+		},
+		{
+			desc:  "newlines in id are dropped",
+			event: SSEvent{ID: "4\n2", Data: "x"},
+			want:  "id: 42\ndata: x\n\n",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if got := tC.event.String(); got != tC.want {
+				t.Errorf("invalid event, wanted: '%q', got: '%q'", tC.want, got)
+			}
+		})
+	}
+}
+
+func TestChunkedStream(t *testing.T) {
+	proceed := make(chan struct{})
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		stream, err := res.Stream()
+		if err != nil {
+			t.Errorf("could not start stream: %v", err)
+			return
+		}
+		io.WriteString(stream, "first")
+		stream.Flush()
+		<-proceed
+		io.WriteString(stream, "second")
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+		t.Fatalf("wanted chunked response, got: %v", res.TransferEncoding)
+	}
+
+	first := make([]byte, len("first"))
+	if _, err := io.ReadFull(res.Body, first); err != nil || string(first) != "first" {
+		t.Fatalf("wanted first chunk before the handler returned, got: '%s' (err: %v)", first, err)
+	}
+	close(proceed)
+
+	rest, _ := io.ReadAll(res.Body)
+	if string(rest) != "second" {
+		t.Errorf("invalid rest of body, wanted: 'second', got: '%s'", rest)
+	}
+
+	// The connection is reusable after the stream ended.
+	status, _, body := roundTrip(t, conn, br, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if status != "HTTP/1.1 200 OK" {
+		t.Errorf("invalid status line of second request, got: '%s', body: '%s'", status, body)
+	}
+}
+
+func TestSSEClientDisconnect(t *testing.T) {
+	disconnected := make(chan struct{})
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		w, err := NewSSEWriter(req, res, 10*time.Millisecond)
+		if err != nil {
+			t.Errorf("could not start event stream: %v", err)
+			return
+		}
+		defer w.Close()
+
+		if w.LastEventID != "7" {
+			t.Errorf("invalid last event id, wanted: '7', got: '%s'", w.LastEventID)
+		}
+		w.Send(SSEvent{ID: "8", Data: "hello"})
+		select {
+		case <-w.Done():
+			close(disconnected)
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 7\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	if ct := res.Header.Get(HeaderContentType); ct != "text/event-stream" {
+		t.Errorf("invalid content type, wanted: 'text/event-stream', got: '%s'", ct)
+	}
+
+	events := bufio.NewReader(res.Body)
+	var got []string
+	for len(got) < 3 {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read event: %v", err)
+		}
+		got = append(got, line)
+	}
+	if want := "id: 8\ndata: hello\n\n"; strings.Join(got, "") != want {
+		t.Errorf("invalid event, wanted: '%q', got: '%q'", want, strings.Join(got, ""))
+	}
+	if line, _ := events.ReadString('\n'); line != ": heartbeat\n" {
+		t.Errorf("wanted heartbeat comment, got: '%q'", line)
+	}
+
+	conn.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Errorf("wanted handler to notice the disconnect")
+	}
+}
+
+func TestHTTP2Stream(t *testing.T) {
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		stream, err := res.Stream()
+		if err != nil {
+			t.Errorf("could not start stream: %v", err)
+			return
+		}
+		for _, s := range []string{"a", "b", "c"} {
+			io.WriteString(stream, s)
+			stream.Flush()
+		}
+	})
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	defer client.CloseIdleConnections()
+
+	res, err := client.Get("http://" + addr + "/stream")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("wanted HTTP/2 response, got: %s", res.Proto)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "abc" {
+		t.Errorf("invalid body, wanted: 'abc', got: '%s'", body)
+	}
+}
+
+func TestStreamBeforeReadingBody(t *testing.T) {
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		stream, err := res.Stream()
+		if err != nil {
+			t.Errorf("could not start stream: %v", err)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		stream.Write(body)
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "POST /stream HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	io.WriteString(conn, "hello")
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "hello" {
+		t.Errorf("invalid body, wanted: 'hello', got: '%s'", body)
+	}
+}
+
+func TestStreamDisconnectWithBufferedRequest(t *testing.T) {
+	disconnected := make(chan struct{}, 1)
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		w, err := NewSSEWriter(req, res, 10*time.Millisecond)
+		if err != nil {
+			t.Errorf("could not start event stream: %v", err)
+			return
+		}
+		defer w.Close()
+		select {
+		case <-w.Done():
+			disconnected <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+
+	// The pipelined request stays buffered while the first one streams.
+	io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\nGET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	conn.Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Errorf("wanted handler to notice the disconnect")
+	}
+}
+
+func TestSSEWriterNotClosed(t *testing.T) {
+	addr := startTestServer(t, func(req *HttpRequest, res *HttpResponse) {
+		if req.Target != "/events" {
+			res.WriteStr("next")
+			return
+		}
+		w, err := NewSSEWriter(req, res, time.Millisecond)
+		if err != nil {
+			t.Errorf("could not start event stream: %v", err)
+			return
+		}
+		// The handler returns without closing w, heartbeats must stop.
+		w.Send(SSEvent{Data: "hello"})
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\nGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("could not read events: %v", err)
+	}
+	if events := strings.ReplaceAll(string(body), ": heartbeat\n\n", ""); events != "data: hello\n\n" {
+		t.Errorf("invalid events, wanted: 'data: hello\\n\\n', got: '%q'", events)
+	}
+
+	// Time for a heartbeat to be written after the stream ended.
+	time.Sleep(10 * time.Millisecond)
+	status, _, next := roundTrip(t, conn, br, "")
+	if status != "HTTP/1.1 200 OK" || next != "next" {
+		t.Errorf("invalid response to the next request, got: '%s' with body '%s'", status, next)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const certReloadInterval = 10 * time.Second
+
+var ErrNoCertificates = errors.New("tls: no certificates configured")
+
+// StartTLS listens on srv.Addr and serves HTTPS. certFile and keyFile may be
+// empty when srv.TLSConfig already provides certificates.
+func (srv *Server) StartTLS(certFile, keyFile string) error {
+	cfg, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(tls.NewListener(l, cfg))
+}
+
+func (srv *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	var cfg *tls.Config
+	if srv.TLSConfig != nil {
+		cfg = srv.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{http2ALPN, "http/1.1"}
+	}
+
+	if certFile != "" || keyFile != "" {
+		store := NewCertStore(srv.log)
+		if err := store.Add(certFile, keyFile); err != nil {
+			return nil, err
+		}
+		srv.onClose(store.Watch(certReloadInterval))
+		cfg.GetCertificate = store.GetCertificate
+	}
+
+	if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil && cfg.GetConfigForClient == nil {
+		return nil, ErrNoCertificates
+	}
+	return cfg, nil
+}
+
+// CertStore holds certificate/key pairs loaded from disk, selects one per
+// connection based on SNI and reloads them when the files change.
+type CertStore struct {
+	log *slog.Logger
+
+	mu    sync.RWMutex
+	pairs []*certPair
+}
+
+type certPair struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+func NewCertStore(logger *slog.Logger) *CertStore {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &CertStore{log: logger}
+}
+
+// Add loads a certificate/key pair. The first pair added is the default for
+// clients without SNI or with an unknown server name.
+func (s *CertStore) Add(certFile, keyFile string) error {
+	pair := &certPair{certFile: certFile, keyFile: keyFile}
+	if err := pair.load(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.pairs = append(s.pairs, pair)
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.pairs) == 0 {
+		return nil, ErrNoCertificates
+	}
+	if hello.ServerName != "" {
+		for _, p := range s.pairs {
+			if hello.SupportsCertificate(p.cert) == nil {
+				return p.cert, nil
+			}
+		}
+	}
+	return s.pairs[0].cert, nil
+}
+
+// Reload reloads every pair whose files were modified since they were last loaded.
+// A pair that fails to load keeps serving its previous certificate.
+func (s *CertStore) Reload() error {
+	s.mu.RLock()
+	pairs := make([]*certPair, len(s.pairs))
+	copy(pairs, s.pairs)
+	s.mu.RUnlock()
+
+	var errs []error
+	for i, p := range pairs {
+		modTime, err := p.latestModTime()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !modTime.After(p.modTime) {
+			continue
+		}
+
+		fresh := &certPair{certFile: p.certFile, keyFile: p.keyFile}
+		if err := fresh.load(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.pairs[i] = fresh
+		s.mu.Unlock()
+		s.log.Info("reloaded certificate", slog.String("certFile", p.certFile))
+	}
+	return errors.Join(errs...)
+}
+
+// Watch periodically calls Reload until the returned stop function is called.
+func (s *CertStore) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.Reload(); err != nil {
+					s.log.Warn("could not reload certificates", slog.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+	return sync.OnceFunc(func() { close(done) })
+}
+
+func (p *certPair) load() error {
+	modTime, err := p.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: could not load key pair %s: %w", p.certFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	p.cert = &cert
+	p.modTime = modTime
+	return nil
+}
+
+func (p *certPair) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{p.certFile, p.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ClientCertPool loads PEM encoded CA certificates used to verify client certificates.
+func ClientCertPool(caFile string) (*x509.CertPool, error) {
+	buff, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buff) {
+		return nil, fmt.Errorf("tls: no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// VerifiedChain returns the verified client certificate chain, or nil when
+// the client did not present a certificate or the connection is not TLS.
+func (r *HttpRequest) VerifiedChain() []*x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0]
+}
+
+// HTTPSRedirectHandler permanently redirects every request to the same host
+// and target on httpsPort.
+func HTTPSRedirectHandler(httpsPort string) Handler {
+	return func(req *HttpRequest, res *HttpResponse) {
+		host := req.Headers.Get(HeaderHost)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if host == "" {
+			res.Status = StatusBadRequest
+			return
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		res.Status = StatusPermanentRedirect
+		res.Headers[HeaderLocation] = "https://" + host + req.Target
+	}
+}
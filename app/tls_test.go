@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert generates a certificate for dnsNames, self-signed when parent is nil,
+// and writes it as PEM files into a temporary directory.
+func newTestCert(t *testing.T, commonName string, dnsNames []string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+	}
+	tc.write(t, der, keyDer)
+	return tc
+}
+
+func (tc *testCert) write(t *testing.T, der, keyDer []byte) {
+	t.Helper()
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(tc.certFile, certPem, 0o600); err != nil {
+		t.Fatalf("could not write certificate: %v", err)
+	}
+	if err := os.WriteFile(tc.keyFile, keyPem, 0o600); err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+}
+
+// peerCommonName performs a TLS handshake with serverName and returns the server certificate CN.
+func peerCommonName(t *testing.T, addr, serverName string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	first := newTestCert(t, "first", []string{"localhost"}, nil, false)
+	second := newTestCert(t, "second", []string{"example.test"}, nil, false)
+
+	store := NewCertStore(slog.New(NewNoopHandler()))
+	if err := store.Add(first.certFile, first.keyFile); err != nil {
+		t.Fatalf("could not add certificate: %v", err)
+	}
+	if err := store.Add(second.certFile, second.keyFile); err != nil {
+		t.Fatalf("could not add certificate: %v", err)
+	}
+
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	cfg := &tls.Config{GetCertificate: store.GetCertificate}
+	addr := serveTestServer(t, srv, func(l net.Listener) net.Listener { return tls.NewListener(l, cfg) })
+
+	testCases := []struct {
+		desc       string
+		serverName string
+		wantCN     string
+	}{
+		{desc: "no sni uses the default certificate", serverName: "", wantCN: "first"},
+		{desc: "sni matching first certificate", serverName: "localhost", wantCN: "first"},
+		{desc: "sni matching second certificate", serverName: "example.test", wantCN: "second"},
+		{desc: "unknown sni uses the default certificate", serverName: "unknown.test", wantCN: "first"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if cn := peerCommonName(t, addr, tC.serverName); cn != tC.wantCN {
+				t.Errorf("invalid certificate served, wanted CN: '%s', got: '%s'", tC.wantCN, cn)
+			}
+		})
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	tc := newTestCert(t, "before", []string{"localhost"}, nil, false)
+
+	store := NewCertStore(slog.New(NewNoopHandler()))
+	if err := store.Add(tc.certFile, tc.keyFile); err != nil {
+		t.Fatalf("could not add certificate: %v", err)
+	}
+
+	// Replace the files with a new certificate and bump their modification time.
+	replacement := newTestCert(t, "after", []string{"localhost"}, nil, false)
+	certPem, _ := os.ReadFile(replacement.certFile)
+	keyPem, _ := os.ReadFile(replacement.keyFile)
+	os.WriteFile(tc.certFile, certPem, 0o600)
+	os.WriteFile(tc.keyFile, keyPem, 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(tc.certFile, future, future)
+	os.Chtimes(tc.keyFile, future, future)
+
+	if err := store.Reload(); err != nil {
+		t.Fatalf("could not reload certificates: %v", err)
+	}
+
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("could not get certificate: %v", err)
+	}
+	if cn := cert.Leaf.Subject.CommonName; cn != "after" {
+		t.Errorf("wanted reloaded certificate CN to be 'after', got: '%s'", cn)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, nil, true)
+	serverCert := newTestCert(t, "server", []string{"localhost"}, nil, false)
+	clientCert := newTestCert(t, "client", nil, ca, false)
+
+	pool, err := ClientCertPool(ca.certFile)
+	if err != nil {
+		t.Fatalf("could not load client ca: %v", err)
+	}
+
+	chains := make(chan []*x509.Certificate, 1)
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), func(req *HttpRequest, res *HttpResponse) {
+		chains <- req.VerifiedChain()
+	})
+	srv.TLSConfig = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	cfg, err := srv.tlsConfig(serverCert.certFile, serverCert.keyFile)
+	if err != nil {
+		t.Fatalf("could not build tls config: %v", err)
+	}
+	addr := serveTestServer(t, srv, func(l net.Listener) net.Listener { return tls.NewListener(l, cfg) })
+
+	clientPair, err := tls.LoadX509KeyPair(clientCert.certFile, clientCert.keyFile)
+	if err != nil {
+		t.Fatalf("could not load client key pair: %v", err)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientPair},
+	})
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+
+	status, _, _ := roundTrip(t, conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\n\r\n")
+	if status != "HTTP/1.1 200 OK" {
+		t.Errorf("invalid status line, wanted: 'HTTP/1.1 200 OK', got: '%s'", status)
+	}
+
+	chain := <-chains
+	if len(chain) != 2 {
+		t.Fatalf("wanted a verified chain of 2 certificates, got: %d", len(chain))
+	}
+	if cn := chain[0].Subject.CommonName; cn != "client" {
+		t.Errorf("invalid client certificate CN, wanted: 'client', got: '%s'", cn)
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		httpsPort    string
+		host         string
+		target       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{
+			desc:         "redirect to custom port",
+			httpsPort:    "4221",
+			host:         "localhost:8080",
+			target:       "/files/abc?x=1",
+			wantStatus:   StatusPermanentRedirect,
+			wantLocation: "https://localhost:4221/files/abc?x=1",
+		},
+		{
+			desc:         "redirect to default port",
+			httpsPort:    "443",
+			host:         "example.com",
+			target:       "/",
+			wantStatus:   StatusPermanentRedirect,
+			wantLocation: "https://example.com/",
+		},
+		{
+			desc:         "redirect ipv6 host",
+			httpsPort:    "4221",
+			host:         "[::1]:8080",
+			target:       "/",
+			wantStatus:   StatusPermanentRedirect,
+			wantLocation: "https://[::1]:4221/",
+		},
+		{
+			desc:       "missing host",
+			httpsPort:  "4221",
+			target:     "/",
+			wantStatus: StatusBadRequest,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			req := &HttpRequest{Target: tC.target, Headers: HttpHeaders{}}
+			if tC.host != "" {
+				req.Headers[HeaderHost] = tC.host
+			}
+			res := newCleanResponse()
+
+			HTTPSRedirectHandler(tC.httpsPort)(req, res)
+
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+			if got := res.Headers[HeaderLocation]; got != tC.wantLocation {
+				t.Errorf("invalid location, wanted: '%s', got: '%s'", tC.wantLocation, got)
+			}
+		})
+	}
+}
+
+func TestCloseStopsCertReload(t *testing.T) {
+	cert := newTestCert(t, "server", []string{"localhost"}, nil, false)
+	srv, _ := NewServerFromConfig("", slog.New(NewNoopHandler()), nil)
+	if _, err := srv.tlsConfig(cert.certFile, cert.keyFile); err != nil {
+		t.Fatalf("could not build tls config: %v", err)
+	}
+	if len(srv.closers) != 1 {
+		t.Fatalf("wanted the certificate reload to be stopped on Close, got %d closers", len(srv.closers))
+	}
+	if err := srv.Close(); err != nil {
+		t.Errorf("could not close server: %v", err)
+	}
+	if len(srv.closers) != 0 {
+		t.Errorf("wanted Close to stop the certificate reload, got %d closers left", len(srv.closers))
+	}
+}
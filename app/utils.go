@@ -22,3 +22,14 @@ func newBufferedReader(r io.Reader) *bufio.Reader {
 		return bufio.NewReader(r)
 	}
 }
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket server (RFC 6455) with optional permessage-deflate (RFC 7692).
+
+const (
+	HeaderSecWebSocketKey        = "Sec-WebSocket-Key"
+	HeaderSecWebSocketAccept     = "Sec-WebSocket-Accept"
+	HeaderSecWebSocketVersion    = "Sec-WebSocket-Version"
+	HeaderSecWebSocketProtocol   = "Sec-WebSocket-Protocol"
+	HeaderSecWebSocketExtensions = "Sec-WebSocket-Extensions"
+)
+
+const (
+	webSocketGUID          = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	webSocketVersion       = "13"
+	webSocketDeflate       = "permessage-deflate"
+	webSocketMaxControl    = 125
+	webSocketCloseTimeout  = 5 * time.Second
+	webSocketFragmentSize  = 64 << 10
+	webSocketMaxMessageDef = 32 << 20
+)
+
+// Message types, the values are the frame opcodes.
+const (
+	WebSocketText   = 0x1
+	WebSocketBinary = 0x2
+
+	webSocketContinuation = 0x0
+	webSocketClose        = 0x8
+	webSocketPing         = 0x9
+	webSocketPong         = 0xa
+)
+
+// Close status codes (RFC 6455, section 7.4.1).
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseUnsupportedData = 1003
+	WebSocketCloseNoStatus        = 1005
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseMessageTooBig   = 1009
+	WebSocketCloseInternalError   = 1011
+)
+
+var (
+	ErrWebSocketClosed = errors.New("websocket: connection closed")
+	deflateTail        = []byte{0x00, 0x00, 0xff, 0xff}
+)
+
+// WebSocketCloseError is returned by ReadMessage when the peer closed the connection.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with code %d: %s", e.Code, e.Reason)
+}
+
+// WebSocketHandler upgrades requests to WebSocket connections, its Serve
+// method can be mounted on a route like any other Handler.
+type WebSocketHandler struct {
+	// Handle is called once the connection is established, the connection
+	// is closed when it returns.
+	Handle func(ws *WebSocketConn, req *HttpRequest)
+	// Subprotocols supported by the server in order of preference.
+	Subprotocols []string
+	// CheckOrigin reports whether the request origin is allowed. When nil,
+	// requests with an Origin header must come from the same host.
+	CheckOrigin func(req *HttpRequest) bool
+	// EnableCompression negotiates permessage-deflate when the client offers it.
+	EnableCompression bool
+	// MaxMessageSize limits the size of a (reassembled) incoming message.
+	MaxMessageSize int64
+}
+
+// Serve performs the opening handshake and hands the connection to h.Handle.
+func (h *WebSocketHandler) Serve(req *HttpRequest, res *HttpResponse) {
+	if req.Method != MethodGet ||
+		!headerHasToken(req.Headers.Get(HeaderUpgrade), "websocket") ||
+		!headerHasToken(req.Headers.Get(HeaderConnection), "upgrade") {
+		res.Status = StatusUpgradeRequired
+		res.Headers[HeaderUpgrade] = "websocket"
+		res.Headers[HeaderConnection] = "Upgrade"
+		return
+	}
+	if req.Headers.Get(HeaderSecWebSocketVersion) != webSocketVersion {
+		res.Status = StatusUpgradeRequired
+		res.Headers[HeaderSecWebSocketVersion] = webSocketVersion
+		return
+	}
+	key := req.Headers.Get(HeaderSecWebSocketKey)
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		res.Status = StatusBadRequest
+		res.WriteStr("Invalid Sec-WebSocket-Key")
+		return
+	}
+	checkOrigin := h.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		res.Status = StatusForbidden
+		return
+	}
+
+	headers := HttpHeaders{
+		HeaderUpgrade:            "websocket",
+		HeaderConnection:         "Upgrade",
+		HeaderSecWebSocketAccept: webSocketAccept(key),
+	}
+	subprotocol := h.selectSubprotocol(req)
+	if subprotocol != "" {
+		headers[HeaderSecWebSocketProtocol] = subprotocol
+	}
+	compress := h.EnableCompression && offersDeflate(req.Headers.Get(HeaderSecWebSocketExtensions))
+	if compress {
+		// Resetting the compression context after every message in both
+		// directions keeps the implementation simple and memory bounded.
+		headers[HeaderSecWebSocketExtensions] = webSocketDeflate + "; server_no_context_takeover; client_no_context_takeover"
+	}
+
+	conn, rw, err := res.Hijack()
+	if err != nil {
+		res.Status = StatusInternalServerError
+		res.WriteStr("Could not upgrade connection: " + err.Error())
+		return
+	}
+	res.Status = StatusSwitchingProtocols
+	if err := writeInterimResponse(rw.Writer, StatusSwitchingProtocols, headers); err != nil {
+		req.Logger().Warn("could not write websocket handshake", slog.String("error", err.Error()))
+		conn.Close()
+		return
+	}
+
+	ws := newWebSocketConn(conn, rw.Reader, compress, h.MaxMessageSize)
+	ws.Subprotocol = subprotocol
+	defer ws.Close(WebSocketCloseNormal, "")
+
+	h.Handle(ws, req)
+}
+
+func (h *WebSocketHandler) selectSubprotocol(req *HttpRequest) string {
+	offered := strings.Split(req.Headers.Get(HeaderSecWebSocketProtocol), ",")
+	for i := range offered {
+		offered[i] = strings.TrimSpace(offered[i])
+	}
+	for _, p := range h.Subprotocols {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+func sameOrigin(req *HttpRequest) bool {
+	origin := req.Headers.Get(HeaderOrigin)
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Headers.Get(HeaderHost))
+}
+
+func offersDeflate(extensions string) bool {
+	for _, ext := range strings.Split(extensions, ",") {
+		name, _, _ := strings.Cut(ext, ";")
+		if strings.EqualFold(strings.TrimSpace(name), webSocketDeflate) {
+			return true
+		}
+	}
+	return false
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeInterimResponse writes a status line and headers without a body, as
+// required for 1xx responses.
+func writeInterimResponse(bw *bufio.Writer, status int, headers HttpHeaders) error {
+	fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", status, statusString(status))
+	for _, k := range slices.Sorted(maps.Keys(headers)) {
+		fmt.Fprintf(bw, "%s: %s\r\n", k, headers[k])
+	}
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// WebSocketConn is an established WebSocket connection. Reads must happen
+// from a single goroutine, writes are safe for concurrent use.
+type WebSocketConn struct {
+	// Subprotocol is the negotiated subprotocol, empty if none.
+	Subprotocol string
+
+	conn           net.Conn
+	br             *bufio.Reader
+	compress       bool
+	maxMessageSize int64
+
+	wmu       sync.Mutex
+	closeSent bool
+	closed    bool
+}
+
+func newWebSocketConn(conn net.Conn, br *bufio.Reader, compress bool, maxMessageSize int64) *WebSocketConn {
+	if maxMessageSize <= 0 {
+		maxMessageSize = webSocketMaxMessageDef
+	}
+	return &WebSocketConn{
+		conn:           conn,
+		br:             br,
+		compress:       compress,
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+type webSocketFrame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+func readWebSocketFrame(br *bufio.Reader, maxPayload int64) (webSocketFrame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return webSocketFrame{}, err
+	}
+	f := webSocketFrame{
+		fin:    hdr[0]&0x80 != 0,
+		rsv1:   hdr[0]&0x40 != 0,
+		opcode: hdr[0] & 0x0f,
+		masked: hdr[1]&0x80 != 0,
+	}
+	if hdr[0]&0x30 != 0 {
+		return f, &WebSocketCloseError{WebSocketCloseProtocolError, "reserved bits set"}
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > uint64(maxPayload) {
+		return f, &WebSocketCloseError{WebSocketCloseMessageTooBig, "frame too large"}
+	}
+
+	var mask [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(br, mask[:]); err != nil {
+			return f, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(br, f.payload); err != nil {
+		return f, err
+	}
+	if f.masked {
+		maskBytes(mask, f.payload)
+	}
+	return f, nil
+}
+
+// appendWebSocketFrame encodes a frame, mask is only used by clients.
+func appendWebSocketFrame(dst []byte, f webSocketFrame, mask [4]byte) []byte {
+	b0 := f.opcode
+	if f.fin {
+		b0 |= 0x80
+	}
+	if f.rsv1 {
+		b0 |= 0x40
+	}
+	var b1 byte
+	if f.masked {
+		b1 = 0x80
+	}
+
+	n := len(f.payload)
+	switch {
+	case n < 126:
+		dst = append(dst, b0, b1|byte(n))
+	case n <= 0xffff:
+		dst = append(dst, b0, b1|126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	default:
+		dst = append(dst, b0, b1|127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(n))
+	}
+
+	if !f.masked {
+		return append(dst, f.payload...)
+	}
+	dst = append(dst, mask[:]...)
+	start := len(dst)
+	dst = append(dst, f.payload...)
+	maskBytes(mask, dst[start:])
+	return dst
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// ReadMessage returns the next data message, reassembling fragments and
+// answering control frames. It returns a *WebSocketCloseError once the
+// peer closed the connection.
+func (ws *WebSocketConn) ReadMessage() (int, []byte, error) {
+	var (
+		msgType    byte
+		compressed bool
+		message    []byte
+	)
+
+	for {
+		f, err := readWebSocketFrame(ws.br, ws.maxMessageSize)
+		if err != nil {
+			return 0, nil, ws.fail(err)
+		}
+		if !f.masked {
+			return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "unmasked client frame"})
+		}
+
+		if f.opcode >= webSocketClose {
+			if !f.fin || len(f.payload) > webSocketMaxControl || f.rsv1 {
+				return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "invalid control frame"})
+			}
+			if err := ws.handleControl(f); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		switch {
+		case f.opcode == webSocketContinuation && msgType == 0:
+			return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "unexpected continuation frame"})
+		case f.opcode != webSocketContinuation && msgType != 0:
+			return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "expected continuation frame"})
+		case f.opcode != webSocketContinuation && f.opcode != WebSocketText && f.opcode != WebSocketBinary:
+			return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "unknown opcode"})
+		case f.opcode == webSocketContinuation && f.rsv1:
+			return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "rsv1 on continuation frame"})
+		case f.rsv1 && !ws.compress:
+			return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "compression not negotiated"})
+		}
+
+		if f.opcode != webSocketContinuation {
+			msgType, compressed = f.opcode, f.rsv1
+		}
+		if int64(len(message)+len(f.payload)) > ws.maxMessageSize {
+			return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseMessageTooBig, "message too large"})
+		}
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			if message, err = ws.inflate(message); err != nil {
+				return 0, nil, ws.fail(err)
+			}
+		}
+		if msgType == WebSocketText && !utf8.Valid(message) {
+			return 0, nil, ws.fail(&WebSocketCloseError{WebSocketCloseInvalidPayload, "invalid utf-8"})
+		}
+		return int(msgType), message, nil
+	}
+}
+
+func (ws *WebSocketConn) handleControl(f webSocketFrame) error {
+	switch f.opcode {
+	case webSocketPing:
+		return ws.writeFrame(webSocketFrame{fin: true, opcode: webSocketPong, payload: f.payload})
+	case webSocketPong:
+		return nil
+	case webSocketClose:
+		closeErr := &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+		switch {
+		case len(f.payload) == 1:
+			return ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "invalid close payload"})
+		case len(f.payload) >= 2:
+			closeErr.Code = int(binary.BigEndian.Uint16(f.payload))
+			closeErr.Reason = string(f.payload[2:])
+			if !validCloseCode(closeErr.Code) || !utf8.ValidString(closeErr.Reason) {
+				return ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "invalid close payload"})
+			}
+		}
+
+		// Echo the status code to complete the closing handshake.
+		code := closeErr.Code
+		if code == WebSocketCloseNoStatus {
+			code = WebSocketCloseNormal
+		}
+		ws.sendClose(code, "")
+		ws.closeConn()
+		return closeErr
+	default:
+		return ws.fail(&WebSocketCloseError{WebSocketCloseProtocolError, "unknown control opcode"})
+	}
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code >= 1000 && code <= 1011:
+		return code != 1004 && code != 1005 && code != 1006
+	default:
+		return false
+	}
+}
+
+// fail closes the connection after a read error, sending a close frame when
+// the error is a protocol violation.
+func (ws *WebSocketConn) fail(err error) error {
+	var closeErr *WebSocketCloseError
+	if errors.As(err, &closeErr) {
+		ws.sendClose(closeErr.Code, closeErr.Reason)
+	}
+	ws.closeConn()
+	return err
+}
+
+// WriteMessage sends a text or binary message, fragmenting large ones.
+func (ws *WebSocketConn) WriteMessage(msgType int, data []byte) error {
+	if msgType != WebSocketText && msgType != WebSocketBinary {
+		return fmt.Errorf("websocket: invalid message type %d", msgType)
+	}
+
+	compressed := false
+	if ws.compress && len(data) > 0 {
+		deflated, err := deflate(data)
+		if err != nil {
+			return err
+		}
+		data, compressed = deflated, true
+	}
+
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return ErrWebSocketClosed
+	}
+
+	var buf []byte
+	opcode := byte(msgType)
+	for first := true; first || len(data) > 0; first = false {
+		chunk := data[:min(len(data), webSocketFragmentSize)]
+		data = data[len(chunk):]
+		buf = appendWebSocketFrame(buf, webSocketFrame{
+			fin:     len(data) == 0,
+			rsv1:    compressed && first,
+			opcode:  opcode,
+			payload: chunk,
+		}, [4]byte{})
+		opcode = webSocketContinuation
+	}
+	_, err := ws.conn.Write(buf)
+	return err
+}
+
+// Ping sends a ping, the peer's pong is consumed by ReadMessage.
+func (ws *WebSocketConn) Ping(data []byte) error {
+	if len(data) > webSocketMaxControl {
+		return errors.New("websocket: ping payload too large")
+	}
+	return ws.writeFrame(webSocketFrame{fin: true, opcode: webSocketPing, payload: data})
+}
+
+// Close performs the closing handshake: it sends a close frame, waits for the
+// peer's close frame (discarding pending messages) and closes the connection.
+func (ws *WebSocketConn) Close(code int, reason string) error {
+	ws.wmu.Lock()
+	closed := ws.closed
+	ws.wmu.Unlock()
+	if closed {
+		return nil
+	}
+
+	if err := ws.sendClose(code, reason); err != nil {
+		ws.closeConn()
+		return err
+	}
+
+	_ = ws.conn.SetReadDeadline(time.Now().Add(webSocketCloseTimeout))
+	for {
+		f, err := readWebSocketFrame(ws.br, ws.maxMessageSize)
+		if err != nil || f.opcode == webSocketClose {
+			break
+		}
+	}
+	return ws.closeConn()
+}
+
+func (ws *WebSocketConn) writeFrame(f webSocketFrame) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return ErrWebSocketClosed
+	}
+	_, err := ws.conn.Write(appendWebSocketFrame(nil, f, [4]byte{}))
+	return err
+}
+
+func (ws *WebSocketConn) sendClose(code int, reason string) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return nil
+	}
+	ws.closeSent = true
+
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > webSocketMaxControl {
+		payload = payload[:webSocketMaxControl]
+	}
+	_, err := ws.conn.Write(appendWebSocketFrame(nil, webSocketFrame{fin: true, opcode: webSocketClose, payload: payload}, [4]byte{}))
+	return err
+}
+
+func (ws *WebSocketConn) closeConn() error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closed {
+		return nil
+	}
+	ws.closed = true
+	return ws.conn.Close()
+}
+
+func (ws *WebSocketConn) inflate(data []byte) ([]byte, error) {
+	// Append the tail removed by the sender plus an empty final block so the
+	// reader sees a complete stream.
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail), bytes.NewReader([]byte{0x01, 0x00, 0x00, 0xff, 0xff}))
+	r := flate.NewReader(src)
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, ws.maxMessageSize+1))
+	if err != nil {
+		return nil, &WebSocketCloseError{WebSocketCloseInvalidPayload, "invalid compressed data"}
+	}
+	if int64(len(out)) > ws.maxMessageSize {
+		return nil, &WebSocketCloseError{WebSocketCloseMessageTooBig, "message too large"}
+	}
+	return out, nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
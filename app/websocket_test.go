@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// RFC 6455, section 1.3.
+	if got := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("invalid accept key, wanted: 's3pPLMBiTxaQ9kYGzzhZRbK+xOo=', got: '%s'", got)
+	}
+}
+
+// dialWebSocket connects to the echo endpoint and completes the opening handshake.
+func dialWebSocket(t *testing.T, extraHeaders string) (net.Conn, *bufio.Reader, HttpHeaders) {
+	t.Helper()
+	app := newMockApp(t)
+	addr := startTestServer(t, app.Handle)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	br := bufio.NewReader(conn)
+
+	status, headers, _ := roundTrip(t, conn, br, "GET /ws/echo HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		extraHeaders+"\r\n")
+
+	if status != "HTTP/1.1 101 Switching Protocols" {
+		t.Fatalf("invalid status line, wanted: 'HTTP/1.1 101 Switching Protocols', got: '%s'", status)
+	}
+	if got := headers[HeaderSecWebSocketAccept]; got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("invalid accept header, got: '%s'", got)
+	}
+	return conn, br, headers
+}
+
+func writeClientFrame(t *testing.T, conn net.Conn, f webSocketFrame) {
+	t.Helper()
+	f.masked = true
+	if _, err := conn.Write(appendWebSocketFrame(nil, f, [4]byte{0x12, 0x34, 0x56, 0x78})); err != nil {
+		t.Fatalf("could not write frame: %v", err)
+	}
+}
+
+func readServerFrame(t *testing.T, br *bufio.Reader) webSocketFrame {
+	t.Helper()
+	f, err := readWebSocketFrame(br, 1<<20)
+	if err != nil {
+		t.Fatalf("could not read frame: %v", err)
+	}
+	if f.masked {
+		t.Errorf("wanted server frames to be unmasked")
+	}
+	return f
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	conn, br, _ := dialWebSocket(t, "")
+
+	// A fragmented text message with a ping in between.
+	writeClientFrame(t, conn, webSocketFrame{opcode: WebSocketText, payload: []byte("Hello, ")})
+	writeClientFrame(t, conn, webSocketFrame{fin: true, opcode: webSocketPing, payload: []byte("ping")})
+	writeClientFrame(t, conn, webSocketFrame{fin: true, opcode: webSocketContinuation, payload: []byte("World!")})
+
+	pong := readServerFrame(t, br)
+	if pong.opcode != webSocketPong || string(pong.payload) != "ping" {
+		t.Errorf("wanted pong with payload 'ping', got opcode: %d, payload: '%s'", pong.opcode, pong.payload)
+	}
+	echo := readServerFrame(t, br)
+	if echo.opcode != WebSocketText || !echo.fin || string(echo.payload) != "Hello, World!" {
+		t.Errorf("wanted echoed text 'Hello, World!', got opcode: %d, payload: '%s'", echo.opcode, echo.payload)
+	}
+
+	// Binary messages larger than a fragment come back fragmented.
+	large := bytes.Repeat([]byte{0xab}, webSocketFragmentSize+10)
+	writeClientFrame(t, conn, webSocketFrame{fin: true, opcode: WebSocketBinary, payload: large})
+	var got []byte
+	for i := 0; ; i++ {
+		f := readServerFrame(t, br)
+		if i == 0 && f.opcode != WebSocketBinary || i > 0 && f.opcode != webSocketContinuation {
+			t.Fatalf("invalid opcode of fragment %d: %d", i, f.opcode)
+		}
+		got = append(got, f.payload...)
+		if f.fin {
+			break
+		}
+	}
+	if !bytes.Equal(got, large) {
+		t.Errorf("invalid echoed binary message of length %d", len(got))
+	}
+
+	// Closing handshake.
+	writeClientFrame(t, conn, webSocketFrame{fin: true, opcode: webSocketClose, payload: binary.BigEndian.AppendUint16(nil, WebSocketCloseNormal)})
+	closeFrame := readServerFrame(t, br)
+	if closeFrame.opcode != webSocketClose || binary.BigEndian.Uint16(closeFrame.payload) != WebSocketCloseNormal {
+		t.Errorf("wanted close frame with code 1000, got opcode: %d, payload: %x", closeFrame.opcode, closeFrame.payload)
+	}
+	if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("wanted server to close the connection, got: %v", err)
+	}
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	conn, br, headers := dialWebSocket(t, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	if ext := headers[HeaderSecWebSocketExtensions]; !strings.HasPrefix(ext, webSocketDeflate) {
+		t.Fatalf("wanted permessage-deflate to be negotiated, got: '%s'", ext)
+	}
+
+	msg := strings.Repeat("compress me ", 100)
+	compressed, err := deflate([]byte(msg))
+	if err != nil {
+		t.Fatalf("could not compress message: %v", err)
+	}
+	writeClientFrame(t, conn, webSocketFrame{fin: true, rsv1: true, opcode: WebSocketText, payload: compressed})
+
+	f := readServerFrame(t, br)
+	if !f.rsv1 {
+		t.Fatalf("wanted echoed message to be compressed")
+	}
+	got, err := newWebSocketConn(nil, nil, true, 0).inflate(f.payload)
+	if err != nil {
+		t.Fatalf("could not decompress message: %v", err)
+	}
+	if string(got) != msg {
+		t.Errorf("invalid echoed message, wanted %d bytes, got %d bytes", len(msg), len(got))
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		frame    webSocketFrame
+		unmasked bool
+		wantCode uint16
+	}{
+		{
+			desc:     "unmasked frame",
+			frame:    webSocketFrame{fin: true, opcode: WebSocketText, payload: []byte("hi")},
+			unmasked: true,
+			wantCode: WebSocketCloseProtocolError,
+		},
+		{
+			desc:     "invalid utf-8 text",
+			frame:    webSocketFrame{fin: true, opcode: WebSocketText, payload: []byte{0xff, 0xfe}},
+			wantCode: WebSocketCloseInvalidPayload,
+		},
+		{
+			desc:     "unexpected continuation",
+			frame:    webSocketFrame{fin: true, opcode: webSocketContinuation, payload: []byte("hi")},
+			wantCode: WebSocketCloseProtocolError,
+		},
+		{
+			desc:     "fragmented control frame",
+			frame:    webSocketFrame{fin: false, opcode: webSocketPing},
+			wantCode: WebSocketCloseProtocolError,
+		},
+		{
+			desc:     "compressed frame without negotiation",
+			frame:    webSocketFrame{fin: true, rsv1: true, opcode: WebSocketText, payload: []byte("hi")},
+			wantCode: WebSocketCloseProtocolError,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn, br, _ := dialWebSocket(t, "")
+			if tC.unmasked {
+				conn.Write(appendWebSocketFrame(nil, tC.frame, [4]byte{}))
+			} else {
+				writeClientFrame(t, conn, tC.frame)
+			}
+
+			f := readServerFrame(t, br)
+			if f.opcode != webSocketClose || len(f.payload) < 2 {
+				t.Fatalf("wanted close frame, got opcode: %d, payload: %x", f.opcode, f.payload)
+			}
+			if code := binary.BigEndian.Uint16(f.payload); code != tC.wantCode {
+				t.Errorf("invalid close code, wanted: %d, got: %d", tC.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestWebSocketHandshakeRejected(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		headers    HttpHeaders
+		wantStatus int
+	}{
+		{
+			desc:       "missing upgrade",
+			headers:    HttpHeaders{},
+			wantStatus: StatusUpgradeRequired,
+		},
+		{
+			desc: "unsupported version",
+			headers: HttpHeaders{
+				"Upgrade": "websocket", "Connection": "Upgrade",
+				"Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==",
+			},
+			wantStatus: StatusUpgradeRequired,
+		},
+		{
+			desc: "invalid key",
+			headers: HttpHeaders{
+				"Upgrade": "websocket", "Connection": "Upgrade",
+				"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short",
+			},
+			wantStatus: StatusBadRequest,
+		},
+		{
+			desc: "cross origin",
+			headers: HttpHeaders{
+				"Upgrade": "websocket", "Connection": "Upgrade", "Host": "localhost:4221",
+				"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==",
+				"Origin": "https://evil.example",
+			},
+			wantStatus: StatusForbidden,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			h := &WebSocketHandler{Handle: func(*WebSocketConn, *HttpRequest) {}}
+			res := newCleanResponse()
+			h.Serve(&HttpRequest{Method: MethodGet, Target: "/ws/echo", Headers: tC.headers}, res)
+
+			if res.Status != tC.wantStatus {
+				t.Errorf("invalid status, wanted: %d, got: %d", tC.wantStatus, res.Status)
+			}
+		})
+	}
+}
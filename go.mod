@@ -1,3 +1,5 @@
 module github.com/codecrafters-io/http-server-starter-go
 
 go 1.24.0
+
+require golang.org/x/crypto v0.45.0